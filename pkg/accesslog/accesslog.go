@@ -0,0 +1,77 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"gofly/pkg/engine/tunnel/statistic"
+)
+
+// Entry is one line of the access log, describing a closed flow.
+type Entry struct {
+	Time        time.Time `json:"time"`
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Client      string    `json:"client"`
+	Network     string    `json:"network"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Host        string    `json:"host,omitempty"`
+	Outbound    string    `json:"outbound"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+	Duration    float64   `json:"duration"` //Unit second
+	CloseReason string    `json:"close_reason"`
+}
+
+func NewEntry(info *statistic.TrackerInfo) *Entry {
+	return &Entry{
+		Time:        info.Start,
+		ID:          info.UUID.String(),
+		User:        info.User,
+		Client:      info.Client,
+		Network:     info.Metadata.Network.String(),
+		Source:      info.Metadata.SourceAddress(),
+		Destination: info.Metadata.DestinationAddress(),
+		Host:        info.Host,
+		Outbound:    info.Outbound,
+		Upload:      info.UploadTotal.Load(),
+		Download:    info.DownloadTotal.Load(),
+		Duration:    info.Duration().Seconds(),
+		CloseReason: info.CloseReason(),
+	}
+}
+
+// Logger writes entries as JSON lines.
+type Logger struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func Open(path string) (*Logger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{file: f, encoder: json.NewEncoder(f)}, nil
+}
+
+func (l *Logger) Write(e *Entry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.encoder.Encode(e)
+}
+
+// Record writes the final state of a closed flow, it fits statistic.Manager.SetRecorder.
+func (l *Logger) Record(info *statistic.TrackerInfo) {
+	_ = l.Write(NewEntry(info))
+}
+
+func (l *Logger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
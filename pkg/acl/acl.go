@@ -0,0 +1,277 @@
+package acl
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type Verdict int
+
+const (
+	// Unknown is returned when the verdict depends on the domain of a flow which is not known yet.
+	Unknown Verdict = iota
+	Allow
+	Deny
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Request describes a packet or a flow sent by a client.
+type Request struct {
+	User    string
+	Group   string
+	Network string
+	IP      netip.Addr
+	Port    uint16
+	Host    string
+	// HostKnown is set when Host is final, i.e. rules with domains can be decided.
+	HostKnown bool
+	// Packet is set for the ip packets routed between clients, they never carry a domain so
+	// the rules with domains are skipped.
+	Packet bool
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+type rule struct {
+	verdict  Verdict
+	network  string
+	prefixes []netip.Prefix
+	ports    []portRange
+	domains  []string
+	users    map[string]bool
+	groups   map[string]bool
+	hits     atomic.Uint64
+}
+
+// ACL evaluates the destination rules in order, the first matching rule wins.
+type ACL struct {
+	rules          []*rule
+	defaultVerdict Verdict
+	reject         bool
+	denied         atomic.Uint64
+}
+
+func New(c *Config) (*ACL, error) {
+	a := &ACL{defaultVerdict: Allow, reject: c.Reject}
+	if c.Default != "" {
+		v, err := parseAction(c.Default)
+		if err != nil {
+			return nil, err
+		}
+		a.defaultVerdict = v
+	}
+	for i, r := range c.Rules {
+		parsed, err := parseRule(&r)
+		if err != nil {
+			return nil, fmt.Errorf("acl rule %d: %w", i, err)
+		}
+		a.rules = append(a.rules, parsed)
+	}
+	return a, nil
+}
+
+func parseAction(s string) (Verdict, error) {
+	switch strings.ToLower(s) {
+	case ActionAllow:
+		return Allow, nil
+	case ActionDeny:
+		return Deny, nil
+	default:
+		return Unknown, fmt.Errorf("unsupported action: %s", s)
+	}
+}
+
+func parseRule(r *Rule) (*rule, error) {
+	v, err := parseAction(r.Action)
+	if err != nil {
+		return nil, err
+	}
+	parsed := &rule{verdict: v, network: strings.ToLower(r.Network)}
+	switch parsed.network {
+	case "", "tcp", "udp", "icmp":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", r.Network)
+	}
+	for _, s := range r.CIDR {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		parsed.prefixes = append(parsed.prefixes, prefix.Masked())
+	}
+	for _, s := range r.Ports {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed.ports = append(parsed.ports, pr)
+	}
+	for _, d := range r.Domains {
+		parsed.domains = append(parsed.domains, strings.ToLower(strings.Trim(d, ".")))
+	}
+	if len(r.Users) > 0 {
+		parsed.users = toSet(r.Users)
+	}
+	if len(r.Groups) > 0 {
+		parsed.groups = toSet(r.Groups)
+	}
+	return parsed, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || t < f {
+		return portRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	return portRange{from: uint16(f), to: uint16(t)}, nil
+}
+
+func toSet(s []string) map[string]bool {
+	m := make(map[string]bool, len(s))
+	for _, v := range s {
+		m[v] = true
+	}
+	return m
+}
+
+// Reject reports whether denied packets are answered with TCP RST / ICMP unreachable.
+func (a *ACL) Reject() bool {
+	return a.reject
+}
+
+// Evaluate returns the verdict of the first rule matching r.
+func (a *ACL) Evaluate(r *Request) Verdict {
+	for _, ru := range a.rules {
+		if !ru.matchWithoutDomain(r) {
+			continue
+		}
+		if len(ru.domains) > 0 {
+			if r.Packet {
+				continue
+			}
+			if !r.HostKnown {
+				return Unknown
+			}
+			if !ru.matchDomain(r.Host) {
+				continue
+			}
+		}
+		ru.hits.Add(1)
+		if ru.verdict == Deny {
+			a.denied.Add(1)
+		}
+		return ru.verdict
+	}
+	if a.defaultVerdict == Deny {
+		a.denied.Add(1)
+	}
+	return a.defaultVerdict
+}
+
+func (r *rule) matchWithoutDomain(req *Request) bool {
+	if r.network != "" && r.network != req.Network {
+		return false
+	}
+	if r.users != nil && !r.users[req.User] {
+		return false
+	}
+	if r.groups != nil && !r.groups[req.Group] {
+		return false
+	}
+	if len(r.prefixes) > 0 {
+		ip := req.IP.Unmap()
+		matched := false
+		for _, p := range r.prefixes {
+			if p.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.ports) > 0 {
+		matched := false
+		for _, p := range r.ports {
+			if req.Port >= p.from && req.Port <= p.to {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rule) matchDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleStats is the number of times a rule matched.
+type RuleStats struct {
+	Index  int    `json:"index"`
+	Action string `json:"action"`
+	Hits   uint64 `json:"hits"`
+}
+
+type Stats struct {
+	Denied uint64      `json:"denied"`
+	Rules  []RuleStats `json:"rules"`
+}
+
+func (a *ACL) Stats() *Stats {
+	s := &Stats{Denied: a.denied.Load()}
+	for i, r := range a.rules {
+		action := ActionAllow
+		if r.verdict == Deny {
+			action = ActionDeny
+		}
+		s.Rules = append(s.Rules, RuleStats{Index: i, Action: action, Hits: r.hits.Load()})
+	}
+	return s
+}
+
+// _default is the acl enforced by the servers and the engine, nil allows everything.
+var _default atomic.Pointer[ACL]
+
+func SetDefault(a *ACL) {
+	_default.Store(a)
+}
+
+func Default() *ACL {
+	return _default.Load()
+}
@@ -0,0 +1,116 @@
+package acl
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL_Evaluate(t *testing.T) {
+	a, err := New(&Config{
+		Rules: []Rule{
+			{Action: "allow", Groups: []string{"admin"}},
+			{Action: "deny", Network: "tcp", Ports: []string{"25", "465-587"}},
+			{Action: "deny", CIDR: []string{"169.254.169.254", "10.0.0.0/8"}},
+			{Action: "allow", Domains: []string{"example.com"}},
+			{Action: "deny", Ports: []string{"443"}},
+		},
+	})
+	assert.NoError(t, err)
+
+	smtp := &Request{Network: "tcp", IP: netip.MustParseAddr("1.1.1.1"), Port: 25}
+	assert.Equal(t, Deny, a.Evaluate(smtp))
+	smtp.Group = "admin"
+	assert.Equal(t, Allow, a.Evaluate(smtp))
+
+	metadata := &Request{Network: "tcp", IP: netip.MustParseAddr("169.254.169.254"), Port: 80}
+	assert.Equal(t, Deny, a.Evaluate(metadata))
+	assert.Equal(t, Unknown, a.Evaluate(&Request{Network: "udp", IP: netip.MustParseAddr("1.1.1.1"), Port: 587}))
+
+	https := &Request{Network: "tcp", IP: netip.MustParseAddr("93.184.216.34"), Port: 443}
+	assert.Equal(t, Unknown, a.Evaluate(https))
+	https.Host, https.HostKnown = "www.example.com", true
+	assert.Equal(t, Allow, a.Evaluate(https))
+	https.Host = "example.org"
+	assert.Equal(t, Deny, a.Evaluate(https))
+
+	stats := a.Stats()
+	assert.Equal(t, uint64(3), stats.Denied)
+	assert.Equal(t, uint64(1), stats.Rules[1].Hits)
+
+	_, err = New(&Config{Rules: []Rule{{Action: "drop"}}})
+	assert.Error(t, err)
+}
+
+func TestACL_EvaluatePacket(t *testing.T) {
+	a, err := New(&Config{
+		Default: "deny",
+		Rules: []Rule{
+			{Action: "allow", Domains: []string{"example.com"}},
+			{Action: "deny", CIDR: []string{"1.1.1.0/24"}},
+			{Action: "allow", Ports: []string{"80"}},
+		},
+	})
+	assert.NoError(t, err)
+
+	// the packets skip the rules with domains instead of stopping at them.
+	r, ok := PacketRequest(ipv4TCP(tcpFlagSYN), "alice", "")
+	assert.True(t, ok)
+	assert.Equal(t, Deny, a.Evaluate(r))
+	r.IP, r.Port = netip.MustParseAddr("2.2.2.2"), 80
+	assert.Equal(t, Allow, a.Evaluate(r))
+	r.Port = 443
+	assert.Equal(t, Deny, a.Evaluate(r))
+}
+
+func ipv4TCP(flags byte) []byte {
+	b := make([]byte, ipv4HeaderLength+tcpHeaderLength)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[9] = protocolTCP
+	copy(b[12:16], []byte{10, 0, 0, 2})
+	copy(b[16:20], []byte{1, 1, 1, 1})
+	t := b[ipv4HeaderLength:]
+	binary.BigEndian.PutUint16(t[0:2], 40000)
+	binary.BigEndian.PutUint16(t[2:4], 25)
+	binary.BigEndian.PutUint32(t[4:8], 1000)
+	t[12] = 5 << 4
+	t[13] = flags
+	return b
+}
+
+func TestRejectPacket(t *testing.T) {
+	syn := ipv4TCP(tcpFlagSYN)
+	r, ok := PacketRequest(syn, "alice", "")
+	assert.True(t, ok)
+	assert.Equal(t, "tcp", r.Network)
+	assert.Equal(t, uint16(25), r.Port)
+	assert.Equal(t, netip.MustParseAddr("1.1.1.1"), r.IP)
+
+	rst := RejectPacket(syn)
+	assert.Len(t, rst, ipv4HeaderLength+tcpHeaderLength)
+	assert.Equal(t, uint16(0), fold(sum(0, rst[:ipv4HeaderLength])))
+	assert.Equal(t, []byte{1, 1, 1, 1}, rst[12:16])
+	assert.Equal(t, []byte{10, 0, 0, 2}, rst[16:20])
+	tcp := rst[ipv4HeaderLength:]
+	assert.Equal(t, uint16(25), binary.BigEndian.Uint16(tcp[0:2]))
+	assert.Equal(t, uint16(40000), binary.BigEndian.Uint16(tcp[2:4]))
+	assert.Equal(t, uint32(1001), binary.BigEndian.Uint32(tcp[8:12]))
+	assert.Equal(t, byte(tcpFlagRST|tcpFlagACK), tcp[13])
+	src, _ := netip.AddrFromSlice(rst[12:16])
+	dst, _ := netip.AddrFromSlice(rst[16:20])
+	assert.Equal(t, uint16(0), transportChecksum(src, dst, protocolTCP, tcp))
+
+	assert.Nil(t, RejectPacket(ipv4TCP(tcpFlagRST)))
+
+	udp := ipv4TCP(0)
+	udp[9] = protocolUDP
+	unreachable := RejectPacket(udp)
+	assert.Equal(t, byte(protocolICMP), unreachable[9])
+	icmp := unreachable[ipv4HeaderLength:]
+	assert.Equal(t, []byte{3, 13}, icmp[0:2])
+	assert.Equal(t, uint16(0), fold(sum(0, icmp)))
+	assert.Equal(t, udp[:ipv4HeaderLength+8], icmp[8:])
+}
@@ -0,0 +1,17 @@
+package acl
+
+type Rule struct {
+	Action  string   `yaml:"action"`  //allow or deny
+	Network string   `yaml:"network"` //tcp, udp, icmp, or empty for any
+	CIDR    []string `yaml:"cidr"`
+	Ports   []string `yaml:"ports"`   //e.g. 25 or 8000-9000
+	Domains []string `yaml:"domains"` //matches the domain and its subdomains
+	Users   []string `yaml:"users"`
+	Groups  []string `yaml:"groups"`
+}
+
+type Config struct {
+	Rules   []Rule `yaml:"rules"`
+	Default string `yaml:"default"` //the action when no rule matches, allow or deny
+	Reject  bool   `yaml:"reject"`  //answer denied packets with TCP RST / ICMP unreachable instead of dropping them
+}
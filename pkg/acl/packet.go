@@ -0,0 +1,215 @@
+package acl
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+
+	ipv4HeaderLength = 20
+	ipv6HeaderLength = 40
+	tcpHeaderLength  = 20
+
+	// ipv6MinMTU bounds the size of an ICMPv6 error message (RFC 4443 2.4).
+	ipv6MinMTU = 1280
+)
+
+// packetInfo holds the fields of an ip packet the acl works on.
+type packetInfo struct {
+	version   int
+	protocol  int
+	src       netip.Addr
+	dst       netip.Addr
+	header    int // length of the ip header
+	fragment  bool
+	transport []byte
+}
+
+func parsePacket(b []byte) (*packetInfo, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+	p := &packetInfo{version: int(b[0] >> 4)}
+	switch p.version {
+	case 4:
+		if len(b) < ipv4HeaderLength {
+			return nil, false
+		}
+		p.header = int(b[0]&0x0f) * 4
+		if p.header < ipv4HeaderLength || len(b) < p.header {
+			return nil, false
+		}
+		p.protocol = int(b[9])
+		p.src = netip.AddrFrom4([4]byte(b[12:16]))
+		p.dst = netip.AddrFrom4([4]byte(b[16:20]))
+		p.fragment = binary.BigEndian.Uint16(b[6:8])&0x1fff != 0
+	case 6:
+		if len(b) < ipv6HeaderLength {
+			return nil, false
+		}
+		p.header = ipv6HeaderLength
+		p.protocol = int(b[6])
+		p.src = netip.AddrFrom16([16]byte(b[8:24]))
+		p.dst = netip.AddrFrom16([16]byte(b[24:40]))
+	default:
+		return nil, false
+	}
+	p.transport = b[p.header:]
+	return p, true
+}
+
+// PacketRequest returns the request of an ip packet sent by a client of user and group.
+func PacketRequest(b []byte, user, group string) (*Request, bool) {
+	p, ok := parsePacket(b)
+	if !ok {
+		return nil, false
+	}
+	r := &Request{User: user, Group: group, IP: p.dst, Packet: true}
+	switch p.protocol {
+	case protocolTCP, protocolUDP:
+		r.Network = "tcp"
+		if p.protocol == protocolUDP {
+			r.Network = "udp"
+		}
+		if !p.fragment && len(p.transport) >= 4 {
+			r.Port = binary.BigEndian.Uint16(p.transport[2:4])
+		}
+	case protocolICMP, protocolICMPv6:
+		r.Network = "icmp"
+	}
+	return r, true
+}
+
+// RejectPacket returns the TCP RST or ICMP unreachable answering a denied packet,
+// or nil when the packet must be dropped silently.
+func RejectPacket(b []byte) []byte {
+	p, ok := parsePacket(b)
+	if !ok || p.fragment {
+		return nil
+	}
+	switch p.protocol {
+	case protocolTCP:
+		return p.tcpReset()
+	case protocolICMP, protocolICMPv6:
+		// never answer icmp with icmp
+		return nil
+	default:
+		return p.unreachable(b)
+	}
+}
+
+func (p *packetInfo) tcpReset() []byte {
+	t := p.transport
+	if len(t) < tcpHeaderLength || t[13]&tcpFlagRST != 0 {
+		return nil
+	}
+	tcp := make([]byte, tcpHeaderLength)
+	copy(tcp[0:2], t[2:4])
+	copy(tcp[2:4], t[0:2])
+	if t[13]&tcpFlagACK != 0 {
+		copy(tcp[4:8], t[8:12])
+		tcp[13] = tcpFlagRST
+	} else {
+		length := uint32(len(t) - int(t[12]>>4)*4)
+		if t[13]&tcpFlagSYN != 0 {
+			length++
+		}
+		if t[13]&tcpFlagFIN != 0 {
+			length++
+		}
+		binary.BigEndian.PutUint32(tcp[8:12], binary.BigEndian.Uint32(t[4:8])+length)
+		tcp[13] = tcpFlagRST | tcpFlagACK
+	}
+	tcp[12] = tcpHeaderLength / 4 << 4
+	packet := p.ipHeader(protocolTCP, len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:18], transportChecksum(p.dst, p.src, protocolTCP, tcp))
+	return append(packet, tcp...)
+}
+
+func (p *packetInfo) unreachable(b []byte) []byte {
+	var icmp []byte
+	var protocol int
+	if p.version == 4 {
+		// type 3 code 13: communication administratively prohibited
+		icmp = []byte{3, 13, 0, 0, 0, 0, 0, 0}
+		n := p.header + 8
+		if n > len(b) {
+			n = len(b)
+		}
+		icmp = append(icmp, b[:n]...)
+		binary.BigEndian.PutUint16(icmp[2:4], fold(sum(0, icmp)))
+		protocol = protocolICMP
+	} else {
+		// type 1 code 1: communication with destination administratively prohibited
+		icmp = []byte{1, 1, 0, 0, 0, 0, 0, 0}
+		n := ipv6MinMTU - ipv6HeaderLength - len(icmp)
+		if n > len(b) {
+			n = len(b)
+		}
+		icmp = append(icmp, b[:n]...)
+		binary.BigEndian.PutUint16(icmp[2:4], transportChecksum(p.dst, p.src, protocolICMPv6, icmp))
+		protocol = protocolICMPv6
+	}
+	return append(p.ipHeader(protocol, len(icmp)), icmp...)
+}
+
+// ipHeader returns the header of a packet sent back from the destination to the source.
+func (p *packetInfo) ipHeader(protocol, payloadLength int) []byte {
+	if p.version == 4 {
+		h := make([]byte, ipv4HeaderLength)
+		h[0] = 0x45
+		binary.BigEndian.PutUint16(h[2:4], uint16(ipv4HeaderLength+payloadLength))
+		h[6] = 0x40 // don't fragment
+		h[8] = 64
+		h[9] = byte(protocol)
+		src, dst := p.dst.As4(), p.src.As4()
+		copy(h[12:16], src[:])
+		copy(h[16:20], dst[:])
+		binary.BigEndian.PutUint16(h[10:12], fold(sum(0, h)))
+		return h
+	}
+	h := make([]byte, ipv6HeaderLength)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:6], uint16(payloadLength))
+	h[6] = byte(protocol)
+	h[7] = 64
+	src, dst := p.dst.As16(), p.src.As16()
+	copy(h[8:24], src[:])
+	copy(h[24:40], dst[:])
+	return h
+}
+
+// transportChecksum returns the checksum of a transport segment including the pseudo header.
+func transportChecksum(src, dst netip.Addr, protocol int, segment []byte) uint16 {
+	s := sum(0, src.AsSlice())
+	s = sum(s, dst.AsSlice())
+	s += uint32(protocol) + uint32(len(segment))
+	return fold(sum(s, segment))
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func fold(s uint32) uint16 {
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gofly/pkg/acl"
+)
+
+// getACL returns the number of denied attempts and the hits of every acl rule.
+func (x *Server) getACL(c *gin.Context) {
+	a := acl.Default()
+	if a == nil {
+		c.JSON(http.StatusOK, &acl.Stats{})
+		return
+	}
+	c.JSON(http.StatusOK, a.Stats())
+}
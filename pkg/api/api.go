@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gofly/pkg/audit"
+	"gofly/pkg/config"
+	"gofly/pkg/logger"
+	"gofly/pkg/statistics"
+)
+
+// Server is the admin api server.
+type Server struct {
+	Config     *config.APIConfig
+	Statistics *statistics.Statistics
+	engine     *gin.Engine
+}
+
+func (x *Server) Init() {
+	x.engine = gin.New()
+	x.engine.Use(gin.Recovery())
+	x.registerDashboardRoutes(x.engine)
+	r := x.engine.Group("", x.audit, x.authenticate)
+	x.registerConnectionRoutes(r.Group("/connections"))
+	x.registerClientRoutes(r.Group("/clients"))
+	r.GET("/acl", x.getACL)
+	r.GET("/outbound", x.getOutbound)
+	r.GET("/ratelimit", x.getRateLimit)
+	r.GET("/quota", x.getQuota)
+	r.GET("/bans", x.getBans)
+	r.GET("/certificate", x.getCertificate)
+	x.registerStatsRoutes(r.Group("/stats"))
+}
+
+// Start runs the admin api server, it blocks until the server stops.
+func (x *Server) Start() {
+	logger.Logger.Sugar().Infof("gofly admin api started on %v", x.Config.ListenAddr)
+	if err := http.ListenAndServe(x.Config.ListenAddr, x.engine); err != nil {
+		logger.Logger.Error("admin api stopped", zap.Error(err))
+	}
+}
+
+// audit writes the request to the audit log once it is handled, with its status.
+func (x *Server) audit(c *gin.Context) {
+	c.Next()
+	e := &audit.Entry{
+		Type:    audit.Admin,
+		Outcome: audit.Success,
+		Remote:  c.Request.RemoteAddr,
+		Method:  c.Request.Method,
+		Path:    c.Request.URL.RequestURI(),
+		Status:  c.Writer.Status(),
+	}
+	if e.Status >= http.StatusBadRequest {
+		e.Outcome = audit.Failure
+		e.Detail = http.StatusText(e.Status)
+	}
+	audit.Log(e)
+}
+
+// authenticate checks the bearer token of the request against the configured secret.
+func (x *Server) authenticate(c *gin.Context) {
+	if x.Config.Secret == "" {
+		return
+	}
+	header := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || token != x.Config.Secret {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "unauthorized"})
+	}
+}
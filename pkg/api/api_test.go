@@ -0,0 +1,46 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/config"
+	"gofly/pkg/session"
+	"gofly/pkg/statistics"
+)
+
+func TestServer_Dashboard(t *testing.T) {
+	x := &Server{Config: &config.APIConfig{Secret: "demo_secret"}, Statistics: statistics.New()}
+	x.Init()
+
+	// the page is served without the secret, the api requires it.
+	w := httptest.NewRecorder()
+	x.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "gofly dashboard")
+
+	w = httptest.NewRecorder()
+	x.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	s := session.New("alice", "", "wss", nil)
+	var kicked error
+	s.OnKick(func(err error) { kicked = err })
+	x.Statistics.Push(s)
+
+	req := httptest.NewRequest(http.MethodDelete, "/clients/"+s.ID, nil)
+	req.Header.Set("Authorization", "Bearer demo_secret")
+	w = httptest.NewRecorder()
+	x.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.True(t, errors.Is(kicked, session.ErrKicked))
+
+	req = httptest.NewRequest(http.MethodDelete, "/clients/unknown", nil)
+	req.Header.Set("Authorization", "Bearer demo_secret")
+	w = httptest.NewRecorder()
+	x.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
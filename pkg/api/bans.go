@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gofly/pkg/ban"
+)
+
+// getBans returns the ips and subnets banned for failing their handshakes.
+func (x *Server) getBans(c *gin.Context) {
+	m := ban.Default()
+	if m == nil {
+		c.JSON(http.StatusOK, []*ban.Ban{})
+		return
+	}
+	c.JSON(http.StatusOK, m.Bans())
+}
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gofly/pkg/certwatch"
+)
+
+// getCertificate returns the wss certificate in use and the seconds until it expires.
+func (x *Server) getCertificate(c *gin.Context) {
+	w := certwatch.Default()
+	if w == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "no tls certificate"})
+		return
+	}
+	c.JSON(http.StatusOK, w.Info())
+}
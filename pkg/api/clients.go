@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (x *Server) registerClientRoutes(r *gin.RouterGroup) {
+	r.DELETE("/:id", x.kickClient)
+}
+
+// kickClient disconnects the online client with the given session id.
+func (x *Server) kickClient(c *gin.Context) {
+	s := x.Statistics.Lookup(c.Param("id"))
+	if s == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "client not found"})
+		return
+	}
+	if !s.Kick() {
+		c.JSON(http.StatusConflict, gin.H{"message": "client can not be kicked"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gofly/pkg/engine/tunnel/statistic"
+)
+
+func (x *Server) registerConnectionRoutes(r *gin.RouterGroup) {
+	r.GET("", x.getConnections)
+	r.DELETE("/:id", x.closeConnection)
+}
+
+// getConnections lists the currently open flows.
+func (x *Server) getConnections(c *gin.Context) {
+	c.JSON(http.StatusOK, statistic.DefaultManager.Snapshot())
+}
+
+// closeConnection closes the open flow with the given id.
+func (x *Server) closeConnection(c *gin.Context) {
+	err := statistic.DefaultManager.Close(c.Param("id"), statistic.CloseReasonAdmin)
+	if err == statistic.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// registerDashboardRoutes serves the dashboard, the page asks for the secret and sends it
+// with every api request.
+func (x *Server) registerDashboardRoutes(r *gin.Engine) {
+	sub, err := fs.Sub(dashboardFS, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	r.StaticFS("/dashboard", http.FS(sub))
+	r.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/dashboard/")
+	})
+}
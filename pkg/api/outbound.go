@@ -0,0 +1,29 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gofly/pkg/engine/outbound"
+	"gofly/pkg/engine/tunnel"
+)
+
+// Outbound describes the outbound of the engine.
+type Outbound struct {
+	Outbound string             `json:"outbound"`
+	UDP      *outbound.UDPStats `json:"udp,omitempty"` // how the udp flows are carried
+}
+
+// getOutbound returns the outbound of the engine and how it carries the udp flows.
+func (x *Server) getOutbound(c *gin.Context) {
+	p := tunnel.Outbound()
+	if p == nil {
+		c.JSON(http.StatusOK, &Outbound{})
+		return
+	}
+	c.JSON(http.StatusOK, &Outbound{
+		Outbound: fmt.Sprintf("%s://%s", outbound.Scheme(p), p.Addr()),
+		UDP:      outbound.UDPStatsOf(p),
+	})
+}
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gofly/pkg/quota"
+)
+
+// getQuota returns the traffic of every user with a quota in the current period.
+func (x *Server) getQuota(c *gin.Context) {
+	q := quota.Default()
+	if q == nil {
+		c.JSON(http.StatusOK, &quota.Snapshot{Users: []*quota.Usage{}})
+		return
+	}
+	c.JSON(http.StatusOK, q.Snapshot())
+}
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gofly/pkg/ratelimit"
+)
+
+// getRateLimit returns the number of packets dropped by the rate limits.
+func (x *Server) getRateLimit(c *gin.Context) {
+	l := ratelimit.Default()
+	if l == nil {
+		c.JSON(http.StatusOK, &ratelimit.Stats{})
+		return
+	}
+	c.JSON(http.StatusOK, l.Stats())
+}
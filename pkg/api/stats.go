@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gofly/pkg/statistics"
+)
+
+func (x *Server) registerStatsRoutes(r *gin.RouterGroup) {
+	r.GET("", x.getStats)
+	r.GET("/series", x.getSeries)
+	r.GET("/users", x.requireStore, x.getUserTraffic)
+	r.GET("/daily", x.requireStore, x.getDailyTraffic)
+	r.GET("/sessions", x.requireStore, x.getSessionHistory)
+}
+
+// getStats returns the traffic of the online and recently closed clients, and of every user.
+func (x *Server) getStats(c *gin.Context) {
+	c.JSON(http.StatusOK, x.Statistics.Snapshot())
+}
+
+// getSeries returns the throughput at the resolution given as query parameter, 1s, 1m or 1h.
+func (x *Server) getSeries(c *gin.Context) {
+	resolution, err := time.ParseDuration(c.DefaultQuery("resolution", "1s"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid resolution"})
+		return
+	}
+	points, ok := x.Statistics.Series(resolution)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "unsupported resolution"})
+		return
+	}
+	c.JSON(http.StatusOK, points)
+}
+
+// requireStore answers 404 when the statistics are not persisted.
+func (x *Server) requireStore(c *gin.Context) {
+	if statistics.DefaultStore() == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "statistics store disabled"})
+	}
+}
+
+// getUserTraffic returns the total traffic of every user.
+func (x *Server) getUserTraffic(c *gin.Context) {
+	users, err := statistics.DefaultStore().Users()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// getDailyTraffic returns the daily traffic of every user between the from and to days, like 2006-01-02.
+func (x *Server) getDailyTraffic(c *gin.Context) {
+	days, err := statistics.DefaultStore().Daily(c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, days)
+}
+
+// getSessionHistory returns the most recent closed sessions, of the user given as query parameter.
+func (x *Server) getSessionHistory(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid limit"})
+		return
+	}
+	sessions, err := statistics.DefaultStore().Sessions(c.Query("user"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sessions)
+}
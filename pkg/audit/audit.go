@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-units"
+	"gofly/pkg/logger"
+)
+
+// The entry types.
+const (
+	Handshake = "handshake"
+	Admin     = "admin"
+)
+
+// The outcomes.
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+const (
+	defaultMaxSize    = 100 * units.MiB
+	defaultMaxBackups = 5
+)
+
+// Entry is one line of the audit log.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Outcome  string    `json:"outcome"`
+	User     string    `json:"user,omitempty"`
+	Group    string    `json:"group,omitempty"`
+	Remote   string    `json:"remote"`
+	Protocol string    `json:"protocol,omitempty"`
+	SNI      string    `json:"sni,omitempty"`
+	ShortID  string    `json:"short_id,omitempty"`
+	Method   string    `json:"method,omitempty"` //the admin api request
+	Path     string    `json:"path,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// Logger appends entries as JSON lines to a file, the file is rotated to path.1, path.2...
+// when it reaches the max size.
+type Logger struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func Open(c *Config) (*Logger, error) {
+	l := &Logger{path: c.Path, maxSize: defaultMaxSize, maxBackups: c.MaxBackups}
+	if c.MaxSize != "" {
+		size, err := units.RAMInBytes(c.MaxSize)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid audit max_size: %q", c.MaxSize)
+		}
+		l.maxSize = size
+	}
+	if l.maxBackups <= 0 {
+		l.maxBackups = defaultMaxBackups
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, dropping the oldest, and starts a new file. The file is
+// reopened when it fails so the next entries are appended to it instead of being lost.
+func (l *Logger) rotate() error {
+	err := l.file.Close()
+	if err == nil {
+		err = l.shift()
+	}
+	if oerr := l.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (l *Logger) shift() error {
+	os.Remove(l.backup(l.maxBackups))
+	for i := l.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(l.backup(i), l.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(l.path, l.backup(1))
+}
+
+func (l *Logger) backup(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+func (l *Logger) Write(e *Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var rerr error
+	if l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		// the entry is still written when the file can not be rotated.
+		rerr = l.rotate()
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return errors.Join(rerr, err)
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+var _default atomic.Pointer[Logger]
+
+// Default returns the audit log of the server, nil when it is disabled.
+func Default() *Logger {
+	return _default.Load()
+}
+
+func SetDefault(l *Logger) {
+	_default.Store(l)
+}
+
+// Log writes e to the default audit log, if any.
+func Log(e *Entry) {
+	l := Default()
+	if l == nil {
+		return
+	}
+	if err := l.Write(e); err != nil {
+		logger.Logger.Sugar().Errorf("write audit log: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readEntries(t *testing.T, path string) []*Entry {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var entries []*Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &Entry{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(&Config{Path: path, MaxSize: "300B", MaxBackups: 2})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, l.Write(&Entry{Type: Handshake, Outcome: Failure, Remote: "127.0.0.1:1234", Detail: "authentication failed"}))
+	}
+	assert.NoError(t, l.Close())
+
+	total := 0
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(300))
+		entries := readEntries(t, p)
+		assert.NotEmpty(t, entries)
+		assert.Equal(t, Handshake, entries[0].Type)
+		total += len(entries)
+	}
+	assert.Less(t, total, 10)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// the log is appended to when reopened.
+	l, err = Open(&Config{Path: path, MaxSize: "1MB"})
+	assert.NoError(t, err)
+	before := len(readEntries(t, path))
+	assert.NoError(t, l.Write(&Entry{Type: Admin, Outcome: Success, Method: "GET", Path: "/stats", Status: 200}))
+	assert.NoError(t, l.Close())
+	entries := readEntries(t, path)
+	assert.Len(t, entries, before+1)
+	assert.Equal(t, "/stats", entries[before].Path)
+}
+
+func TestRotate_Failure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// a directory in the way of the rotated file makes the rotation fail.
+	assert.NoError(t, os.MkdirAll(filepath.Join(path+".1", "busy"), 0700))
+	l, err := Open(&Config{Path: path, MaxSize: "200B", MaxBackups: 1})
+	assert.NoError(t, err)
+	defer l.Close()
+	e := &Entry{Type: Handshake, Outcome: Failure, Remote: "127.0.0.1:1234", Detail: "authentication failed"}
+	assert.NoError(t, l.Write(e))
+	assert.Error(t, l.Write(e))
+	assert.Len(t, readEntries(t, path), 2)
+
+	// the rotation succeeds once the directory is gone.
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	assert.NoError(t, l.Write(e))
+	assert.Len(t, readEntries(t, path+".1"), 2)
+	assert.Len(t, readEntries(t, path), 1)
+}
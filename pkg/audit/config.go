@@ -0,0 +1,7 @@
+package audit
+
+type Config struct {
+	Path       string `yaml:"path"`        //disabled when empty
+	MaxSize    string `yaml:"max_size"`    //the size a file is rotated at, like 100MB, 100MB when empty
+	MaxBackups int    `yaml:"max_backups"` //the rotated files kept, 5 when 0
+}
@@ -0,0 +1,306 @@
+package ban
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gofly/pkg/logger"
+)
+
+// ErrBanned is returned for the clients of a banned ip or subnet.
+var ErrBanned = errors.New("banned")
+
+const (
+	defaultIPv4Prefix = 24
+	defaultIPv6Prefix = 64
+	defaultWindow     = 10 * time.Minute
+	defaultBanTime    = time.Minute
+	defaultMaxBanTime = 24 * time.Hour
+
+	cleanupInterval = time.Minute
+)
+
+// Ban is a banned ip or subnet.
+type Ban struct {
+	Key      string    `json:"key"` //the ip, or the subnet like 192.0.2.0/24
+	Subnet   bool      `json:"subnet"`
+	Failures int       `json:"failures"` //the failures in the current window
+	Bans     int       `json:"bans"`     //the times it was banned in a row
+	Until    time.Time `json:"until"`
+}
+
+type counter struct {
+	failures    int
+	windowStart time.Time
+	lastFailure time.Time
+	bans        int
+	until       time.Time
+}
+
+// Manager counts the failed handshakes of the ips and subnets and bans them, every ban lasts
+// twice the previous one until they stop failing for the max ban time.
+type Manager struct {
+	maxFailures       int
+	subnetMaxFailures int
+	ipv4Prefix        int
+	ipv6Prefix        int
+	window            time.Duration
+	banTime           time.Duration
+	maxBanTime        time.Duration
+	allow             []netip.Prefix
+
+	mu       sync.Mutex
+	counters map[string]*counter
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(c *Config) (*Manager, error) {
+	m := &Manager{
+		maxFailures:       c.MaxFailures,
+		subnetMaxFailures: c.SubnetMaxFailures,
+		ipv4Prefix:        c.IPv4Prefix,
+		ipv6Prefix:        c.IPv6Prefix,
+		window:            c.Window,
+		banTime:           c.BanTime,
+		maxBanTime:        c.MaxBanTime,
+		counters:          make(map[string]*counter),
+		done:              make(chan struct{}),
+	}
+	if m.ipv4Prefix == 0 {
+		m.ipv4Prefix = defaultIPv4Prefix
+	}
+	if m.ipv6Prefix == 0 {
+		m.ipv6Prefix = defaultIPv6Prefix
+	}
+	if m.ipv4Prefix < 0 || m.ipv4Prefix > 32 || m.ipv6Prefix < 0 || m.ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ban subnet prefix: /%d, /%d", c.IPv4Prefix, c.IPv6Prefix)
+	}
+	if m.window <= 0 {
+		m.window = defaultWindow
+	}
+	if m.banTime <= 0 {
+		m.banTime = defaultBanTime
+	}
+	if m.maxBanTime <= 0 {
+		m.maxBanTime = defaultMaxBanTime
+	}
+	for _, s := range c.Allow {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("ban allow: %w", err)
+		}
+		m.allow = append(m.allow, p)
+	}
+	m.wg.Add(1)
+	go m.run()
+	return m, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// parseIP returns the ip of addr, an ip or an ip:port.
+func parseIP(addr string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+func (m *Manager) allowed(ip netip.Addr) bool {
+	for _, p := range m.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) subnet(ip netip.Addr) string {
+	bits := m.ipv6Prefix
+	if ip.Is4() {
+		bits = m.ipv4Prefix
+	}
+	p, _ := ip.Prefix(bits)
+	return p.String()
+}
+
+// Check returns ErrBanned when the ip of addr, or its subnet, is banned.
+func (m *Manager) Check(addr string) error {
+	ip, ok := parseIP(addr)
+	if !ok || m.allowed(ip) {
+		return nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range []string{ip.String(), m.subnet(ip)} {
+		if c, ok := m.counters[key]; ok && now.Before(c.until) {
+			return ErrBanned
+		}
+	}
+	return nil
+}
+
+// Fail counts a failed handshake from addr, banning its ip or its subnet when they failed too often.
+func (m *Manager) Fail(addr string) {
+	ip, ok := parseIP(addr)
+	if !ok || m.allowed(ip) {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.maxFailures > 0 {
+		m.fail(ip.String(), m.maxFailures, now)
+	}
+	if m.subnetMaxFailures > 0 {
+		m.fail(m.subnet(ip), m.subnetMaxFailures, now)
+	}
+}
+
+func (m *Manager) fail(key string, max int, now time.Time) {
+	c, ok := m.counters[key]
+	if !ok {
+		c = &counter{}
+		m.counters[key] = c
+	}
+	if now.Sub(c.lastFailure) > m.maxBanTime {
+		// it behaved long enough, the next ban is the first one again.
+		c.bans = 0
+	}
+	if now.Sub(c.windowStart) > m.window {
+		c.failures, c.windowStart = 0, now
+	}
+	c.failures++
+	c.lastFailure = now
+	if c.failures < max || now.Before(c.until) {
+		return
+	}
+	d := m.banTime << c.bans
+	if d > m.maxBanTime || d <= 0 {
+		d = m.maxBanTime
+	}
+	c.bans++
+	c.failures, c.windowStart = 0, now
+	c.until = now.Add(d)
+	logger.Logger.Sugar().Warnf("%s banned for %v after too many failed handshakes", key, d)
+}
+
+// Succeed resets the failures of the ip of addr, the client authenticated.
+func (m *Manager) Succeed(addr string) {
+	ip, ok := parseIP(addr)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.counters[ip.String()]; ok {
+		c.failures = 0
+	}
+}
+
+// Bans returns the ips and subnets currently banned, the longest ban first.
+func (m *Manager) Bans() []*Ban {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bans := []*Ban{}
+	for key, c := range m.counters {
+		if now.Before(c.until) {
+			bans = append(bans, &Ban{
+				Key:      key,
+				Subnet:   strings.Contains(key, "/"),
+				Failures: c.failures,
+				Bans:     c.bans,
+				Until:    c.until,
+			})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.After(bans[j].Until) })
+	return bans
+}
+
+// cleanup drops the counters that are neither banned nor remembered for their next ban.
+func (m *Manager) cleanup(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, c := range m.counters {
+		keep := c.bans > 0 && now.Sub(c.lastFailure) <= m.maxBanTime
+		if !keep && now.After(c.until) && now.Sub(c.windowStart) > m.window {
+			delete(m.counters, key)
+		}
+	}
+}
+
+func (m *Manager) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.cleanup(now)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Manager) Close() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+var _default atomic.Pointer[Manager]
+
+// Default returns the brute-force protection of the servers, nil when it is disabled.
+func Default() *Manager {
+	return _default.Load()
+}
+
+func SetDefault(m *Manager) {
+	_default.Store(m)
+}
+
+// Check returns ErrBanned when addr is banned by the default manager, if any.
+func Check(addr string) error {
+	if m := Default(); m != nil {
+		return m.Check(addr)
+	}
+	return nil
+}
+
+// Fail counts a failed handshake from addr to the default manager, if any.
+func Fail(addr string) {
+	if m := Default(); m != nil {
+		m.Fail(addr)
+	}
+}
+
+// Succeed resets the failures of addr in the default manager, if any.
+func Succeed(addr string) {
+	if m := Default(); m != nil {
+		m.Succeed(addr)
+	}
+}
@@ -0,0 +1,70 @@
+package ban
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/logger"
+)
+
+func TestManager(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	m, err := New(&Config{MaxFailures: 3, SubnetMaxFailures: 5, BanTime: time.Minute, Allow: []string{"10.0.0.0/8"}})
+	assert.NoError(t, err)
+	defer m.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, m.Check("192.0.2.1:1000"))
+		m.Fail("192.0.2.1:1000")
+	}
+	assert.ErrorIs(t, m.Check("192.0.2.1:2000"), ErrBanned)
+	assert.NoError(t, m.Check("192.0.2.2:1000"))
+
+	// the failures of the other ips of the subnet ban the subnet.
+	m.Fail("192.0.2.2:1000")
+	m.Fail("192.0.2.3:1000")
+	assert.ErrorIs(t, m.Check("192.0.2.200:1000"), ErrBanned)
+	assert.NoError(t, m.Check("198.51.100.1:1000"))
+
+	bans := m.Bans()
+	assert.Len(t, bans, 2)
+	for _, b := range bans {
+		assert.Equal(t, 1, b.Bans)
+	}
+
+	// a success resets the failures of the ip.
+	m.Fail("198.51.100.1:1000")
+	m.Fail("198.51.100.1:1000")
+	m.Succeed("198.51.100.1:1000")
+	m.Fail("198.51.100.1:1000")
+	assert.NoError(t, m.Check("198.51.100.1:1000"))
+
+	for i := 0; i < 10; i++ {
+		m.Fail("10.1.2.3:1000")
+	}
+	assert.NoError(t, m.Check("10.1.2.3:1000"))
+}
+
+func TestManager_Exponential(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	m, err := New(&Config{MaxFailures: 1, BanTime: time.Minute, MaxBanTime: 3 * time.Minute})
+	assert.NoError(t, err)
+	defer m.Close()
+
+	now := time.Now()
+	var bans []time.Duration
+	for i := 0; i < 4; i++ {
+		m.fail("192.0.2.1", 1, now)
+		c := m.counters["192.0.2.1"]
+		bans = append(bans, c.until.Sub(now))
+		now = c.until
+	}
+	assert.Equal(t, []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}, bans)
+
+	// the level is forgotten after max ban time without failures.
+	now = now.Add(4 * time.Minute)
+	m.fail("192.0.2.1", 1, now)
+	assert.Equal(t, time.Minute, m.counters["192.0.2.1"].until.Sub(now))
+}
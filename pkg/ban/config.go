@@ -0,0 +1,19 @@
+package ban
+
+import "time"
+
+type Config struct {
+	MaxFailures       int           `yaml:"max_failures"`        //failed handshakes of an ip within the window before it is banned, disabled when 0
+	SubnetMaxFailures int           `yaml:"subnet_max_failures"` //failed handshakes of a subnet within the window before it is banned, disabled when 0
+	IPv4Prefix        int           `yaml:"ipv4_prefix"`         //the size of an ipv4 subnet, 24 when 0
+	IPv6Prefix        int           `yaml:"ipv6_prefix"`         //the size of an ipv6 subnet, 64 when 0
+	Window            time.Duration `yaml:"window"`              //10m when empty
+	BanTime           time.Duration `yaml:"ban_time"`            //the first ban, doubled by every next ban, 1m when empty
+	MaxBanTime        time.Duration `yaml:"max_ban_time"`        //24h when empty
+	Allow             []string      `yaml:"allow"`               //ips and cidrs never banned
+}
+
+// Enabled reports whether failed handshakes are counted.
+func (c *Config) Enabled() bool {
+	return c.MaxFailures > 0 || c.SubnetMaxFailures > 0
+}
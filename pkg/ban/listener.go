@@ -0,0 +1,31 @@
+package ban
+
+import (
+	"net"
+
+	"gofly/pkg/logger"
+)
+
+type listener struct {
+	net.Listener
+}
+
+// NewListener returns a listener closing the connections of the clients banned by the default
+// manager as soon as they are accepted, before any handshake.
+func NewListener(l net.Listener) net.Listener {
+	return &listener{l}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err = Check(conn.RemoteAddr().String()); err == nil {
+			return conn, nil
+		}
+		logger.Logger.Sugar().Debugf("refused %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
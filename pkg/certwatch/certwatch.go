@@ -0,0 +1,235 @@
+package certwatch
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lesismal/llib/std/crypto/tls"
+	"gofly/pkg/logger"
+	"gofly/pkg/webhook"
+)
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultWarnBefore    = 14 * 24 * time.Hour
+	// warnInterval is how often the expiry warning is repeated.
+	warnInterval = 24 * time.Hour
+)
+
+type Config struct {
+	CertFile      string
+	KeyFile       string
+	CheckInterval time.Duration //how often the files are checked for changes, 10s when empty
+	WarnBefore    time.Duration //the expiry is logged as a warning from that long before, 14 days when empty
+}
+
+// Info describes the certificate in use.
+type Info struct {
+	CertFile  string    `json:"cert_file"`
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dns_names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	ExpiresIn int64     `json:"expires_in"` //seconds until NotAfter, negative once expired
+	LoadedAt  time.Time `json:"loaded_at"`
+	Reloads   uint64    `json:"reloads"`
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// Watcher serves a certificate reloaded when its files change or on SIGHUP, the handshakes in
+// progress keep the certificate they started with.
+type Watcher struct {
+	certFile      string
+	keyFile       string
+	checkInterval time.Duration
+	warnBefore    time.Duration
+
+	cert     atomic.Pointer[tls.Certificate]
+	loadedAt atomic.Pointer[time.Time]
+	reloads  atomic.Uint64
+
+	mu       sync.Mutex
+	files    [2]fileState
+	lastWarn time.Time
+}
+
+func New(c *Config) (*Watcher, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("tls certificate file location not set")
+	}
+	w := &Watcher{
+		certFile:      c.CertFile,
+		keyFile:       c.KeyFile,
+		checkInterval: c.CheckInterval,
+		warnBefore:    c.WarnBefore,
+	}
+	if w.checkInterval <= 0 {
+		w.checkInterval = defaultCheckInterval
+	}
+	if w.warnBefore <= 0 {
+		w.warnBefore = defaultWarnBefore
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	w.checkExpiry(time.Now())
+	return w, nil
+}
+
+func (w *Watcher) stat() ([2]fileState, error) {
+	var files [2]fileState
+	for i, path := range []string{w.certFile, w.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return files, err
+		}
+		files[i] = fileState{size: info.Size(), modTime: info.ModTime()}
+	}
+	return files, nil
+}
+
+// load reads the certificate and its key, the current certificate is kept on error.
+func (w *Watcher) load() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files, err := w.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("parse %s: %w", w.certFile, err)
+	}
+	now := time.Now()
+	w.files = files
+	w.cert.Store(&cert)
+	w.loadedAt.Store(&now)
+	return nil
+}
+
+// changed reports whether a file changed since the last load.
+func (w *Watcher) changed() bool {
+	files, err := w.stat()
+	if err != nil {
+		// a file is being replaced, the next check will see it.
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return files != w.files
+}
+
+// Reload loads the files again, the current certificate is kept when they are invalid.
+func (w *Watcher) Reload() error {
+	if err := w.load(); err != nil {
+		logger.Logger.Sugar().Errorf("reload tls certificate %s: %v", w.certFile, err)
+		return err
+	}
+	w.reloads.Add(1)
+	info := w.Info()
+	logger.Logger.Sugar().Infof("tls certificate %s reloaded, it expires on %s", w.certFile, info.NotAfter.Format(time.RFC3339))
+	webhook.Emit(&webhook.Event{Type: webhook.ConfigReloaded, Detail: "tls certificate " + w.certFile})
+	w.checkExpiry(time.Now())
+	return nil
+}
+
+// checkExpiry logs a warning, once a day, when the certificate expires within warnBefore.
+func (w *Watcher) checkExpiry(now time.Time) {
+	leaf := w.cert.Load().Leaf
+	left := leaf.NotAfter.Sub(now)
+	if left > w.warnBefore {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now.Sub(w.lastWarn) < warnInterval {
+		return
+	}
+	w.lastWarn = now
+	if left <= 0 {
+		logger.Logger.Sugar().Warnf("tls certificate %s expired on %s", w.certFile, leaf.NotAfter.Format(time.RFC3339))
+		return
+	}
+	logger.Logger.Sugar().Warnf("tls certificate %s expires in %v", w.certFile, left.Round(time.Minute))
+}
+
+// GetCertificate returns the current certificate, it fits tls.Config.GetCertificate.
+func (w *Watcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.cert.Load(), nil
+}
+
+// GetStdCertificate is GetCertificate for the servers of crypto/tls.
+func (w *Watcher) GetStdCertificate(*stdtls.ClientHelloInfo) (*stdtls.Certificate, error) {
+	c := w.cert.Load()
+	return &stdtls.Certificate{
+		Certificate:                 c.Certificate,
+		PrivateKey:                  c.PrivateKey,
+		OCSPStaple:                  c.OCSPStaple,
+		SignedCertificateTimestamps: c.SignedCertificateTimestamps,
+		Leaf:                        c.Leaf,
+	}, nil
+}
+
+// Info describes the current certificate.
+func (w *Watcher) Info() *Info {
+	leaf := w.cert.Load().Leaf
+	return &Info{
+		CertFile:  w.certFile,
+		Subject:   leaf.Subject.String(),
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		ExpiresIn: int64(time.Until(leaf.NotAfter).Seconds()),
+		LoadedAt:  *w.loadedAt.Load(),
+		Reloads:   w.reloads.Load(),
+	}
+}
+
+// Run reloads the certificate when its files change or on SIGHUP until ctx is done.
+func (w *Watcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(w.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if w.changed() {
+				w.Reload()
+			}
+			w.checkExpiry(now)
+		case <-hup:
+			w.Reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+var _default atomic.Pointer[Watcher]
+
+// Default returns the watcher of the wss certificate, nil when there is none.
+func Default() *Watcher {
+	return _default.Load()
+}
+
+func SetDefault(w *Watcher) {
+	_default.Store(w)
+}
@@ -0,0 +1,67 @@
+package certwatch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/logger"
+)
+
+func writePair(t *testing.T, certFile, keyFile string, serial int64, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "vpn.example.com"},
+		DNSNames:     []string{"vpn.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func TestWatcher(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePair(t, certFile, keyFile, 1, time.Now().Add(24*time.Hour))
+
+	w, err := New(&Config{CertFile: certFile, KeyFile: keyFile})
+	assert.NoError(t, err)
+	cert, err := w.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), cert.Leaf.SerialNumber.Int64())
+	assert.False(t, w.changed())
+
+	writePair(t, certFile, keyFile, 2, time.Now().Add(90*24*time.Hour))
+	assert.True(t, w.changed())
+	assert.NoError(t, w.Reload())
+	assert.False(t, w.changed())
+	cert, _ = w.GetCertificate(nil)
+	assert.Equal(t, int64(2), cert.Leaf.SerialNumber.Int64())
+	info := w.Info()
+	assert.Equal(t, uint64(1), info.Reloads)
+	assert.Greater(t, info.ExpiresIn, int64(89*24*3600))
+
+	// an invalid pair keeps the current certificate.
+	assert.NoError(t, os.WriteFile(keyFile, []byte("invalid"), 0600))
+	assert.Error(t, w.Reload())
+	cert, _ = w.GetCertificate(nil)
+	assert.Equal(t, int64(2), cert.Leaf.SerialNumber.Int64())
+}
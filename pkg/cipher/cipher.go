@@ -10,9 +10,17 @@ func SetKey(key string) {
 
 // XOR encrypts the data
 func XOR(src []byte) []byte {
-	_klen := len(_key)
+	return XORWithKey(_key, src)
+}
+
+// XORWithKey encrypts the data with key instead of the default key
+func XORWithKey(key, src []byte) []byte {
+	_klen := len(key)
+	if _klen == 0 {
+		return src
+	}
 	for i := 0; i < len(src); i++ {
-		src[i] ^= _key[i%_klen]
+		src[i] ^= key[i%_klen]
 	}
 	return src
 }
@@ -2,7 +2,21 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"gofly/pkg/acl"
+	"gofly/pkg/audit"
+	"gofly/pkg/ban"
+	"gofly/pkg/connlimit"
+	"gofly/pkg/dns"
 	"gofly/pkg/engine"
+	"gofly/pkg/quota"
+	"gofly/pkg/ratelimit"
+	"gofly/pkg/realip"
+	"gofly/pkg/sniff"
+	"gofly/pkg/statistics"
+	"gofly/pkg/webhook"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -14,10 +28,33 @@ type Server struct {
 }
 
 type Config struct {
-	VTunSettings      VTunConfig      `yaml:"vTunSettings"`
-	Tun2SocksSettings engine.Key      `yaml:"socksSettings"`
-	WebSocketSettings WebSocketConfig `yaml:"wsSettings"`
-	RealitySettings   RealityConfig   `yaml:"realitySettings"`
+	VTunSettings      VTunConfig             `yaml:"vTunSettings"`
+	Tun2SocksSettings engine.Key             `yaml:"socksSettings"`
+	WebSocketSettings WebSocketConfig        `yaml:"wsSettings"`
+	RealitySettings   RealityConfig          `yaml:"realitySettings"`
+	GRPCSettings      GRPCConfig             `yaml:"grpcSettings"`
+	APISettings       APIConfig              `yaml:"apiSettings"`
+	AccessLogSettings AccessLogConfig        `yaml:"accessLogSettings"`
+	DNSSettings       dns.Config             `yaml:"dnsSettings"`
+	SniffSettings     sniff.Config           `yaml:"sniffSettings"`
+	ACLSettings       acl.Config             `yaml:"aclSettings"`
+	RateLimitSettings ratelimit.Config       `yaml:"rateLimitSettings"`
+	QuotaSettings     quota.Config           `yaml:"quotaSettings"`
+	StatsSettings     statistics.StoreConfig `yaml:"statsSettings"`
+	WebhookSettings   webhook.Config         `yaml:"webhookSettings"`
+	AuditSettings     audit.Config           `yaml:"auditSettings"`
+	BanSettings       ban.Config             `yaml:"banSettings"`
+	LimitSettings     connlimit.Config       `yaml:"limitSettings"`
+	RealIPSettings    realip.Config          `yaml:"realIPSettings"`
+	Users             []UserConfig           `yaml:"users"`
+}
+
+// UserConfig is a client allowed to connect with its own key, in addition to VTunSettings.Key.
+type UserConfig struct {
+	Name        string `yaml:"name"`
+	Key         string `yaml:"key"`
+	Group       string `yaml:"group"`
+	Certificate string `yaml:"certificate"` //the identity in the client certificate of the user, the name when empty
 }
 
 type VTunConfig struct {
@@ -34,15 +71,85 @@ type VTunConfig struct {
 }
 
 type WebSocketConfig struct {
-	Path                      string `yaml:"path"`
-	TLSCertificateFilePath    string `yaml:"tls_certificate_file_path"`
-	TLSCertificateKeyFilePath string `yaml:"tls_certificate_key_file_path"`
+	Path                      string           `yaml:"path"`
+	Transport                 string           `yaml:"transport"` //websocket, http2 or http3, websocket when empty
+	TLSCertificateFilePath    string           `yaml:"tls_certificate_file_path"`
+	TLSCertificateKeyFilePath string           `yaml:"tls_certificate_key_file_path"`
+	CertificateCheckInterval  time.Duration    `yaml:"certificate_check_interval"` //how often the certificate files are checked for changes, 10s when empty
+	CertificateWarnBefore     time.Duration    `yaml:"certificate_warn_before"`    //the certificate expiry is warned about from that long before, 336h when empty
+	Fallback                  FallbackConfig   `yaml:"fallback"`
+	ClientAuth                ClientAuthConfig `yaml:"client_auth"`
+	PerMessageDeflate         bool             `yaml:"permessage_deflate"` //the permessage-deflate extension is negotiated with the clients offering it
+	CompressionLevel          int              `yaml:"compression_level"`  //the deflate level from 1 (speed) to 9 (size), 1 when empty
+}
+
+// The transports of the ws protocol family. http2 accepts the websocket upgrades too, http3
+// serves http2 on tcp and quic on udp.
+const (
+	TransportWebSocket = "websocket"
+	TransportHTTP2     = "http2"
+	TransportHTTP3     = "http3"
+)
+
+// The fields of a client certificate naming its user.
+const (
+	IdentityCommonName = "common_name"
+	IdentityDNSSAN     = "dns_san"
+	IdentityEmailSAN   = "email_san"
+	IdentityURISAN     = "uri_san"
+)
+
+// ClientAuthConfig requires the wss clients to present a certificate signed by the CA.
+type ClientAuthConfig struct {
+	CAFilePath string `yaml:"ca_file_path"` //disabled when empty
+	Identity   string `yaml:"identity"`     //the field naming the user: common_name, dns_san, email_san or uri_san, common_name when empty
+	RequireKey bool   `yaml:"require_key"`  //the key of the same user must be sent too
+}
+
+func (c *ClientAuthConfig) Enabled() bool {
+	return c.CAFilePath != ""
+}
+
+// FallbackConfig is the site served to the requests which are not authorized websocket upgrades.
+// Without Dir and Origin they get the default page of nginx.
+type FallbackConfig struct {
+	Dir    string `yaml:"dir"`    //static files served from the directory
+	Origin string `yaml:"origin"` //the requests are proxied to the url, like https://www.example.com
 }
 
 func (c *WebSocketConfig) Check() error {
 	if c.Path == "" {
 		c.Path = "/"
 	}
+	switch c.ClientAuth.Identity {
+	case "":
+		c.ClientAuth.Identity = IdentityCommonName
+	case IdentityCommonName, IdentityDNSSAN, IdentityEmailSAN, IdentityURISAN:
+	default:
+		return fmt.Errorf("unsupported client_auth identity: %s", c.ClientAuth.Identity)
+	}
+	switch c.Transport {
+	case "":
+		c.Transport = TransportWebSocket
+	case TransportWebSocket, TransportHTTP2, TransportHTTP3:
+	default:
+		return fmt.Errorf("unsupported transport: %s", c.Transport)
+	}
+	if c.CompressionLevel < 0 || c.CompressionLevel > 9 {
+		return fmt.Errorf("invalid compression_level: %d", c.CompressionLevel)
+	}
+	if c.Fallback.Dir != "" && c.Fallback.Origin != "" {
+		return errors.New("fallback dir and origin are exclusive")
+	}
+	if c.Fallback.Origin != "" {
+		u, err := url.Parse(c.Fallback.Origin)
+		if err != nil {
+			return fmt.Errorf("invalid fallback origin: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid fallback origin: %s", c.Fallback.Origin)
+		}
+	}
 	return nil
 }
 
@@ -70,6 +177,33 @@ func (c *RealityConfig) Check() error {
 	return nil
 }
 
+type GRPCConfig struct {
+	ServiceName               string        `yaml:"service_name"` //the packets are streamed by /<service_name>/Stream, gofly.Tunnel when empty
+	TLSCertificateFilePath    string        `yaml:"tls_certificate_file_path"`
+	TLSCertificateKeyFilePath string        `yaml:"tls_certificate_key_file_path"`
+	CertificateCheckInterval  time.Duration `yaml:"certificate_check_interval"` //how often the certificate files are checked for changes, 10s when empty
+	CertificateWarnBefore     time.Duration `yaml:"certificate_warn_before"`    //the certificate expiry is warned about from that long before, 336h when empty
+}
+
+func (c *GRPCConfig) Check() error {
+	if c.ServiceName == "" {
+		c.ServiceName = "gofly.Tunnel"
+	}
+	if strings.ContainsAny(c.ServiceName, "/ ") {
+		return fmt.Errorf("invalid service_name: %s", c.ServiceName)
+	}
+	return nil
+}
+
+type APIConfig struct {
+	ListenAddr string `yaml:"listen_addr"` //disabled when empty
+	Secret     string `yaml:"secret"`
+}
+
+type AccessLogConfig struct {
+	Path string `yaml:"path"` //disabled when empty
+}
+
 func (config *Config) setDefault() {
 	if config.VTunSettings.BufferSize == 0 {
 		config.VTunSettings.BufferSize = 65535
@@ -90,9 +224,18 @@ func (config *Config) setDefault() {
 	if config.Tun2SocksSettings.UDPTimeout == 0 {
 		config.Tun2SocksSettings.UDPTimeout = 60 * time.Second
 	}
+	if config.Tun2SocksSettings.HealthCheckInterval == 0 {
+		config.Tun2SocksSettings.HealthCheckInterval = 30 * time.Second
+	}
 	if config.Tun2SocksSettings.Device == "" {
 		config.Tun2SocksSettings.Device = "tun0"
 	}
+	if len(config.DNSSettings.Upstreams) == 0 {
+		config.DNSSettings.Upstreams = []string{"tcp://1.1.1.1:53"}
+	}
+	if config.DNSSettings.FakeIPRange == "" {
+		config.DNSSettings.FakeIPRange = "198.18.0.0/15"
+	}
 	if !config.RealitySettings.Debug {
 		config.RealitySettings.Debug = config.VTunSettings.Verbose
 	}
@@ -0,0 +1,20 @@
+package connlimit
+
+const (
+	PolicyReject     = "reject"
+	PolicyKickOldest = "kick_oldest"
+)
+
+type Config struct {
+	MaxSessions      int     `yaml:"max_sessions"`       //concurrent sessions of every user, unlimited when 0
+	MaxUserSessions  int     `yaml:"max_user_sessions"`  //concurrent sessions of a user, unlimited when 0
+	UserPolicy       string  `yaml:"user_policy"`        //reject or kick_oldest when a user has too many sessions, reject when empty
+	MaxIPConnections int     `yaml:"max_ip_connections"` //concurrent connections from an ip but the trusted proxies, unlimited when 0
+	AcceptRate       float64 `yaml:"accept_rate"`        //connections accepted per second, unlimited when 0
+	AcceptBurst      int     `yaml:"accept_burst"`       //the accept_rate rounded up when 0
+}
+
+// Enabled reports whether any limit is configured.
+func (c *Config) Enabled() bool {
+	return c.MaxSessions > 0 || c.MaxUserSessions > 0 || c.MaxIPConnections > 0 || c.AcceptRate > 0
+}
@@ -0,0 +1,203 @@
+package connlimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"gofly/pkg/logger"
+	"gofly/pkg/realip"
+	"gofly/pkg/session"
+	"golang.org/x/time/rate"
+)
+
+// The reasons a connection or a session is refused.
+var (
+	ErrAcceptRate    = errors.New("accept rate exceeded")
+	ErrIPConnections = errors.New("too many connections from the ip")
+	ErrSessions      = errors.New("too many sessions")
+	ErrUserSessions  = errors.New("too many sessions of the user")
+)
+
+// ErrReplaced is the reason of a session closed for a newer session of its user.
+var ErrReplaced = errors.New("replaced by a newer session of the user")
+
+// Manager limits the connections accepted by the servers and the sessions of the users.
+type Manager struct {
+	maxSessions      int
+	maxUserSessions  int
+	kickOldest       bool
+	maxIPConnections int
+	accept           *rate.Limiter // nil when unlimited
+
+	mu       sync.Mutex
+	conns    map[string]netip.Addr // the remote address of every open connection and its ip
+	ips      map[netip.Addr]int
+	sessions map[*session.Session]struct{}
+	users    map[string][]*session.Session // the open sessions of every user, the oldest first
+}
+
+func New(c *Config) (*Manager, error) {
+	m := &Manager{
+		maxSessions:      c.MaxSessions,
+		maxUserSessions:  c.MaxUserSessions,
+		maxIPConnections: c.MaxIPConnections,
+		conns:            make(map[string]netip.Addr),
+		ips:              make(map[netip.Addr]int),
+		sessions:         make(map[*session.Session]struct{}),
+		users:            make(map[string][]*session.Session),
+	}
+	switch c.UserPolicy {
+	case "", PolicyReject:
+	case PolicyKickOldest:
+		m.kickOldest = true
+	default:
+		return nil, fmt.Errorf("unsupported user_policy: %s", c.UserPolicy)
+	}
+	if c.AcceptRate > 0 {
+		burst := c.AcceptBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(c.AcceptRate))
+		}
+		m.accept = rate.NewLimiter(rate.Limit(c.AcceptRate), burst)
+	}
+	return m, nil
+}
+
+// OpenConn admits the connection from the remote address addr, it must be released by CloseConn.
+func (m *Manager) OpenConn(addr string) error {
+	if m.accept != nil && !m.accept.Allow() {
+		return ErrAcceptRate
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := ap.Addr().Unmap()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.conns[addr]; ok {
+		return nil
+	}
+	// the clients behind a trusted proxy share its ip, they are not capped together.
+	if m.maxIPConnections > 0 && m.ips[ip] >= m.maxIPConnections && !realip.Trusted(addr) {
+		return ErrIPConnections
+	}
+	m.conns[addr] = ip
+	m.ips[ip]++
+	return nil
+}
+
+// CloseConn releases the connection from addr, it does nothing when it was not admitted.
+func (m *Manager) CloseConn(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ip, ok := m.conns[addr]
+	if !ok {
+		return
+	}
+	delete(m.conns, addr)
+	if m.ips[ip]--; m.ips[ip] <= 0 {
+		delete(m.ips, ip)
+	}
+}
+
+// OpenSession admits s, it must be released by CloseSession. When its user has too many
+// sessions, s is refused or the oldest session of the user is disconnected.
+func (m *Manager) OpenSession(s *session.Session) error {
+	m.mu.Lock()
+	if m.maxSessions > 0 && len(m.sessions) >= m.maxSessions {
+		m.mu.Unlock()
+		return ErrSessions
+	}
+	var oldest *session.Session
+	if user := s.User; user != "" && m.maxUserSessions > 0 && len(m.users[user]) >= m.maxUserSessions {
+		if !m.kickOldest {
+			m.mu.Unlock()
+			return ErrUserSessions
+		}
+		oldest = m.users[user][0]
+		m.remove(oldest)
+	}
+	m.sessions[s] = struct{}{}
+	if s.User != "" {
+		m.users[s.User] = append(m.users[s.User], s)
+	}
+	m.mu.Unlock()
+
+	if oldest != nil {
+		logger.Logger.Sugar().Infof("session %s of user %s replaced by session %s", oldest.ID, oldest.User, s.ID)
+		oldest.Disconnect(ErrReplaced)
+	}
+	return nil
+}
+
+// CloseSession releases s, it does nothing when it was not admitted or already released.
+func (m *Manager) CloseSession(s *session.Session) {
+	m.mu.Lock()
+	m.remove(s)
+	m.mu.Unlock()
+}
+
+func (m *Manager) remove(s *session.Session) {
+	if _, ok := m.sessions[s]; !ok {
+		return
+	}
+	delete(m.sessions, s)
+	sessions := m.users[s.User]
+	for i, us := range sessions {
+		if us == s {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(m.users, s.User)
+	} else {
+		m.users[s.User] = sessions
+	}
+}
+
+var _default atomic.Pointer[Manager]
+
+// Default returns the limits of the servers, nil when there are none.
+func Default() *Manager {
+	return _default.Load()
+}
+
+func SetDefault(m *Manager) {
+	_default.Store(m)
+}
+
+// OpenConn admits the connection from addr with the default manager, if any.
+func OpenConn(addr string) error {
+	if m := Default(); m != nil {
+		return m.OpenConn(addr)
+	}
+	return nil
+}
+
+// CloseConn releases the connection from addr in the default manager, if any.
+func CloseConn(addr string) {
+	if m := Default(); m != nil {
+		m.CloseConn(addr)
+	}
+}
+
+// OpenSession admits s with the default manager, if any.
+func OpenSession(s *session.Session) error {
+	if m := Default(); m != nil {
+		return m.OpenSession(s)
+	}
+	return nil
+}
+
+// CloseSession releases s in the default manager, if any.
+func CloseSession(s *session.Session) {
+	if m := Default(); m != nil {
+		m.CloseSession(s)
+	}
+}
@@ -0,0 +1,70 @@
+package connlimit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/logger"
+	"gofly/pkg/realip"
+	"gofly/pkg/session"
+)
+
+func TestManager_Conns(t *testing.T) {
+	m, err := New(&Config{MaxIPConnections: 2})
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.OpenConn("192.0.2.1:1000"))
+	assert.NoError(t, m.OpenConn("192.0.2.1:1001"))
+	assert.ErrorIs(t, m.OpenConn("192.0.2.1:1002"), ErrIPConnections)
+	assert.NoError(t, m.OpenConn("192.0.2.2:1000"))
+
+	m.CloseConn("192.0.2.1:1002") // refused, not released
+	assert.ErrorIs(t, m.OpenConn("192.0.2.1:1002"), ErrIPConnections)
+	m.CloseConn("192.0.2.1:1000")
+	assert.NoError(t, m.OpenConn("192.0.2.1:1002"))
+
+	// the connections from a trusted proxy are not capped.
+	x, err := realip.New(&realip.Config{Trusted: []string{"192.0.2.0/24"}})
+	assert.NoError(t, err)
+	realip.SetDefault(x)
+	defer realip.SetDefault(nil)
+	assert.NoError(t, m.OpenConn("192.0.2.1:1003"))
+
+	m, err = New(&Config{AcceptRate: 1, AcceptBurst: 2})
+	assert.NoError(t, err)
+	assert.NoError(t, m.OpenConn("192.0.2.1:1000"))
+	assert.NoError(t, m.OpenConn("192.0.2.1:1001"))
+	assert.ErrorIs(t, m.OpenConn("192.0.2.1:1002"), ErrAcceptRate)
+}
+
+func TestManager_Sessions(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	m, err := New(&Config{MaxSessions: 3, MaxUserSessions: 2})
+	assert.NoError(t, err)
+
+	a1 := session.New("alice", "", "wss", nil)
+	a2 := session.New("alice", "", "wss", nil)
+	assert.NoError(t, m.OpenSession(a1))
+	assert.NoError(t, m.OpenSession(a2))
+	assert.ErrorIs(t, m.OpenSession(session.New("alice", "", "wss", nil)), ErrUserSessions)
+	assert.NoError(t, m.OpenSession(session.New("bob", "", "wss", nil)))
+	assert.ErrorIs(t, m.OpenSession(session.New("carol", "", "wss", nil)), ErrSessions)
+	m.CloseSession(a1)
+	assert.NoError(t, m.OpenSession(session.New("carol", "", "wss", nil)))
+
+	m, err = New(&Config{MaxUserSessions: 1, UserPolicy: PolicyKickOldest})
+	assert.NoError(t, err)
+	var reason error
+	a1.OnKick(func(err error) { reason = err })
+	assert.NoError(t, m.OpenSession(a1))
+	assert.NoError(t, m.OpenSession(a2))
+	assert.True(t, errors.Is(reason, ErrReplaced))
+	m.CloseSession(a1) // already released when it was replaced
+	assert.Len(t, m.users["alice"], 1)
+	assert.Len(t, m.sessions, 1)
+
+	_, err = New(&Config{UserPolicy: "unknown"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package connlimit
+
+import (
+	"net"
+	"sync"
+
+	"gofly/pkg/logger"
+)
+
+type listener struct {
+	net.Listener
+	rejected func(error)
+}
+
+// NewListener returns a listener closing the connections refused by the default manager as
+// soon as they are accepted, before any handshake. rejected receives the reason of every
+// refused connection.
+func NewListener(l net.Listener, rejected func(error)) net.Listener {
+	return &listener{Listener: l, rejected: rejected}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr := conn.RemoteAddr().String()
+		if err = OpenConn(addr); err == nil {
+			return &limitedConn{Conn: conn, addr: addr}, nil
+		}
+		logger.Logger.Sugar().Debugf("refused %s: %v", addr, err)
+		conn.Close()
+		if l.rejected != nil {
+			l.rejected(err)
+		}
+	}
+}
+
+// limitedConn releases its connection when it is closed.
+type limitedConn struct {
+	net.Conn
+	addr string
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { CloseConn(c.addr) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,33 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+)
+
+type Config struct {
+	Enable      bool     `yaml:"enable"`
+	Listen      string   `yaml:"listen"`    //the virtual resolver address, e.g. 198.18.0.2:53
+	Upstreams   []string `yaml:"upstreams"` //tcp://, tls:// or https:// upstreams dialed through the outbound, which resolves their names
+	NoCache     bool     `yaml:"no_cache"`
+	FakeIP      bool     `yaml:"fake_ip"`
+	FakeIPRange string   `yaml:"fake_ip_range"`
+}
+
+func (c *Config) Check() error {
+	if !c.Enable {
+		return nil
+	}
+	if _, err := netip.ParseAddrPort(c.Listen); err != nil {
+		return errors.New("dns listen must be an ip:port address")
+	}
+	if len(c.Upstreams) == 0 {
+		return errors.New("dns upstreams can not empty")
+	}
+	if c.FakeIP {
+		if _, err := netip.ParsePrefix(c.FakeIPRange); err != nil {
+			return errors.New("invalid dns fake_ip_range")
+		}
+	}
+	return nil
+}
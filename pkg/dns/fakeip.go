@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// FakeIPPool hands out addresses of a reserved range to domain names,
+// so that flows to such an address can be mapped back to the domain.
+type FakeIPPool struct {
+	mutex  sync.Mutex
+	prefix netip.Prefix
+	first  netip.Addr
+	last   netip.Addr
+	next   netip.Addr
+	byHost map[string]netip.Addr
+	byIP   map[netip.Addr]string
+	skip   map[netip.Addr]bool
+}
+
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+	// skip the network address, and the broadcast address for ipv4
+	first := prefix.Addr().Next()
+	last := lastAddr(prefix)
+	if prefix.Addr().Is4() {
+		last = last.Prev()
+	}
+	return &FakeIPPool{
+		prefix: prefix,
+		first:  first,
+		last:   last,
+		next:   first,
+		byHost: make(map[string]netip.Addr),
+		byIP:   make(map[netip.Addr]string),
+		skip:   make(map[netip.Addr]bool),
+	}, nil
+}
+
+// Lookup returns the fake address of host, allocating one if needed.
+// When the pool is exhausted the oldest allocation is reused.
+func (p *FakeIPPool) Lookup(host string) netip.Addr {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if ip, ok := p.byHost[host]; ok {
+		return ip
+	}
+	ip := p.advance()
+	for i := 0; p.skip[ip] && i < len(p.skip); i++ {
+		ip = p.advance()
+	}
+	if old, ok := p.byIP[ip]; ok {
+		delete(p.byHost, old)
+	}
+	p.byHost[host] = ip
+	p.byIP[ip] = host
+	return ip
+}
+
+// Reserve excludes ip from allocation, e.g. the virtual resolver address.
+func (p *FakeIPPool) Reserve(ip netip.Addr) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.Contains(ip) {
+		p.skip[ip] = true
+	}
+}
+
+func (p *FakeIPPool) advance() netip.Addr {
+	ip := p.next
+	if p.next == p.last {
+		p.next = p.first
+	} else {
+		p.next = p.next.Next()
+	}
+	return ip
+}
+
+// Host returns the domain name the fake address ip was allocated to.
+func (p *FakeIPPool) Host(ip netip.Addr) (string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	host, ok := p.byIP[ip]
+	return host, ok
+}
+
+// Contains reports whether ip is in the fake ip range.
+func (p *FakeIPPool) Contains(ip netip.Addr) bool {
+	return p.prefix.Contains(ip)
+}
+
+func (p *FakeIPPool) Is4() bool {
+	return p.prefix.Addr().Is4()
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
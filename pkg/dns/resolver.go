@@ -0,0 +1,286 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// fakeIPTTL is the ttl of fake answers, kept short so clients come back to us.
+	fakeIPTTL = 1
+
+	// exchangeTimeout is the timeout of a single upstream exchange.
+	exchangeTimeout = 5 * time.Second
+)
+
+var errNoAnswer = errors.New("no answer")
+
+// Resolver answers the dns queries sent by clients to the virtual resolver address.
+type Resolver struct {
+	addr      netip.AddrPort
+	cache     *cache.Cache
+	fakeIP    *FakeIPPool
+	upstreams []Upstream
+}
+
+func New(c *Config, dial DialFunc) (*Resolver, error) {
+	addr, err := netip.ParseAddrPort(c.Listen)
+	if err != nil {
+		return nil, err
+	}
+	r := &Resolver{addr: addr}
+	if !c.NoCache {
+		r.cache = cache.New(time.Minute, 10*time.Minute)
+	}
+	if c.FakeIP {
+		if r.fakeIP, err = NewFakeIPPool(c.FakeIPRange); err != nil {
+			return nil, err
+		}
+		r.fakeIP.Reserve(addr.Addr())
+	}
+	for _, s := range c.Upstreams {
+		u, err := parseUpstream(s, dial)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+// Addr returns the virtual resolver address.
+func (r *Resolver) Addr() netip.AddrPort {
+	return r.addr
+}
+
+// IsResolverAddr reports whether ip:port is the virtual resolver address.
+func (r *Resolver) IsResolverAddr(ip net.IP, port uint16) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && addr.Unmap() == r.addr.Addr() && port == r.addr.Port()
+}
+
+// FakeIPHost returns the domain behind a fake address.
+func (r *Resolver) FakeIPHost(ip net.IP) (string, bool) {
+	if r.fakeIP == nil {
+		return "", false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || !r.fakeIP.Contains(addr.Unmap()) {
+		return "", false
+	}
+	return r.fakeIP.Host(addr.Unmap())
+}
+
+// Exchange answers a dns query from a client.
+func (r *Resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	if r.fakeIP != nil && q.Class == dnsmessage.ClassINET && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+		return r.fakeAnswer(header, q)
+	}
+	return r.forward(ctx, header.ID, q, query)
+}
+
+// LookupIP resolves host to a real address through the upstreams, bypassing fake ip.
+func (r *Resolver) LookupIP(ctx context.Context, host string) (net.IP, error) {
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		name, err := dnsmessage.NewName(fqdn(host))
+		if err != nil {
+			return nil, err
+		}
+		q := dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(time.Now().UnixNano()), RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(q)
+		query, err := b.Finish()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := r.forward(ctx, 0, q, query)
+		if err != nil {
+			return nil, err
+		}
+		if ip := firstAddress(resp); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("lookup %s: %w", host, errNoAnswer)
+}
+
+// cachedResponse is a cached upstream response and the time it was received at.
+type cachedResponse struct {
+	msg []byte
+	at  time.Time
+}
+
+func (r *Resolver) forward(ctx context.Context, id uint16, q dnsmessage.Question, query []byte) ([]byte, error) {
+	key := q.Name.String() + "/" + q.Type.String()
+	if r.cache != nil {
+		if v, ok := r.cache.Get(key); ok {
+			c := v.(*cachedResponse)
+			return withID(aged(c.msg, time.Since(c.at)), id), nil
+		}
+	}
+	var resp []byte
+	var err error
+	for _, u := range r.upstreams {
+		uctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+		resp, err = u.Exchange(uctx, query)
+		cancel()
+		if err == nil {
+			break
+		}
+		err = fmt.Errorf("%s: %w", u, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.cache != nil {
+		if ttl := minTTL(resp); ttl > 0 {
+			r.cache.Set(key, &cachedResponse{msg: resp, at: time.Now()}, ttl)
+		}
+	}
+	return withID(resp, id), nil
+}
+
+func (r *Resolver) fakeAnswer(header dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	host := strings.TrimSuffix(q.Name.String(), ".")
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: fakeIPTTL}
+	// only the family of the pool gets an answer, the other one is empty
+	if q.Type == dnsmessage.TypeA && r.fakeIP.Is4() {
+		if err := b.AResource(rh, dnsmessage.AResource{A: r.fakeIP.Lookup(host).As4()}); err != nil {
+			return nil, err
+		}
+	} else if q.Type == dnsmessage.TypeAAAA && !r.fakeIP.Is4() {
+		if err := b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: r.fakeIP.Lookup(host).As16()}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// withID returns a copy of msg carrying the transaction id.
+func withID(msg []byte, id uint16) []byte {
+	b := append([]byte(nil), msg...)
+	if len(b) >= 2 {
+		binary.BigEndian.PutUint16(b, id)
+	}
+	return b
+}
+
+// aged returns msg with the ttls of its records decreased by the time spent in the cache.
+func aged(msg []byte, age time.Duration) []byte {
+	seconds := uint32(age / time.Second)
+	if seconds == 0 {
+		return msg
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return msg
+	}
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			h := &section[i].Header
+			// the ttl of an OPT record holds the extended rcode and flags
+			if h.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if h.TTL > seconds {
+				h.TTL -= seconds
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+	b, err := m.Pack()
+	if err != nil {
+		return msg
+	}
+	return b
+}
+
+// minTTL returns the smallest ttl of the answers of a successful response.
+func minTTL(msg []byte) time.Duration {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.RCode != dnsmessage.RCodeSuccess {
+		return 0
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return 0
+	}
+	answers, err := p.AllAnswers()
+	if err != nil || len(answers) == 0 {
+		return 0
+	}
+	ttl := answers[0].Header.TTL
+	for _, a := range answers[1:] {
+		if a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// firstAddress returns the first A or AAAA answer of msg.
+func firstAddress(msg []byte) net.IP {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil
+	}
+	for _, a := range answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			return net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			return net.IP(body.AAAA[:])
+		}
+	}
+	return nil
+}
+
+func fqdn(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
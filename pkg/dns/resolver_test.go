@@ -0,0 +1,116 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type countingUpstream struct {
+	count int
+	ip    [4]byte
+}
+
+func (x *countingUpstream) String() string {
+	return "counting"
+}
+
+func (x *countingUpstream) Exchange(_ context.Context, msg []byte) ([]byte, error) {
+	x.count++
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 300}, dnsmessage.AResource{A: x.ip})
+	return b.Finish()
+}
+
+func newQuery(t *testing.T, id uint16, host string, qtype dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(host), Type: qtype, Class: dnsmessage.ClassINET})
+	msg, err := b.Finish()
+	assert.NoError(t, err)
+	return msg
+}
+
+func TestFakeIPPool_Lookup(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/30")
+	assert.NoError(t, err)
+	p.Reserve(netip.MustParseAddr("198.18.0.1"))
+
+	a := p.Lookup("a.example")
+	assert.Equal(t, netip.MustParseAddr("198.18.0.2"), a)
+	assert.Equal(t, a, p.Lookup("a.example"))
+	host, ok := p.Host(a)
+	assert.True(t, ok)
+	assert.Equal(t, "a.example", host)
+
+	// the pool holds a single address, the oldest allocation is reused
+	b := p.Lookup("b.example")
+	assert.Equal(t, a, b)
+	host, _ = p.Host(b)
+	assert.Equal(t, "b.example", host)
+}
+
+func TestResolver_Exchange(t *testing.T) {
+	u := &countingUpstream{ip: [4]byte{1, 2, 3, 4}}
+	r, err := New(&Config{Listen: "198.18.0.2:53"}, nil)
+	assert.NoError(t, err)
+	r.upstreams = []Upstream{u}
+
+	for id := uint16(1); id <= 2; id++ {
+		resp, err := r.Exchange(context.Background(), newQuery(t, id, "example.com.", dnsmessage.TypeA))
+		assert.NoError(t, err)
+		var p dnsmessage.Parser
+		header, err := p.Start(resp)
+		assert.NoError(t, err)
+		assert.Equal(t, id, header.ID)
+		assert.Equal(t, net.IPv4(1, 2, 3, 4).To4(), firstAddress(resp).To4())
+	}
+	assert.Equal(t, 1, u.count)
+
+	// the cached responses are served with the ttls left.
+	v, ok := r.cache.Get("example.com./TypeA")
+	assert.True(t, ok)
+	v.(*cachedResponse).at = time.Now().Add(-100 * time.Second)
+	resp, err := r.Exchange(context.Background(), newQuery(t, 3, "example.com.", dnsmessage.TypeA))
+	assert.NoError(t, err)
+	assert.Equal(t, 200*time.Second, minTTL(resp))
+	assert.Equal(t, 1, u.count)
+}
+
+func TestResolver_FakeIP(t *testing.T) {
+	u := &countingUpstream{ip: [4]byte{5, 6, 7, 8}}
+	r, err := New(&Config{Listen: "198.18.0.2:53", FakeIP: true, FakeIPRange: "198.18.0.0/15"}, nil)
+	assert.NoError(t, err)
+	r.upstreams = []Upstream{u}
+
+	resp, err := r.Exchange(context.Background(), newQuery(t, 7, "example.com.", dnsmessage.TypeA))
+	assert.NoError(t, err)
+	fake := firstAddress(resp)
+	assert.True(t, r.IsResolverAddr(net.IPv4(198, 18, 0, 2), 53))
+	assert.NotEqual(t, "198.18.0.2", fake.String())
+	host, ok := r.FakeIPHost(fake)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", host)
+	assert.Equal(t, 0, u.count)
+
+	ip, err := r.LookupIP(context.Background(), host)
+	assert.NoError(t, err)
+	assert.Equal(t, "5.6.7.8", ip.String())
+}
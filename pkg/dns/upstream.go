@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DialFunc dials a tcp connection, usually through the engine outbound.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Upstream exchanges a dns message with a remote resolver.
+type Upstream interface {
+	Exchange(ctx context.Context, msg []byte) ([]byte, error)
+	String() string
+}
+
+// parseUpstream parses an upstream url such as tcp://1.1.1.1:53,
+// tls://1.1.1.1:853?sni=one.one.one.one or https://1.1.1.1/dns-query.
+func parseUpstream(s string, dial DialFunc) (Upstream, error) {
+	if !strings.Contains(s, "://") {
+		s = fmt.Sprintf("%s://%s", "tcp", s)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	sni := u.Query().Get("sni")
+	if sni == "" {
+		sni = u.Hostname()
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "tcp":
+		return &tcpUpstream{address: withPort(u, "53"), dial: dial}, nil
+	case "tls":
+		return &tcpUpstream{address: withPort(u, "853"), dial: dial, tls: &tls.Config{ServerName: sni}}, nil
+	case "https":
+		address := withPort(u, "443")
+		return &httpsUpstream{
+			url: u.String(),
+			client: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+						return dial(ctx, network, address)
+					},
+					TLSClientConfig:   &tls.Config{ServerName: sni},
+					ForceAttemptHTTP2: true,
+				},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream scheme: %s", u.Scheme)
+	}
+}
+
+func withPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// tcpUpstream implements dns over tcp, and dns over tls when tls is set.
+type tcpUpstream struct {
+	address string
+	dial    DialFunc
+	tls     *tls.Config
+}
+
+func (x *tcpUpstream) String() string {
+	if x.tls != nil {
+		return "tls://" + x.address
+	}
+	return "tcp://" + x.address
+}
+
+func (x *tcpUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	conn, err := x.dial(ctx, "tcp", x.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if x.tls != nil {
+		tlsConn := tls.Client(conn, x.tls)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if err = WriteTCPMessage(conn, msg); err != nil {
+		return nil, err
+	}
+	return ReadTCPMessage(conn)
+}
+
+// httpsUpstream implements dns over https (RFC 8484).
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (x *httpsUpstream) String() string {
+	return x.url
+}
+
+func (x *httpsUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, x.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// ReadTCPMessage reads a length prefixed dns message (RFC 1035 4.2.2).
+func ReadTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteTCPMessage writes a length prefixed dns message (RFC 1035 4.2.2).
+func WriteTCPMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
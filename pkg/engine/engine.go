@@ -1,8 +1,14 @@
 package engine
 
 import (
+	"context"
 	"errors"
 	"github.com/docker/go-units"
+	"gofly/pkg/dns"
+	"gofly/pkg/engine/mirror"
+	"gofly/pkg/engine/outbound"
+	"gofly/pkg/engine/tunnel"
+	"gofly/pkg/sniff"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"os/exec"
 	"strings"
@@ -11,7 +17,6 @@ import (
 	"github.com/xjasonlyu/tun2socks/v2/core"
 	"github.com/xjasonlyu/tun2socks/v2/core/device"
 	"github.com/xjasonlyu/tun2socks/v2/core/option"
-	"github.com/xjasonlyu/tun2socks/v2/engine/mirror"
 	"github.com/xjasonlyu/tun2socks/v2/log"
 	"github.com/xjasonlyu/tun2socks/v2/proxy"
 )
@@ -30,6 +35,18 @@ var (
 
 	// _defaultStack holds the default stack for the engine.
 	_defaultStack *stack.Stack
+
+	// _defaultDNS holds the dns settings for the engine.
+	_defaultDNS *dns.Config
+
+	// _defaultSniff holds the sniffing settings for the engine.
+	_defaultSniff *sniff.Config
+
+	// _defaultHealth holds the upstream health check of the engine, if any.
+	_defaultHealth *healthCheck
+
+	// _stopUDPCheck stops the udp health check of the proxy of the engine.
+	_stopUDPCheck context.CancelFunc
 )
 
 // Start starts the default engine up.
@@ -53,6 +70,20 @@ func Insert(k *Key) {
 	_engineMu.Unlock()
 }
 
+// InsertDNS loads *dns.Config to the default engine.
+func InsertDNS(c *dns.Config) {
+	_engineMu.Lock()
+	_defaultDNS = c
+	_engineMu.Unlock()
+}
+
+// InsertSniff loads *sniff.Config to the default engine.
+func InsertSniff(c *sniff.Config) {
+	_engineMu.Lock()
+	_defaultSniff = c
+	_engineMu.Unlock()
+}
+
 func start() error {
 	_engineMu.Lock()
 	if _defaultKey == nil {
@@ -61,6 +92,8 @@ func start() error {
 
 	for _, f := range []func(*Key) error{
 		netStack,
+		resolver,
+		sniffing,
 	} {
 		if err := f(_defaultKey); err != nil {
 			return err
@@ -72,6 +105,14 @@ func start() error {
 
 func stop() (err error) {
 	_engineMu.Lock()
+	if _defaultHealth != nil {
+		_defaultHealth.stop()
+		_defaultHealth = nil
+	}
+	if _stopUDPCheck != nil {
+		_stopUDPCheck()
+		_stopUDPCheck = nil
+	}
 	if _defaultDevice != nil {
 		err = _defaultDevice.Close()
 	}
@@ -100,6 +141,24 @@ func SetLogLevel(debug bool) {
 	}
 }
 
+func resolver(*Key) error {
+	if _defaultDNS == nil || !_defaultDNS.Enable {
+		return nil
+	}
+	r, err := dns.New(_defaultDNS, tunnel.Dial)
+	if err != nil {
+		return err
+	}
+	tunnel.SetResolver(r)
+	log.Infof("[DNS] resolver %s", r.Addr())
+	return nil
+}
+
+func sniffing(*Key) error {
+	tunnel.SetSniffing(_defaultSniff)
+	return nil
+}
+
 func netStack(k *Key) (err error) {
 	if k.Proxy == "" {
 		return errors.New("empty proxy")
@@ -108,10 +167,26 @@ func netStack(k *Key) (err error) {
 		return errors.New("empty device")
 	}
 
-	if _defaultProxy, err = parseProxy(k.Proxy); err != nil {
+	var first proxy.Proxy
+	if _defaultProxy, first, err = parseChain(k); err != nil {
 		return
 	}
 	proxy.SetDialer(_defaultProxy)
+	tunnel.SetProxy(_defaultProxy)
+	if _stopUDPCheck != nil {
+		_stopUDPCheck()
+	}
+	var ctx context.Context
+	ctx, _stopUDPCheck = context.WithCancel(context.Background())
+	outbound.StartUDPCheck(ctx, _defaultProxy)
+	if _defaultHealth != nil {
+		_defaultHealth.stop()
+	}
+	_defaultHealth = startHealthCheck(first, k.HealthCheckInterval)
+
+	if k.UDPTimeout > 0 {
+		tunnel.SetUDPTimeout(k.UDPTimeout)
+	}
 
 	if _defaultDevice, err = parseDevice(k.Device, uint32(k.MTU)); err != nil {
 		return
@@ -149,7 +224,7 @@ func netStack(k *Key) (err error) {
 	log.Infof(
 		"[STACK] %s://%s <-> %s://%s",
 		_defaultDevice.Type(), _defaultDevice.Name(),
-		_defaultProxy.Proto(), _defaultProxy.Addr(),
+		outbound.Scheme(_defaultProxy), _defaultProxy.Addr(),
 	)
 	return nil
 }
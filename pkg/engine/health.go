@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/dialer"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+	"gofly/pkg/webhook"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// healthCheck dials the upstream of a started engine every interval, it is stopped with the engine.
+type healthCheck struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startHealthCheck dials the server of p every interval, and emits an event when it becomes
+// unreachable or reachable again. It returns nil when there is nothing to check.
+func startHealthCheck(p proxy.Proxy, interval time.Duration) *healthCheck {
+	if interval <= 0 {
+		return nil
+	}
+	switch p.Proto() {
+	case proto.Direct, proto.Reject:
+		return nil
+	}
+	addr := p.Addr()
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &healthCheck{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		up := true
+		for {
+			err := checkUpstream(ctx, network, addr)
+			if ctx.Err() != nil {
+				return
+			}
+			if (err == nil) != up {
+				up = err == nil
+				e := &webhook.Event{Type: webhook.UpstreamUp, Detail: addr}
+				if !up {
+					e.Type, e.Detail = webhook.UpstreamDown, addr+": "+err.Error()
+					log.Warnf("[HEALTH] upstream %s is down: %v", addr, err)
+				} else {
+					log.Infof("[HEALTH] upstream %s is up", addr)
+				}
+				webhook.Emit(e)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return h
+}
+
+// stop stops h and waits for its last check.
+func (h *healthCheck) stop() {
+	h.cancel()
+	<-h.done
+}
+
+func checkUpstream(ctx context.Context, network, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	c, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
@@ -5,9 +5,11 @@ import "time"
 type Key struct {
 	MTU                      int           `yaml:"mtu"`
 	Proxy                    string        `yaml:"proxy"`
+	Chain                    []string      `yaml:"chain"` //the proxies Proxy is dialed through, the first one is dialed directly
 	Device                   string        `yaml:"device"`
 	TCPModerateReceiveBuffer bool          `yaml:"tcp-moderate-receive-buffer"`
 	TCPSendBufferSize        string        `yaml:"tcp-send-buffer-size"`
 	TCPReceiveBufferSize     string        `yaml:"tcp-receive-buffer-size"`
 	UDPTimeout               time.Duration `yaml:"udp-timeout"`
+	HealthCheckInterval      time.Duration `yaml:"health-check-interval"` //the interval of the upstream reachability check, disabled when negative
 }
@@ -2,7 +2,7 @@ package mirror
 
 import (
 	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
-	"github.com/xjasonlyu/tun2socks/v2/tunnel"
+	"gofly/pkg/engine/tunnel"
 )
 
 var _ adapter.TransportHandler = (*Tunnel)(nil)
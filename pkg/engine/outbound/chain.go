@@ -0,0 +1,99 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/xjasonlyu/tun2socks/v2/dialer"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// DialFunc dials the server of an outbound.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+var errChainUDP = errors.New("udp is not supported by a chained outbound")
+
+// serverDialer dials the server of an outbound, directly unless the outbound is chained.
+type serverDialer struct {
+	dial DialFunc
+}
+
+func (d *serverDialer) setDial(dial DialFunc) {
+	d.dial = dial
+}
+
+func (d *serverDialer) chained() bool {
+	return d.dial != nil
+}
+
+func (d *serverDialer) dialServer(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.dial != nil {
+		return d.dial(ctx, network, address)
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// chainable is implemented by the outbounds whose server can be dialed through another outbound.
+type chainable interface {
+	proxy.Proxy
+	setDial(DialFunc)
+}
+
+// Chain returns the last of hops, dialing its server through the hop before it and so on,
+// the first hop is dialed directly.
+func Chain(hops ...proxy.Proxy) (proxy.Proxy, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("empty chain")
+	}
+	for i := 1; i < len(hops); i++ {
+		c, ok := hops[i].(chainable)
+		if !ok {
+			return nil, fmt.Errorf("%s can not be dialed through another outbound", Scheme(hops[i]))
+		}
+		c.setDial(via(hops[i-1]))
+	}
+	return hops[len(hops)-1], nil
+}
+
+// via returns the DialFunc dialing tcp through p, a host is resolved locally unless p dials hosts.
+func via(p proxy.Proxy) DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, fmt.Errorf("%s can not be dialed through %s", network, Scheme(p))
+		}
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", portStr)
+		}
+		metadata := &M.Metadata{
+			Network: M.TCP,
+			DstIP:   net.ParseIP(host),
+			DstPort: uint16(port),
+		}
+		// the host of the flow is meant for the last hop only.
+		ctx = WithHost(ctx, "")
+		if metadata.DstIP == nil {
+			if CanDialHost(p) {
+				ctx = WithHost(ctx, host)
+				metadata.DstIP = net.IPv4zero
+			} else {
+				ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+				if err != nil {
+					return nil, err
+				}
+				metadata.DstIP = ips[0]
+			}
+		}
+		return p.DialContext(ctx, metadata)
+	}
+}
@@ -0,0 +1,93 @@
+package outbound
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// connectProxy is an http CONNECT proxy recording the addresses it connects to.
+type connectProxy struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.hosts = append(p.hosts, r.Host)
+	p.mu.Unlock()
+	dst, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	src, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		dst.Close()
+		return
+	}
+	go func() {
+		io.Copy(dst, src)
+		dst.Close()
+	}()
+	io.Copy(src, dst)
+	src.Close()
+}
+
+func TestChain(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	jump, egress := &connectProxy{}, &connectProxy{}
+	jumpServer, egressServer := httptest.NewServer(jump), httptest.NewServer(egress)
+	defer jumpServer.Close()
+	defer egressServer.Close()
+
+	first, err := NewHTTP(jumpServer.Listener.Addr().String(), "", "")
+	assert.NoError(t, err)
+	last, err := NewHTTP(egressServer.Listener.Addr().String(), "", "")
+	assert.NoError(t, err)
+	p, err := Chain(first, last)
+	assert.NoError(t, err)
+	assert.Equal(t, last, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := echo.Addr().(*net.TCPAddr)
+	c, err := p.DialContext(WithHost(ctx, "localhost"), &M.Metadata{Network: M.TCP, DstIP: addr.IP, DstPort: uint16(addr.Port)})
+	assert.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	assert.Equal(t, []string{egressServer.Listener.Addr().String()}, jump.hosts)
+	assert.Equal(t, []string{net.JoinHostPort("localhost", strconv.Itoa(addr.Port))}, egress.hosts)
+
+	_, err = Chain(first, proxy.NewDirect())
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+	"gofly/pkg/cipher"
+	"gofly/pkg/x/xproto"
+)
+
+const tcpConnectTimeout = 5 * time.Second
+
+var _ chainable = (*Gofly)(nil)
+
+// GoflyOptions are the settings shared by the gofly outbounds.
+type GoflyOptions struct {
+	Key      string         // the key authenticating to the server, VTunSettings.Key or the key of a user
+	ObfsKey  string         // the VTunSettings.Key of the server when Obfs is enabled, Key when empty
+	Obfs     bool           // must match VTunSettings.Obfs of the server
+	Compress bool           // must match VTunSettings.Compress of the server, unless negotiated by the ws subprotocol
+	MTU      uint32         // the mtu of the tunnel
+	Addrs    []netip.Prefix // the addresses of this client inside the network of the server
+}
+
+// codec is basic.Server BasicEncode/BasicDecode for the client side of a gofly tunnel.
+type codec struct {
+	obfsKey  []byte
+	compress bool
+}
+
+func newCodec(o *GoflyOptions) *codec {
+	c := &codec{compress: o.Compress}
+	if o.Obfs {
+		c.obfsKey = []byte(o.ObfsKey)
+		if len(c.obfsKey) == 0 {
+			c.obfsKey = []byte(o.Key)
+		}
+	}
+	return c
+}
+
+// encode leaves b untouched, the stack may still hold it for retransmission.
+func (c *codec) encode(b []byte) []byte {
+	if c.obfsKey != nil {
+		b = cipher.XORWithKey(c.obfsKey, xproto.Copy(b))
+	}
+	if c.compress {
+		b = snappy.Encode(nil, b)
+	}
+	return b
+}
+
+// subprotocol returns the ws subprotocol naming the codec to the servers which negotiate it.
+func (c *codec) subprotocol() string {
+	if c.compress {
+		return "gofly.v1.snappy"
+	}
+	return "gofly.v1"
+}
+
+// muxSubprotocol returns the ws subprotocol of the mux framing with the codec.
+func (c *codec) muxSubprotocol() string {
+	if c.compress {
+		return "gofly.v2.snappy"
+	}
+	return "gofly.v2"
+}
+
+func (c *codec) decode(b []byte) ([]byte, error) {
+	var err error
+	if c.compress {
+		b, err = snappy.Decode(nil, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.obfsKey != nil {
+		b = cipher.XORWithKey(c.obfsKey, b)
+	}
+	return b, nil
+}
+
+// Gofly chains the engine to another gofly server, the flows are carried as ip packets
+// by a userspace network stack holding the addresses of GoflyOptions.Addrs.
+type Gofly struct {
+	*serverDialer
+
+	addr  string
+	proto proto.Proto
+	stack *netstack
+}
+
+// newGofly returns the Gofly outbound connecting its transport with dial, which dials the server with sd.
+func newGofly(addr string, p proto.Proto, o *GoflyOptions, sd *serverDialer, dial func(context.Context) (packetTransport, error)) (*Gofly, error) {
+	if len(o.Addrs) == 0 {
+		return nil, errors.New("gofly outbound requires the address of the client")
+	}
+	if o.MTU == 0 {
+		o.MTU = 1500
+	}
+	s, err := newNetstack(&packetLink{dial: dial}, o.MTU, o.Addrs)
+	if err != nil {
+		return nil, err
+	}
+	return &Gofly{serverDialer: sd, addr: addr, proto: p, stack: s}, nil
+}
+
+func (g *Gofly) Addr() string {
+	return g.addr
+}
+
+func (g *Gofly) Proto() proto.Proto {
+	return g.proto
+}
+
+func (g *Gofly) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	return g.stack.DialContext(ctx, metadata)
+}
+
+func (g *Gofly) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	return g.stack.DialUDP(metadata)
+}
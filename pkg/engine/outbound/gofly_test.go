@@ -0,0 +1,97 @@
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// chanTransport is one end of an in-memory packet transport.
+type chanTransport struct {
+	in  <-chan []byte
+	out chan<- []byte
+}
+
+func (t *chanTransport) ReadPacket() ([]byte, error) {
+	b, ok := <-t.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return b, nil
+}
+
+func (t *chanTransport) WritePacket(b []byte) error {
+	t.out <- bytes.Clone(b)
+	return nil
+}
+
+func (t *chanTransport) Close() error {
+	return nil
+}
+
+func TestGofly_DialContext(t *testing.T) {
+	a, b := make(chan []byte, 64), make(chan []byte, 64)
+	client, err := newGofly("server", ProtoWS, &GoflyOptions{
+		Addrs: []netip.Prefix{netip.MustParsePrefix("172.16.222.100/24")},
+	}, &serverDialer{}, func(context.Context) (packetTransport, error) {
+		return &chanTransport{in: a, out: b}, nil
+	})
+	assert.NoError(t, err)
+	server, err := newNetstack(&packetLink{dial: func(context.Context) (packetTransport, error) {
+		return &chanTransport{in: b, out: a}, nil
+	}}, 1500, []netip.Prefix{netip.MustParsePrefix("172.16.222.1/24")})
+	assert.NoError(t, err)
+
+	l, err := gonet.ListenTCP(server.stack, tcpip.FullAddress{
+		NIC:  netstackNICID,
+		Addr: tcpip.AddrFrom4([4]byte{172, 16, 222, 1}),
+		Port: 80,
+	}, ipv4.ProtocolNumber)
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.DialContext(ctx, &M.Metadata{
+		Network: M.TCP,
+		DstIP:   net.ParseIP("172.16.222.1"),
+		DstPort: 80,
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestCodec(t *testing.T) {
+	c := newCodec(&GoflyOptions{Key: "demo_key", Obfs: true, Compress: true})
+	packet := []byte("an ip packet")
+	b := c.encode(packet)
+	assert.Equal(t, "an ip packet", string(packet))
+	decoded, err := c.decode(b)
+	assert.NoError(t, err)
+	assert.Equal(t, packet, decoded)
+}
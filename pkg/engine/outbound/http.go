@@ -0,0 +1,96 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+var (
+	_ hostDialer = (*HTTP)(nil)
+	_ chainable  = (*HTTP)(nil)
+)
+
+// HTTP is proxy.HTTP issuing CONNECT by hostname when the context carries one.
+type HTTP struct {
+	*proxy.HTTP
+	serverDialer
+
+	user string
+	pass string
+}
+
+func NewHTTP(addr, user, pass string) (*HTTP, error) {
+	base, err := proxy.NewHTTP(addr, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTP{HTTP: base, user: user, pass: pass}, nil
+}
+
+func (h *HTTP) dialHost() {}
+
+func (h *HTTP) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	c, err = h.dialServer(ctx, "tcp", h.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", h.Addr(), err)
+	}
+	setKeepAlive(c)
+
+	defer safeConnClose(c, err)
+
+	err = h.shakeHand(destinationAddress(ctx, metadata), c)
+	return
+}
+
+func (h *HTTP) shakeHand(addr string, rw io.ReadWriter) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL: &url.URL{
+			Host: addr,
+		},
+		Host: addr,
+		Header: http.Header{
+			"Proxy-Connection": []string{"Keep-Alive"},
+		},
+	}
+
+	if h.user != "" && h.pass != "" {
+		req.Header.Set("Proxy-Authorization", basicAuth(h.user, h.pass))
+	}
+
+	if err := req.Write(rw); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(rw), req)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusProxyAuthRequired:
+		return errors.New("HTTP auth required by proxy")
+	case http.StatusMethodNotAllowed:
+		return errors.New("CONNECT method not allowed by proxy")
+	default:
+		return fmt.Errorf("HTTP connect status: %s", resp.Status)
+	}
+}
+
+// basicAuth returns the value of a Basic Proxy-Authorization header.
+func basicAuth(username, password string) string {
+	auth := username + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+}
@@ -0,0 +1,210 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+	"golang.org/x/net/http2"
+)
+
+var (
+	_ hostDialer = (*HTTP2)(nil)
+	_ chainable  = (*HTTP2)(nil)
+)
+
+// HTTP2Options are the settings of the http/2 outbound.
+type HTTP2Options struct {
+	User               string
+	Password           string
+	ServerName         string // the tls server name, the host of the proxy when empty
+	InsecureSkipVerify bool
+}
+
+// HTTP2 is an http/2 proxy over tls: every tcp flow is a CONNECT stream of a shared connection.
+type HTTP2 struct {
+	serverDialer
+
+	addr      string
+	auth      string
+	transport *http2.Transport
+}
+
+func NewHTTP2(addr string, o *HTTP2Options) (*HTTP2, error) {
+	serverName := o.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	h := &HTTP2{addr: addr}
+	if o.User != "" {
+		h.auth = basicAuth(o.User, o.Password)
+	}
+	h.transport = &http2.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: o.InsecureSkipVerify,
+			NextProtos:         []string{http2.NextProtoTLS},
+		},
+		DialTLSContext: func(ctx context.Context, network, _ string, config *tls.Config) (net.Conn, error) {
+			c, err := h.dialServer(ctx, network, addr)
+			if err != nil {
+				return nil, fmt.Errorf("connect to %s: %w", addr, err)
+			}
+			setKeepAlive(c)
+			tlsConn := tls.Client(c, config)
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+	return h, nil
+}
+
+func (h *HTTP2) dialHost() {}
+
+func (h *HTTP2) Addr() string {
+	return h.addr
+}
+
+func (h *HTTP2) Proto() proto.Proto {
+	return ProtoHTTP2
+}
+
+func (h *HTTP2) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	addr := destinationAddress(ctx, metadata)
+	pr, pw := io.Pipe()
+	// the stream lives as long as the conn, so it does not inherit the dial context.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: h.addr},
+		Host:   addr,
+		Header: make(http.Header),
+		Body:   pr,
+	}).WithContext(streamCtx)
+	req.ContentLength = -1
+	if h.auth != "" {
+		req.Header.Set("Proxy-Authorization", h.auth)
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := h.transport.RoundTrip(req)
+		ch <- result{resp, err}
+	}()
+	var r result
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		cancel()
+		pw.Close()
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		cancel()
+		pw.Close()
+		return nil, r.err
+	}
+	if r.resp.StatusCode != http.StatusOK {
+		r.resp.Body.Close()
+		cancel()
+		pw.Close()
+		switch r.resp.StatusCode {
+		case http.StatusProxyAuthRequired:
+			return nil, errors.New("HTTP auth required by proxy")
+		default:
+			return nil, fmt.Errorf("HTTP connect status: %s", r.resp.Status)
+		}
+	}
+	return &http2Conn{
+		r:      r.resp.Body,
+		w:      pw,
+		cancel: cancel,
+		remote: metadata.TCPAddr(),
+	}, nil
+}
+
+var errHTTP2UDP = errors.New("http/2 outbound does not support udp")
+
+func (h *HTTP2) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	return nil, errHTTP2UDP
+}
+
+// http2Conn is a CONNECT stream, it is closed when its read deadline expires
+// and its write deadline is not supported.
+type http2Conn struct {
+	r      io.ReadCloser
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+	remote net.Addr
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func (c *http2Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *http2Conn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *http2Conn) Close() error {
+	c.SetReadDeadline(time.Time{})
+	c.w.Close()
+	c.r.Close()
+	c.cancel()
+	return nil
+}
+
+// CloseWrite ends the request body, half-closing the stream.
+func (c *http2Conn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *http2Conn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *http2Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *http2Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *http2Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() { c.r.Close() })
+	}
+	return nil
+}
+
+func (c *http2Conn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/device/iobased"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	netstackNICID = 1
+
+	// reconnectInterval is the delay between two attempts to connect the packet transport.
+	reconnectInterval = 3 * time.Second
+)
+
+// packetTransport carries ip packets to a server, one packet per call.
+type packetTransport interface {
+	ReadPacket() ([]byte, error)
+	WritePacket([]byte) error
+	Close() error
+}
+
+// packetLink is the io.ReadWriter below the netstack, it connects the transport
+// on demand and reconnects it once it fails.
+type packetLink struct {
+	dial func(context.Context) (packetTransport, error)
+
+	mu        sync.Mutex
+	transport packetTransport
+}
+
+func (l *packetLink) current() packetTransport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.transport
+}
+
+func (l *packetLink) reset(t packetTransport) {
+	l.mu.Lock()
+	if l.transport == t {
+		l.transport = nil
+	}
+	l.mu.Unlock()
+	t.Close()
+}
+
+// connect is only called by Read, so the transport is never dialed twice at once.
+func (l *packetLink) connect() packetTransport {
+	for {
+		if t := l.current(); t != nil {
+			return t
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), tcpConnectTimeout)
+		t, err := l.dial(ctx)
+		cancel()
+		if err != nil {
+			time.Sleep(reconnectInterval)
+			continue
+		}
+		l.mu.Lock()
+		l.transport = t
+		l.mu.Unlock()
+		return t
+	}
+}
+
+func (l *packetLink) Read(b []byte) (int, error) {
+	for {
+		t := l.connect()
+		p, err := t.ReadPacket()
+		if err != nil {
+			l.reset(t)
+			continue
+		}
+		return copy(b, p), nil
+	}
+}
+
+// Write drops the packet while the transport is connecting, the stack retransmits it.
+func (l *packetLink) Write(b []byte) (int, error) {
+	t := l.current()
+	if t == nil {
+		return len(b), nil
+	}
+	if err := t.WritePacket(b); err != nil {
+		l.reset(t)
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// netstack is a userspace network stack dialing tcp and udp over a packet link,
+// it lets the outbounds carrying ip packets serve the flows of the engine.
+type netstack struct {
+	stack *stack.Stack
+}
+
+func newNetstack(link io.ReadWriter, mtu uint32, addrs []netip.Prefix) (*netstack, error) {
+	ep, err := iobased.New(link, mtu, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if e := s.CreateNIC(netstackNICID, ep); e != nil {
+		return nil, fmt.Errorf("create nic: %s", e)
+	}
+	for _, p := range addrs {
+		protocolAddress := tcpip.ProtocolAddress{
+			Protocol: ipv4.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.AddrFromSlice(p.Addr().AsSlice()),
+				PrefixLen: p.Bits(),
+			},
+		}
+		if p.Addr().Is6() {
+			protocolAddress.Protocol = ipv6.ProtocolNumber
+		}
+		if e := s.AddProtocolAddress(netstackNICID, protocolAddress, stack.AddressProperties{}); e != nil {
+			return nil, fmt.Errorf("add address %s: %s", p, e)
+		}
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: netstackNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: netstackNICID},
+	})
+	return &netstack{stack: s}, nil
+}
+
+// networkProtocol returns the network protocol and the canonical form of ip.
+func networkProtocol(ip net.IP) (tcpip.NetworkProtocolNumber, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ipv4.ProtocolNumber, ip4
+	}
+	return ipv6.ProtocolNumber, ip.To16()
+}
+
+func (n *netstack) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	protocol, ip := networkProtocol(metadata.DstIP)
+	return gonet.DialContextTCP(ctx, n.stack, tcpip.FullAddress{
+		NIC:  netstackNICID,
+		Addr: tcpip.AddrFromSlice(ip),
+		Port: metadata.DstPort,
+	}, protocol)
+}
+
+func (n *netstack) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	protocol, _ := networkProtocol(metadata.DstIP)
+	pc, err := gonet.DialUDP(n.stack, nil, nil, protocol)
+	if err != nil {
+		return nil, err
+	}
+	return &netstackPacketConn{UDPConn: pc, protocol: protocol}, nil
+}
+
+var errAddressFamily = errors.New("address family mismatch")
+
+// netstackPacketConn converts the addresses written to into the form gonet expects.
+type netstackPacketConn struct {
+	*gonet.UDPConn
+	protocol tcpip.NetworkProtocolNumber
+}
+
+func (pc *netstackPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("invalid udp address: %v", addr)
+	}
+	protocol, ip := networkProtocol(ua.IP)
+	if protocol != pc.protocol {
+		return 0, errAddressFamily
+	}
+	return pc.UDPConn.WriteTo(b, &net.UDPAddr{IP: ip, Port: ua.Port})
+}
@@ -0,0 +1,94 @@
+// Package outbound provides the outbounds of the engine which tun2socks lacks,
+// they implement proxy.Proxy so they can be used as any other tun2socks proxy.
+package outbound
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
+)
+
+// The protocols of the outbounds which tun2socks lacks, numbered after the ones of tun2socks.
+const (
+	ProtoWS proto.Proto = iota + proto.Shadowsocks + 1
+	ProtoWSS
+	ProtoReality
+	ProtoSSH
+	ProtoHTTP2
+)
+
+// Scheme returns the name of the protocol of p, as used in the proxy url.
+func Scheme(p proxy.Proxy) string {
+	switch p.Proto() {
+	case ProtoWS:
+		return "ws"
+	case ProtoWSS:
+		return "wss"
+	case ProtoReality:
+		return "reality"
+	case ProtoSSH:
+		return "ssh"
+	case ProtoHTTP2:
+		return "h2"
+	default:
+		return p.Proto().String()
+	}
+}
+
+type hostKey struct{}
+
+// WithHost returns a context asking the outbound to dial host instead of the destination ip.
+func WithHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, hostKey{}, host)
+}
+
+// HostFromContext returns the host set by WithHost.
+func HostFromContext(ctx context.Context) string {
+	host, _ := ctx.Value(hostKey{}).(string)
+	return host
+}
+
+// hostDialer is implemented by the outbounds which dial the host carried by the context.
+type hostDialer interface {
+	proxy.Proxy
+	dialHost()
+}
+
+// CanDialHost reports whether p dials the host set by WithHost.
+func CanDialHost(p proxy.Proxy) bool {
+	_, ok := p.(hostDialer)
+	return ok
+}
+
+// destinationAddress returns the host:port to dial for metadata.
+func destinationAddress(ctx context.Context, metadata *M.Metadata) string {
+	if host := HostFromContext(ctx); host != "" {
+		return net.JoinHostPort(host, strconv.FormatUint(uint64(metadata.DstPort), 10))
+	}
+	return metadata.DestinationAddress()
+}
+
+// socksAddr returns the socks5 address to dial for metadata.
+func socksAddr(ctx context.Context, metadata *M.Metadata) socks5.Addr {
+	return socks5.SerializeAddr(HostFromContext(ctx), metadata.DstIP, metadata.DstPort)
+}
+
+// setKeepAlive sets tcp keepalive option for tcp connection.
+func setKeepAlive(c net.Conn) {
+	if tcp, ok := c.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(tcpKeepAlivePeriod)
+	}
+}
+
+// safeConnClose closes tcp connection safely.
+func safeConnClose(c net.Conn, err error) {
+	if c != nil && err != nil {
+		c.Close()
+	}
+}
@@ -0,0 +1,272 @@
+package outbound
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"gofly/pkg/x/xproto"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// realityVersion is the client version carried in the session id, the server does not check it.
+var realityVersion = [3]byte{1, 8, 0}
+
+var errRealityVerification = errors.New("reality verification failed")
+
+// RealityOptions are the settings of the gofly reality outbound.
+type RealityOptions struct {
+	GoflyOptions
+
+	ServerName  string // one of RealitySettings.ServerNames of the server
+	PublicKey   string // the public key of RealitySettings.PrivateKey, base64 raw url encoded
+	ShortID     string // one of RealitySettings.ShortID of the server
+	Fingerprint string // the tls client hello to mimic: chrome, firefox, safari, ios, edge or randomized
+}
+
+func realityFingerprint(name string) (utls.ClientHelloID, error) {
+	switch name {
+	case "", "chrome":
+		return utls.HelloChrome_Auto, nil
+	case "firefox":
+		return utls.HelloFirefox_Auto, nil
+	case "safari":
+		return utls.HelloSafari_Auto, nil
+	case "ios":
+		return utls.HelloIOS_Auto, nil
+	case "edge":
+		return utls.HelloEdge_Auto, nil
+	case "randomized":
+		return utls.HelloRandomized, nil
+	default:
+		return utls.ClientHelloID{}, fmt.Errorf("unsupported fingerprint: %s", name)
+	}
+}
+
+// NewReality returns the outbound to a gofly reality server.
+func NewReality(addr string, o *RealityOptions) (*Gofly, error) {
+	if o.ServerName == "" {
+		return nil, errors.New("reality outbound requires a server name")
+	}
+	publicKey, err := base64.RawURLEncoding.DecodeString(o.PublicKey)
+	if err != nil || len(publicKey) != 32 {
+		return nil, fmt.Errorf("invalid public key: %s", o.PublicKey)
+	}
+	var shortID [8]byte
+	if len(o.ShortID) > 2*len(shortID) {
+		return nil, fmt.Errorf("invalid short id: %s", o.ShortID)
+	}
+	if _, err = hex.Decode(shortID[:], []byte(o.ShortID)); err != nil {
+		return nil, fmt.Errorf("invalid short id: %w", err)
+	}
+	fingerprint, err := realityFingerprint(o.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	d := &realityDialer{
+		serverDialer: &serverDialer{},
+		addr:         addr,
+		serverName:   o.ServerName,
+		publicKey:    publicKey,
+		shortID:      shortID,
+		fingerprint:  fingerprint,
+		authKey:      xproto.ParseAuthKeyFromString(o.Key),
+		codec:        newCodec(&o.GoflyOptions),
+	}
+	for _, p := range o.Addrs {
+		if p.Addr().Is4() && d.ipv4 == nil {
+			d.ipv4 = p.Addr().AsSlice()
+		} else if p.Addr().Is6() && d.ipv6 == nil {
+			d.ipv6 = p.Addr().AsSlice()
+		}
+	}
+	if d.ipv4 == nil {
+		d.ipv4 = net.IPv4zero
+	}
+	if d.ipv6 == nil {
+		d.ipv6 = net.IPv6zero
+	}
+	return newGofly(addr, ProtoReality, &o.GoflyOptions, d.serverDialer, d.dial)
+}
+
+type realityDialer struct {
+	*serverDialer
+
+	addr        string
+	serverName  string
+	publicKey   []byte
+	shortID     [8]byte
+	fingerprint utls.ClientHelloID
+	authKey     *xproto.AuthKey
+	ipv4, ipv6  net.IP
+	codec       *codec
+}
+
+func (d *realityDialer) dial(ctx context.Context) (t packetTransport, err error) {
+	c, err := d.dialServer(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", d.addr, err)
+	}
+	setKeepAlive(c)
+
+	defer safeConnClose(c, err)
+
+	conn, err := d.handshake(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	hs := &xproto.ClientHandshakePacket{
+		ProtocolVersion: xproto.ProtocolVersion,
+		Key:             d.authKey,
+		CIDRv4:          d.ipv4,
+		CIDRv6:          d.ipv6,
+	}
+	if _, err = conn.Write(hs.Bytes()); err != nil {
+		return nil, err
+	}
+	return &realityTransport{conn: conn, authKey: d.authKey, codec: d.codec}, nil
+}
+
+// handshake is the REALITY client handshake: the session id of the client hello carries the
+// short id sealed with the x25519 secret shared with the server, which proves itself by
+// signing its temporary certificate with the same secret.
+func (d *realityDialer) handshake(ctx context.Context, c net.Conn) (net.Conn, error) {
+	var authKey []byte
+	config := &utls.Config{
+		ServerName:             d.serverName,
+		SessionTicketsDisabled: true,
+		InsecureSkipVerify:     true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || authKey == nil {
+				return errRealityVerification
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			pub, ok := cert.PublicKey.(ed25519.PublicKey)
+			if !ok {
+				return errRealityVerification
+			}
+			h := hmac.New(sha512.New, authKey)
+			h.Write(pub)
+			if !hmac.Equal(h.Sum(nil), cert.Signature) {
+				return errRealityVerification
+			}
+			return nil
+		},
+	}
+	uConn := utls.UClient(c, config, d.fingerprint)
+	if err := uConn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	hello := uConn.HandshakeState.Hello
+	ecdhe, ok := uConn.HandshakeState.State13.KeySharesEcdheParams[utls.X25519]
+	if !ok || len(hello.Raw) < 39+32 {
+		return nil, fmt.Errorf("fingerprint %s has no x25519 key share", d.fingerprint.Str())
+	}
+	hello.SessionId = make([]byte, 32)
+	copy(hello.Raw[39:], hello.SessionId) // the session id is at a fixed offset of the client hello
+	copy(hello.SessionId, realityVersion[:])
+	binary.BigEndian.PutUint32(hello.SessionId[4:], uint32(time.Now().Unix()))
+	copy(hello.SessionId[8:], d.shortID[:])
+
+	authKey = ecdhe.SharedKey(d.publicKey)
+	if authKey == nil {
+		return nil, errors.New("invalid public key")
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, authKey, hello.Random[:20], []byte("REALITY")), authKey); err != nil {
+		return nil, err
+	}
+	aead, err := realityAEAD(authKey, hello.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	aead.Seal(hello.SessionId[:0], hello.Random[20:], hello.SessionId[:16], hello.Raw)
+	copy(hello.Raw[39:], hello.SessionId)
+
+	if err = uConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return uConn, nil
+}
+
+// realityAEAD returns the aead the server picks: aes-gcm when the first cipher suite
+// it knows of the client hello is an aes-gcm one, chacha20-poly1305 otherwise.
+func realityAEAD(key []byte, suites []uint16) (cipher.AEAD, error) {
+	known := make(map[uint16]string)
+	for _, s := range append(utls.CipherSuites(), utls.InsecureCipherSuites()...) {
+		known[s.ID] = s.Name
+	}
+	for _, suite := range suites {
+		name, ok := known[suite]
+		if !ok {
+			continue
+		}
+		if !strings.Contains(name, "_GCM_") {
+			break
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return chacha20poly1305.New(key)
+}
+
+// realityTransport frames the packets as reality.Server expects them.
+type realityTransport struct {
+	conn    net.Conn
+	authKey *xproto.AuthKey
+	codec   *codec
+
+	mu     sync.Mutex
+	header [xproto.ServerSendPacketHeaderLength]byte
+}
+
+func (t *realityTransport) ReadPacket() ([]byte, error) {
+	if _, err := io.ReadFull(t.conn, t.header[:]); err != nil {
+		return nil, err
+	}
+	ph := xproto.ParseServerSendPacketHeader(t.header[:])
+	b := make([]byte, ph.Length)
+	if _, err := io.ReadFull(t.conn, b); err != nil {
+		return nil, err
+	}
+	return t.codec.decode(b)
+}
+
+func (t *realityTransport) WritePacket(b []byte) error {
+	b = t.codec.encode(b)
+	ph := &xproto.ClientSendPacketHeader{
+		ProtocolVersion: xproto.ProtocolVersion,
+		Key:             t.authKey,
+		Length:          len(b),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.conn.Write(xproto.Merge(ph.Bytes(), b))
+	return err
+}
+
+func (t *realityTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,121 @@
+package outbound
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtls/reality"
+	"golang.org/x/crypto/curve25519"
+)
+
+// listenDest starts the tls server a reality server borrows its handshake from.
+func listenDest(t *testing.T) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	assert.NoError(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestReality_Handshake(t *testing.T) {
+	dest := listenDest(t)
+	defer dest.Close()
+
+	privateKey := make([]byte, 32)
+	rand.Read(privateKey)
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	assert.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := reality.NewListener(l, &reality.Config{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial(network, address)
+		},
+		Type:                   "tcp",
+		Dest:                   dest.Addr().String(),
+		ServerNames:            map[string]bool{"example.com": true},
+		PrivateKey:             privateKey,
+		ShortIds:               map[[8]byte]bool{{0xab, 0xcd}: true},
+		SessionTicketsDisabled: true,
+	})
+	defer server.Close()
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	o := &RealityOptions{
+		ServerName: "example.com",
+		PublicKey:  base64.RawURLEncoding.EncodeToString(publicKey),
+		ShortID:    "abcd",
+	}
+	fingerprint, err := realityFingerprint(o.Fingerprint)
+	assert.NoError(t, err)
+	d := &realityDialer{
+		serverName:  o.ServerName,
+		publicKey:   publicKey,
+		shortID:     [8]byte{0xab, 0xcd},
+		fingerprint: fingerprint,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	conn, err := d.handshake(ctx, c)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	d.shortID = [8]byte{0xff}
+	c, err = net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	_, err = d.handshake(ctx, c)
+	assert.Error(t, err)
+	c.Close()
+}
@@ -0,0 +1,78 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/Dreamacro/go-shadowsocks2/core"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	obfs "github.com/xjasonlyu/tun2socks/v2/transport/simple-obfs"
+)
+
+var (
+	_ hostDialer = (*Shadowsocks)(nil)
+	_ chainable  = (*Shadowsocks)(nil)
+)
+
+// Shadowsocks is proxy.Shadowsocks which can be chained, and requests the hostname
+// when the context carries one.
+type Shadowsocks struct {
+	*proxy.Shadowsocks
+	serverDialer
+
+	cipher core.Cipher
+
+	// simple-obfs plugin
+	obfsMode, obfsHost string
+}
+
+func NewShadowsocks(addr, method, password, obfsMode, obfsHost string) (*Shadowsocks, error) {
+	base, err := proxy.NewShadowsocks(addr, method, password, obfsMode, obfsHost)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := core.PickCipher(method, nil, password)
+	if err != nil {
+		return nil, fmt.Errorf("ss initialize: %w", err)
+	}
+	return &Shadowsocks{
+		Shadowsocks: base,
+		cipher:      cipher,
+		obfsMode:    obfsMode,
+		obfsHost:    obfsHost,
+	}, nil
+}
+
+func (ss *Shadowsocks) dialHost() {}
+
+func (ss *Shadowsocks) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	c, err = ss.dialServer(ctx, "tcp", ss.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", ss.Addr(), err)
+	}
+	setKeepAlive(c)
+
+	defer safeConnClose(c, err)
+
+	switch ss.obfsMode {
+	case "tls":
+		c = obfs.NewTLSObfs(c, ss.obfsHost)
+	case "http":
+		_, port, _ := net.SplitHostPort(ss.Addr())
+		c = obfs.NewHTTPObfs(c, ss.obfsHost, port)
+	}
+
+	c = ss.cipher.StreamConn(c)
+	_, err = c.Write(socksAddr(ctx, metadata))
+	return
+}
+
+// DialUDP is refused when chained, the udp relay would not go through the chain.
+func (ss *Shadowsocks) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	if ss.chained() {
+		return nil, errChainUDP
+	}
+	return ss.Shadowsocks.DialUDP(metadata)
+}
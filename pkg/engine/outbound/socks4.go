@@ -0,0 +1,42 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks4"
+)
+
+var _ chainable = (*Socks4)(nil)
+
+// Socks4 is proxy.Socks4 which can be chained.
+type Socks4 struct {
+	*proxy.Socks4
+	serverDialer
+
+	userID string
+}
+
+func NewSocks4(addr, userID string) (*Socks4, error) {
+	base, err := proxy.NewSocks4(addr, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &Socks4{Socks4: base, userID: userID}, nil
+}
+
+func (ss *Socks4) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	c, err = ss.dialServer(ctx, "tcp", ss.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", ss.Addr(), err)
+	}
+	setKeepAlive(c)
+
+	defer safeConnClose(c, err)
+
+	err = socks4.ClientHandshake(c, metadata.DestinationAddress(), socks4.CmdConnect, ss.userID)
+	return
+}
@@ -0,0 +1,159 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
+)
+
+const tcpKeepAlivePeriod = 30 * time.Second
+
+var (
+	_ hostDialer = (*Socks5)(nil)
+	_ chainable  = (*Socks5)(nil)
+)
+
+// Socks5 is proxy.Socks5 issuing CONNECT by hostname when the context carries one,
+// its udp flows fall back to tcp when the server lacks UDP ASSOCIATE.
+type Socks5 struct {
+	*proxy.Socks5
+	serverDialer
+
+	udp *udpFallback
+
+	user string
+	pass string
+
+	// unix indicates if socks5 over UDS is enabled.
+	unix bool
+}
+
+func NewSocks5(addr, user, pass string) (*Socks5, error) {
+	base, err := proxy.NewSocks5(addr, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := newUDPFallback(UDPOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &Socks5{
+		Socks5: base,
+		udp:    udp,
+		user:   user,
+		pass:   pass,
+		unix:   len(addr) > 0 && addr[0] == '/',
+	}, nil
+}
+
+// SetUDPOptions sets how the udp flows are carried, before the outbound is used.
+func (ss *Socks5) SetUDPOptions(o UDPOptions) error {
+	udp, err := newUDPFallback(o)
+	if err != nil {
+		return err
+	}
+	ss.udp = udp
+	return nil
+}
+
+func (ss *Socks5) UDPStats() *UDPStats {
+	s := ss.udp.stats()
+	if !ss.associate() {
+		s.Active = UDPModeTCP
+	}
+	return s
+}
+
+// associate reports whether the udp flows use UDP ASSOCIATE, whose datagrams can not go
+// through a chain or a unix socket.
+func (ss *Socks5) associate() bool {
+	return !ss.chained() && !ss.unix && ss.udp.associate.Load()
+}
+
+func (ss *Socks5) startUDPCheck(ctx context.Context) {
+	if ss.chained() || ss.unix {
+		return
+	}
+	ss.udp.start(ctx, ss.Addr(), ss.checkUDPAssociate)
+}
+
+// checkUDPAssociate relays a dns query with UDP ASSOCIATE.
+func (ss *Socks5) checkUDPAssociate(ctx context.Context) error {
+	pc, err := ss.Socks5.DialUDP(&M.Metadata{Network: M.UDP})
+	if err != nil {
+		// the server is unreachable, which tells nothing about UDP ASSOCIATE.
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return err
+		}
+		return fmt.Errorf("%w: %v", errAssociateUnsupported, err)
+	}
+	defer pc.Close()
+	return probeUDP(ctx, pc, ss.udp.options.CheckServer)
+}
+
+func (ss *Socks5) dialHost() {}
+
+func (ss *Socks5) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Conn, err error) {
+	network := "tcp"
+	if ss.unix {
+		network = "unix"
+	}
+
+	c, err = ss.dialServer(ctx, network, ss.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", ss.Addr(), err)
+	}
+	setKeepAlive(c)
+
+	defer safeConnClose(c, err)
+
+	var user *socks5.User
+	if ss.user != "" {
+		user = &socks5.User{
+			Username: ss.user,
+			Password: ss.pass,
+		}
+	}
+
+	_, err = socks5.ClientHandshake(c, socksAddr(ctx, metadata), socks5.CmdConnect, user)
+	return
+}
+
+// DialUDP uses UDP ASSOCIATE, or carries the flow over tcp in tcp mode: the dns queries as
+// DNS-over-TCP, the other datagrams with UDP-over-TCP when the server supports it.
+func (ss *Socks5) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	if ss.associate() {
+		ss.udp.associateFlows.Inc()
+		return ss.Socks5.DialUDP(metadata)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tcpConnectTimeout)
+	defer cancel()
+
+	switch {
+	case metadata.DstPort == 53:
+		c, err := ss.DialContext(ctx, &M.Metadata{Network: M.TCP, DstIP: metadata.DstIP, DstPort: metadata.DstPort})
+		if err != nil {
+			return nil, err
+		}
+		ss.udp.dnsOverTCPFlows.Inc()
+		return &dnsOverTCPConn{Conn: c, remote: metadata.UDPAddr()}, nil
+	case ss.udp.options.UoT:
+		c, err := ss.DialContext(WithHost(ctx, uotMagicHost), &M.Metadata{Network: M.TCP, DstIP: net.IPv4zero})
+		if err != nil {
+			return nil, err
+		}
+		ss.udp.uotFlows.Inc()
+		return &uotConn{Conn: c}, nil
+	default:
+		ss.udp.refusedFlows.Inc()
+		return nil, errUDPUnsupported
+	}
+}
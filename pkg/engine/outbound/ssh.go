@@ -0,0 +1,176 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	_ hostDialer = (*SSH)(nil)
+	_ chainable  = (*SSH)(nil)
+)
+
+// SSHOptions are the settings of the ssh outbound.
+type SSHOptions struct {
+	User       string
+	Password   string
+	KeyFile    string // the private key authenticating the user
+	Passphrase string // the passphrase of KeyFile
+	KnownHosts string // the known_hosts file verifying the server
+	HostKey    string // the public key of the server in authorized_keys format or its SHA256: fingerprint, checked instead of KnownHosts
+	Insecure   bool   // the server is not verified, required without KnownHosts and HostKey
+}
+
+// SSH is ssh dynamic forwarding (ssh -D): the tcp flows are opened as direct-tcpip
+// channels of a single ssh connection, which is reconnected once it is lost.
+type SSH struct {
+	serverDialer
+
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func NewSSH(addr string, o *SSHOptions) (*SSH, error) {
+	config := &ssh.ClientConfig{
+		User:    o.User,
+		Timeout: tcpConnectTimeout,
+	}
+	if o.KeyFile != "" {
+		b, err := os.ReadFile(o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if o.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(o.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", o.KeyFile, err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if o.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(o.Password))
+	}
+	switch {
+	case strings.HasPrefix(o.HostKey, "SHA256:"):
+		config.HostKeyCallback = func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); fingerprint != o.HostKey {
+				return fmt.Errorf("host key mismatch: %s", fingerprint)
+			}
+			return nil
+		}
+	case o.HostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(o.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("parse host key: %w", err)
+		}
+		config.HostKeyCallback = ssh.FixedHostKey(key)
+	case o.KnownHosts != "":
+		callback, err := knownhosts.New(o.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		config.HostKeyCallback = callback
+	case o.Insecure:
+		log.Warnf("[SSH] host key of %s is not verified, insecure=true", addr)
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("ssh: known_hosts or host_key is required, or insecure=true")
+	}
+	return &SSH{addr: addr, config: config}, nil
+}
+
+func (s *SSH) dialHost() {}
+
+func (s *SSH) Addr() string {
+	return s.addr
+}
+
+func (s *SSH) Proto() proto.Proto {
+	return ProtoSSH
+}
+
+// connect returns the ssh connection, dialing it when there is none.
+func (s *SSH) connect(ctx context.Context) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	c, err := s.dialServer(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", s.addr, err)
+	}
+	setKeepAlive(c)
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(c, s.addr, s.config)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	client := ssh.NewClient(conn, chans, reqs)
+	go func() {
+		client.Wait()
+		s.mu.Lock()
+		if s.client == client {
+			s.client = nil
+		}
+		s.mu.Unlock()
+	}()
+	s.client = client
+	return client, nil
+}
+
+func (s *SSH) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := client.Dial("tcp", destinationAddress(ctx, metadata))
+		ch <- result{c, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+var errSSHUDP = errors.New("ssh outbound does not support udp")
+
+func (s *SSH) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	return nil, errSSHUDP
+}
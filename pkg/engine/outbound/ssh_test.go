@@ -0,0 +1,35 @@
+package outbound
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewSSH_HostKey(t *testing.T) {
+	// the server must be verified unless it is explicitly insecure.
+	_, err := NewSSH("127.0.0.1:22", &SSHOptions{User: "demo"})
+	assert.Error(t, err)
+	_, err = NewSSH("127.0.0.1:22", &SSHOptions{User: "demo", Insecure: true})
+	assert.NoError(t, err)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.NoError(t, err)
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := ssh.NewPublicKey(other)
+	assert.NoError(t, err)
+	for _, hostKey := range []string{string(ssh.MarshalAuthorizedKey(key)), ssh.FingerprintSHA256(key)} {
+		s, err := NewSSH("127.0.0.1:22", &SSHOptions{User: "demo", HostKey: hostKey})
+		assert.NoError(t, err)
+		addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+		assert.NoError(t, s.config.HostKeyCallback("127.0.0.1:22", addr, key))
+		assert.Error(t, s.config.HostKeyCallback("127.0.0.1:22", addr, otherKey))
+	}
+}
@@ -0,0 +1,311 @@
+package outbound
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
+	"go.uber.org/atomic"
+	"gofly/pkg/dns"
+)
+
+// The udp modes of an outbound.
+const (
+	// UDPModeAuto uses UDP ASSOCIATE when the health check finds it supported, tcp otherwise.
+	UDPModeAuto = "auto"
+	// UDPModeAssociate always uses UDP ASSOCIATE.
+	UDPModeAssociate = "associate"
+	// UDPModeTCP carries dns queries as DNS-over-TCP and, when the upstream supports it,
+	// the other datagrams with the UDP-over-TCP framing.
+	UDPModeTCP = "tcp"
+)
+
+const (
+	defaultUDPCheckInterval = 5 * time.Minute
+	defaultUDPCheckServer   = "1.1.1.1:53"
+	udpCheckTimeout         = 10 * time.Second
+
+	// uotMagicHost is the CONNECT destination asking the upstream for UDP-over-TCP, as used by sing-box.
+	uotMagicHost = "sp.udp-over-tcp.arpa"
+)
+
+var (
+	errUDPUnsupported = errors.New("udp is not supported by the outbound")
+
+	// errAssociateUnsupported is returned by the health check when the upstream is reachable
+	// but does not relay datagrams with UDP ASSOCIATE.
+	errAssociateUnsupported = errors.New("udp associate is not supported")
+)
+
+// UDPOptions are the udp settings of an outbound.
+type UDPOptions struct {
+	Mode          string        // one of UDPModeAuto, UDPModeAssociate or UDPModeTCP, UDPModeAuto when empty
+	UoT           bool          // the upstream accepts UDP-over-TCP
+	CheckInterval time.Duration // the interval of the UDP ASSOCIATE health check
+	CheckServer   string        // the dns server queried through UDP ASSOCIATE by the health check
+}
+
+// UDPFlows counts the udp flows by the way they are carried.
+type UDPFlows struct {
+	Associate  uint64 `json:"associate"`
+	DNSOverTCP uint64 `json:"dns_over_tcp"`
+	UoT        uint64 `json:"uot"`
+	Refused    uint64 `json:"refused"`
+}
+
+// UDPStats tells how the udp flows of an outbound are carried.
+type UDPStats struct {
+	Mode               string    `json:"mode"`                          // the configured mode
+	Active             string    `json:"active"`                        // associate or tcp
+	UoT                bool      `json:"uot"`                           // the other datagrams are carried over tcp in tcp mode
+	AssociateSupported *bool     `json:"associate_supported,omitempty"` // the result of the last health check
+	CheckedAt          time.Time `json:"checked_at,omitempty"`
+	CheckError         string    `json:"check_error,omitempty"`
+	Flows              UDPFlows  `json:"flows"`
+}
+
+// udpReporter is implemented by the outbounds which report UDPStats.
+type udpReporter interface {
+	UDPStats() *UDPStats
+}
+
+// UDPStatsOf returns the UDPStats of p, nil when p does not report them.
+func UDPStatsOf(p proxy.Proxy) *UDPStats {
+	if r, ok := p.(udpReporter); ok {
+		return r.UDPStats()
+	}
+	return nil
+}
+
+// udpChecker is implemented by the outbounds checking their udp support in the background.
+type udpChecker interface {
+	startUDPCheck(ctx context.Context)
+}
+
+// StartUDPCheck starts the udp health check of p, if it has one, until ctx is done.
+func StartUDPCheck(ctx context.Context, p proxy.Proxy) {
+	if c, ok := p.(udpChecker); ok {
+		c.startUDPCheck(ctx)
+	}
+}
+
+// udpFallback chooses between UDP ASSOCIATE and the tcp fallbacks for an outbound.
+type udpFallback struct {
+	options UDPOptions
+
+	associate atomic.Bool
+
+	mu         sync.Mutex
+	supported  *bool
+	checkedAt  time.Time
+	checkError string
+	once       sync.Once
+
+	associateFlows  atomic.Uint64
+	dnsOverTCPFlows atomic.Uint64
+	uotFlows        atomic.Uint64
+	refusedFlows    atomic.Uint64
+}
+
+func newUDPFallback(o UDPOptions) (*udpFallback, error) {
+	switch o.Mode {
+	case "":
+		o.Mode = UDPModeAuto
+	case UDPModeAuto, UDPModeAssociate, UDPModeTCP:
+	default:
+		return nil, fmt.Errorf("unsupported udp mode: %s", o.Mode)
+	}
+	if o.CheckInterval <= 0 {
+		o.CheckInterval = defaultUDPCheckInterval
+	}
+	if o.CheckServer == "" {
+		o.CheckServer = defaultUDPCheckServer
+	}
+	u := &udpFallback{options: o}
+	// auto starts with UDP ASSOCIATE until the first health check tells otherwise.
+	u.associate.Store(o.Mode != UDPModeTCP)
+	return u, nil
+}
+
+// start runs check now and every CheckInterval until ctx is done, check returns nil when UDP
+// ASSOCIATE works and errAssociateUnsupported when it does not.
+func (u *udpFallback) start(ctx context.Context, name string, check func(context.Context) error) {
+	if u.options.Mode != UDPModeAuto {
+		return
+	}
+	u.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(u.options.CheckInterval)
+			defer ticker.Stop()
+			for ctx.Err() == nil {
+				u.check(ctx, name, check)
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	})
+}
+
+func (u *udpFallback) check(ctx context.Context, name string, check func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(ctx, udpCheckTimeout)
+	err := check(ctx)
+	cancel()
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.checkedAt = time.Now()
+	u.checkError = ""
+	if err != nil {
+		u.checkError = err.Error()
+		if !errors.Is(err, errAssociateUnsupported) {
+			// the upstream is unreachable, keep the previous verdict.
+			log.Warnf("[UDP] check %s: %v", name, err)
+			return
+		}
+	}
+	supported := err == nil
+	first := u.supported == nil
+	u.supported = &supported
+	if u.associate.Swap(supported) != supported || first {
+		log.Infof("[UDP] %s udp mode: %s", name, u.activeMode())
+	}
+}
+
+func (u *udpFallback) activeMode() string {
+	if u.associate.Load() {
+		return UDPModeAssociate
+	}
+	return UDPModeTCP
+}
+
+func (u *udpFallback) stats() *UDPStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s := &UDPStats{
+		Mode:       u.options.Mode,
+		Active:     u.activeMode(),
+		UoT:        u.options.UoT,
+		CheckedAt:  u.checkedAt,
+		CheckError: u.checkError,
+		Flows: UDPFlows{
+			Associate:  u.associateFlows.Load(),
+			DNSOverTCP: u.dnsOverTCPFlows.Load(),
+			UoT:        u.uotFlows.Load(),
+			Refused:    u.refusedFlows.Load(),
+		},
+	}
+	if u.supported != nil {
+		supported := *u.supported
+		s.AssociateSupported = &supported
+	}
+	return s
+}
+
+// dnsOverTCPConn carries the dns queries of a udp flow as DNS-over-TCP.
+type dnsOverTCPConn struct {
+	net.Conn
+	remote *net.UDPAddr
+}
+
+func (c *dnsOverTCPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	msg, err := dns.ReadTCPMessage(c.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, msg), c.remote, nil
+}
+
+func (c *dnsOverTCPConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if err := dns.WriteTCPMessage(c.Conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// uotConn carries the datagrams of a udp flow with the UDP-over-TCP framing:
+// every datagram is its socks5 address, its uint16 length and its payload.
+type uotConn struct {
+	net.Conn
+	buf [socks5.MaxAddrLen]byte
+}
+
+func (c *uotConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	addr, err := socks5.ReadAddr(c.Conn, c.buf[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	var length uint16
+	if err = binary.Read(c.Conn, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if int(length) > len(b) {
+		if _, err = io.CopyN(io.Discard, c.Conn, int64(length)); err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, io.ErrShortBuffer
+	}
+	n, err := io.ReadFull(c.Conn, b[:length])
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, addr.UDPAddr(), nil
+}
+
+func (c *uotConn) WriteTo(b []byte, to net.Addr) (int, error) {
+	addr := socks5.ParseAddr(to)
+	if addr == nil {
+		return 0, fmt.Errorf("invalid udp address: %v", to)
+	}
+	packet := make([]byte, 0, len(addr)+2+len(b))
+	packet = append(packet, addr...)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(b)))
+	packet = append(packet, b...)
+	if _, err := c.Conn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// dnsProbe is a query for the root name servers, answered by any recursive dns server.
+var dnsProbe = []byte{
+	0x67, 0x66, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // header, recursion desired
+	0x00, 0x00, 0x02, 0x00, 0x01, // ". IN NS"
+}
+
+// probeUDP sends dnsProbe to server through pc and waits for the answer.
+func probeUDP(ctx context.Context, pc net.PacketConn, server string) error {
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.SetDeadline(deadline)
+	}
+	if _, err = pc.WriteTo(dnsProbe, addr); err != nil {
+		return fmt.Errorf("%w: %v", errAssociateUnsupported, err)
+	}
+	buf := make([]byte, 512)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("%w: no answer from %s: %v", errAssociateUnsupported, server, err)
+		}
+		if n >= 12 && buf[0] == dnsProbe[0] && buf[1] == dnsProbe[1] {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package outbound
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
+)
+
+// listenNoAssociate starts a socks5 server refusing every command.
+func listenNoAssociate(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, socks5.MaxAddrLen)
+				// greeting: version, methods
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+					return
+				}
+				c.Write([]byte{socks5.Version, 0x00})
+				// request: version, command, reserved, address
+				if _, err := io.ReadFull(c, buf[:3]); err != nil {
+					return
+				}
+				if _, err := socks5.ReadAddr(c, buf); err != nil {
+					return
+				}
+				c.Write([]byte{socks5.Version, 0x07, 0x00, socks5.AtypIPv4, 0, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+	return l
+}
+
+func TestSocks5_UDPCheck(t *testing.T) {
+	l := listenNoAssociate(t)
+	defer l.Close()
+
+	ss, err := NewSocks5(l.Addr().String(), "", "")
+	assert.NoError(t, err)
+	assert.NoError(t, ss.SetUDPOptions(UDPOptions{UoT: true}))
+	assert.Equal(t, UDPModeAssociate, ss.UDPStats().Active)
+
+	ss.udp.check(context.Background(), ss.Addr(), ss.checkUDPAssociate)
+	stats := ss.UDPStats()
+	assert.Equal(t, UDPModeAuto, stats.Mode)
+	assert.Equal(t, UDPModeTCP, stats.Active)
+	if assert.NotNil(t, stats.AssociateSupported) {
+		assert.False(t, *stats.AssociateSupported)
+	}
+	assert.NotEmpty(t, stats.CheckError)
+
+	// an unreachable server keeps the verdict.
+	l.Close()
+	ss.udp.check(context.Background(), ss.Addr(), ss.checkUDPAssociate)
+	assert.Equal(t, UDPModeTCP, ss.UDPStats().Active)
+}
+
+func TestUDPFallback_Stop(t *testing.T) {
+	u, err := newUDPFallback(UDPOptions{CheckInterval: time.Millisecond})
+	assert.NoError(t, err)
+	checks := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	u.start(ctx, "test", func(context.Context) error {
+		checks <- struct{}{}
+		return nil
+	})
+	<-checks
+	<-checks
+	// the checks stop with ctx.
+	cancel()
+	select {
+	case <-checks:
+	case <-time.After(10 * time.Millisecond):
+	}
+	select {
+	case <-checks:
+		t.Fatal("checked after ctx was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUoTConn(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := &uotConn{Conn: a}, &uotConn{Conn: b}
+	defer client.Close()
+	defer server.Close()
+
+	to := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+	go client.WriteTo([]byte("datagram"), to)
+	buf := make([]byte, 64)
+	n, from, err := server.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "datagram", string(buf[:n]))
+	assert.Equal(t, to.String(), from.String())
+
+	go server.WriteTo([]byte("too long for the buffer"), to)
+	_, _, err = client.ReadFrom(buf[:4])
+	assert.ErrorIs(t, err, io.ErrShortBuffer)
+}
@@ -0,0 +1,212 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// wsAuthFieldKey is ws.AuthFieldKey, the header carrying the key to the server.
+	wsAuthFieldKey = "key"
+
+	// wsPingInterval keeps the connection within the 25 seconds keepalive of the server.
+	wsPingInterval = 20 * time.Second
+)
+
+// WSOptions are the settings of the gofly ws and wss outbounds.
+type WSOptions struct {
+	GoflyOptions
+
+	Path               string // must match WebSocketSettings.Path of the server
+	ServerName         string // the tls server name, the host of the server when empty
+	InsecureSkipVerify bool
+	Bond               int    // the websockets bonded into one session by the mux framing, 1 when empty
+	Transport          string // websocket, http2, http3, quic or poll, websocket when empty
+}
+
+// NewWS returns the outbound to a gofly ws server, or to a wss server when secure is set.
+func NewWS(addr string, secure bool, o *WSOptions) (*Gofly, error) {
+	p, scheme := ProtoWS, "ws"
+	if secure {
+		p, scheme = ProtoWSS, "wss"
+	}
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	location := &url.URL{Scheme: scheme, Host: addr, Path: o.Path}
+	config, err := websocket.NewConfig(location.String(), (&url.URL{Scheme: "http", Host: addr}).String())
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set(wsAuthFieldKey, o.Key)
+	c := newCodec(&o.GoflyOptions)
+	config.Protocol = []string{c.subprotocol()}
+	if o.Bond > 1 {
+		config.Protocol = []string{c.muxSubprotocol()}
+	}
+	if secure {
+		serverName := o.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(addr)
+		}
+		config.TlsConfig = &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: o.InsecureSkipVerify,
+		}
+	}
+	sd := &serverDialer{}
+	switch o.Transport {
+	case "", WSTransportWebSocket:
+	case WSTransportHTTP2, WSTransportHTTP3, WSTransportQUIC:
+		if o.Transport != WSTransportHTTP2 && !secure {
+			return nil, fmt.Errorf("the %s transport requires wss", o.Transport)
+		}
+		location.Scheme = "http"
+		if secure {
+			location.Scheme = "https"
+		}
+		if o.Transport == WSTransportQUIC {
+			return newGofly(addr, p, &o.GoflyOptions, sd, func(ctx context.Context) (packetTransport, error) {
+				return dialQUIC(ctx, addr, location, config.TlsConfig, o.Key, c)
+			})
+		}
+		rt := newStreamRoundTripper(o.Transport, addr, config.TlsConfig, sd)
+		return newGofly(addr, p, &o.GoflyOptions, sd, func(ctx context.Context) (packetTransport, error) {
+			return dialStream(ctx, rt, location, o.Key, c)
+		})
+	case WSTransportPoll:
+		location.Scheme = "http"
+		if secure {
+			location.Scheme = "https"
+		}
+		client := newPollClient(addr, config.TlsConfig, sd)
+		return newGofly(addr, p, &o.GoflyOptions, sd, func(ctx context.Context) (packetTransport, error) {
+			return dialPoll(ctx, client, location, o.Key, c)
+		})
+	default:
+		return nil, fmt.Errorf("unsupported transport: %s", o.Transport)
+	}
+	return newGofly(addr, p, &o.GoflyOptions, sd, func(ctx context.Context) (packetTransport, error) {
+		if o.Bond > 1 {
+			return dialWSBond(ctx, sd, addr, config, c, o.Bond)
+		}
+		ws, err := dialWS(ctx, sd, addr, config)
+		if err != nil {
+			return nil, err
+		}
+		ws.SetDeadline(time.Time{})
+		return newWSTransport(ws, c), nil
+	})
+}
+
+// dialWS returns the websocket to the server, its deadline is the one of ctx.
+func dialWS(ctx context.Context, sd *serverDialer, addr string, config *websocket.Config) (ws *websocket.Conn, err error) {
+	conn, err := sd.dialServer(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	setKeepAlive(conn)
+
+	defer safeConnClose(conn, err)
+
+	if config.TlsConfig != nil {
+		tlsConn := tls.Client(conn, config.TlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// the handshake overwrites the offered subprotocols with the one of the server.
+	dialConfig := *config
+	ws, err = websocket.NewClient(&dialConfig, conn)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+func newWSTransport(ws *websocket.Conn, c *codec) *wsTransport {
+	t := &wsTransport{conn: ws, codec: c, done: make(chan struct{})}
+	go t.keepalive()
+	return t
+}
+
+// wsTransport sends a packet per binary message.
+type wsTransport struct {
+	conn  *websocket.Conn
+	codec *codec
+
+	// mu serializes the packets and the pings.
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *wsTransport) keepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			if err := t.ping(); err != nil {
+				t.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (t *wsTransport) ping() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, err := t.conn.NewFrameWriter(websocket.PingFrame)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(nil); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (t *wsTransport) ReadPacket() ([]byte, error) {
+	for {
+		var b []byte
+		if err := websocket.Message.Receive(t.conn, &b); err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			continue
+		}
+		return t.codec.decode(b)
+	}
+}
+
+func (t *wsTransport) WritePacket(b []byte) error {
+	return t.writeMessage(t.codec.encode(b))
+}
+
+func (t *wsTransport) writeMessage(b []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.conn.Write(b)
+	return err
+}
+
+func (t *wsTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return t.conn.Close()
+}
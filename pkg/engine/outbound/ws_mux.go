@@ -0,0 +1,167 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gofly/pkg/mux"
+	"golang.org/x/net/websocket"
+)
+
+// wsMuxStream is the id of the stream on each bonded websocket.
+const wsMuxStream = 1
+
+// dialWSBond dials n websockets to the server, the first opens a mux stream which the others join.
+func dialWSBond(ctx context.Context, sd *serverDialer, addr string, config *websocket.Config, c *codec, n int) (t packetTransport, err error) {
+	mt := &wsMuxTransport{
+		codec:   c,
+		window:  mux.NewWindow(),
+		packets: make(chan []byte, 64),
+		done:    make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			mt.Close()
+		}
+	}()
+	var token string
+	for i := 0; i < n; i++ {
+		ws, err := dialWS(ctx, sd, addr, config)
+		if err != nil {
+			return nil, err
+		}
+		link := newWSTransport(ws, c)
+		mt.links = append(mt.links, link)
+		f := &mux.Frame{Type: mux.TypeOpen, Stream: wsMuxStream}
+		if token != "" {
+			f = &mux.Frame{Type: mux.TypeJoin, Stream: wsMuxStream, Payload: []byte(token)}
+		}
+		if err = link.writeMessage(f.Append(nil)); err != nil {
+			return nil, err
+		}
+		if token, err = readOpened(ws); err != nil {
+			return nil, err
+		}
+		ws.SetDeadline(time.Time{})
+	}
+	for _, link := range mt.links {
+		go mt.receive(link)
+	}
+	return mt, nil
+}
+
+// readOpened returns the token of the Opened frame answering Open or Join.
+func readOpened(ws *websocket.Conn) (string, error) {
+	var b []byte
+	if err := websocket.Message.Receive(ws, &b); err != nil {
+		return "", err
+	}
+	f, err := mux.Parse(b)
+	if err != nil {
+		return "", err
+	}
+	switch f.Type {
+	case mux.TypeOpened:
+		return string(f.Payload), nil
+	case mux.TypeClose:
+		return "", fmt.Errorf("mux stream refused: %s", f.Payload)
+	default:
+		return "", fmt.Errorf("unexpected mux frame type %d", f.Type)
+	}
+}
+
+// wsMuxTransport sends the packets of one mux stream over bonded websockets in turn.
+type wsMuxTransport struct {
+	links  []*wsTransport
+	codec  *codec
+	window *mux.Window
+	next   atomic.Uint32
+
+	packets   chan []byte
+	err       error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *wsMuxTransport) receive(link *wsTransport) {
+	err := t.receiveFrames(link)
+	t.closeOnce.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *wsMuxTransport) receiveFrames(link *wsTransport) error {
+	for {
+		var b []byte
+		if err := websocket.Message.Receive(link.conn, &b); err != nil {
+			return err
+		}
+		f, err := mux.Parse(b)
+		if err != nil {
+			return err
+		}
+		switch f.Type {
+		case mux.TypeData:
+			if n := t.window.Consume(len(f.Payload)); n > 0 {
+				if err = link.writeMessage(mux.WindowFrame(wsMuxStream, n).Append(nil)); err != nil {
+					return err
+				}
+			}
+			packet, err := t.codec.decode(f.Payload)
+			if err != nil {
+				return err
+			}
+			select {
+			case t.packets <- packet:
+			case <-t.done:
+				return nil
+			}
+		case mux.TypeWindow:
+			n, err := mux.WindowSize(&f)
+			if err != nil {
+				return err
+			}
+			t.window.Grant(n)
+		case mux.TypeClose:
+			return fmt.Errorf("mux stream closed by the server: %s", f.Payload)
+		}
+	}
+}
+
+func (t *wsMuxTransport) ReadPacket() ([]byte, error) {
+	select {
+	case b := <-t.packets:
+		return b, nil
+	case <-t.done:
+		if t.err == nil {
+			return nil, errors.New("mux transport closed")
+		}
+		return nil, t.err
+	}
+}
+
+func (t *wsMuxTransport) WritePacket(b []byte) error {
+	b = t.codec.encode(b)
+	if !t.window.Take(len(b)) {
+		return nil
+	}
+	link := t.links[int(t.next.Add(1))%len(t.links)]
+	f := &mux.Frame{Type: mux.TypeData, Stream: wsMuxStream, Payload: b}
+	return link.writeMessage(f.Append(make([]byte, 0, mux.HeaderSize+len(b))))
+}
+
+func (t *wsMuxTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	var err error
+	for _, link := range t.links {
+		if e := link.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,303 @@
+package outbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// wsSessionKey is ws.HTTP_SESSION_KEY, the token of the poll session.
+	wsSessionKey = "GoFly-Session"
+	// maxPollBatch is the size of the posts batching the queued packets.
+	maxPollBatch = 64 << 10
+	// pollPostTimeout bounds a post, a proxy holding it longer has lost the session.
+	pollPostTimeout = 30 * time.Second
+)
+
+var errPollExpired = errors.New("poll session expired")
+
+// newPollClient returns the http/1.1 client of the poll transport.
+func newPollClient(addr string, tlsConfig *tls.Config, sd *serverDialer) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			c, err := sd.dialServer(ctx, network, addr)
+			if err != nil {
+				return nil, fmt.Errorf("connect to %s: %w", addr, err)
+			}
+			setKeepAlive(c)
+			return c, nil
+		},
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+}
+
+// dialPoll opens the poll session at location: the packets from the server are the events of
+// a GET resumed when a proxy cuts it, and the packets to the server are posted in batches.
+func dialPoll(ctx context.Context, client *http.Client, location *url.URL, key string, c *codec) (packetTransport, error) {
+	// the session lives as long as the transport, so it does not inherit the dial context.
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	t := &pollTransport{
+		client:   client,
+		location: location.String(),
+		codec:    c,
+		ctx:      sessionCtx,
+		cancel:   cancel,
+		up:       make(chan []byte, 64),
+		done:     make(chan struct{}),
+	}
+	header := http.Header{}
+	header.Set(wsAuthFieldKey, key)
+	header.Set(wsProtocolKey, c.subprotocol())
+	type result struct {
+		res *http.Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := t.getEvents(header)
+		done <- result{res, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		cancel()
+		return nil, ctx.Err()
+	}
+	if r.err == nil && r.res.Header.Get(wsProtocolKey) != c.subprotocol() {
+		r.res.Body.Close()
+		r.err = fmt.Errorf("unsupported protocol %q", c.subprotocol())
+	}
+	if r.err == nil && r.res.Header.Get(wsSessionKey) == "" {
+		r.res.Body.Close()
+		r.err = errors.New("no poll session")
+	}
+	if r.err != nil {
+		cancel()
+		return nil, r.err
+	}
+	t.token = r.res.Header.Get(wsSessionKey)
+	t.body = r.res.Body
+	t.events = bufio.NewReader(r.res.Body)
+	go t.postLoop()
+	return t, nil
+}
+
+// pollTransport is a poll session, ReadPacket reads its event stream and the packets of
+// WritePacket are posted by postLoop.
+type pollTransport struct {
+	client   *http.Client
+	location string
+	token    string
+	codec    *codec
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	events *bufio.Reader
+	read   bool // an event was read since the event stream was opened
+
+	up        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	body io.Closer
+	err  error
+}
+
+// getEvents gets the event stream with header.
+func (t *pollTransport) getEvents(header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodGet, t.location, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	res, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("server responded %s", res.Status)
+	}
+	// the unknown tokens get the fallback site of the server.
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		res.Body.Close()
+		return nil, errPollExpired
+	}
+	return res, nil
+}
+
+// resume replaces the event stream cut by a proxy.
+func (t *pollTransport) resume() error {
+	header := http.Header{}
+	header.Set(wsSessionKey, t.token)
+	res, err := t.getEvents(header)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.body != nil {
+		t.body.Close()
+	}
+	if t.ctx.Err() != nil {
+		res.Body.Close()
+		return t.ctx.Err()
+	}
+	t.body = res.Body
+	t.events = bufio.NewReader(res.Body)
+	t.read = false
+	return nil
+}
+
+func (t *pollTransport) ReadPacket() ([]byte, error) {
+	for {
+		line, err := t.events.ReadBytes('\n')
+		if err != nil {
+			// an event stream failing before its first event is not resumed again.
+			if !t.read || t.ctx.Err() != nil {
+				return nil, err
+			}
+			if err = t.resume(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		t.read = true
+		data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r\n"), []byte("data:"))
+		if !ok {
+			// the comments keeping the stream open and the blank lines ending the events.
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		b := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(b, data)
+		if err != nil {
+			return nil, err
+		}
+		return t.codec.decode(b[:n])
+	}
+}
+
+func (t *pollTransport) WritePacket(b []byte) error {
+	b = t.codec.encode(b)
+	if len(b) > 1<<16-1 {
+		return errors.New("packet too large")
+	}
+	select {
+	case <-t.done:
+		return t.closedErr()
+	default:
+	}
+	select {
+	case t.up <- b:
+		return nil
+	case <-t.done:
+		return t.closedErr()
+	}
+}
+
+// closedErr returns the error of the failed post which closed t, if any.
+func (t *pollTransport) closedErr() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	return net.ErrClosed
+}
+
+// postLoop posts the queued packets each prefixed by its big endian 2 bytes length, the session
+// is closed once a post fails.
+func (t *pollTransport) postLoop() {
+	var batch []byte
+	for {
+		batch = batch[:0]
+		select {
+		case b := <-t.up:
+			batch = appendPrefixed(batch, b)
+		case <-t.done:
+			return
+		}
+		for more := true; more && len(batch) < maxPollBatch; {
+			select {
+			case b := <-t.up:
+				batch = appendPrefixed(batch, b)
+			default:
+				more = false
+			}
+		}
+		if err := t.post(batch); err != nil {
+			t.mu.Lock()
+			t.err = err
+			t.mu.Unlock()
+			t.Close()
+			return
+		}
+	}
+}
+
+func appendPrefixed(batch, b []byte) []byte {
+	batch = binary.BigEndian.AppendUint16(batch, uint16(len(b)))
+	return append(batch, b...)
+}
+
+func (t *pollTransport) post(batch []byte) error {
+	ctx, cancel := context.WithTimeout(t.ctx, pollPostTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.location, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(wsSessionKey, t.token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("server responded %s", res.Status)
+	}
+	return nil
+}
+
+// Close closes the poll session on the server, the server closes it after its timeout when
+// the request is lost.
+func (t *pollTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, t.location, nil); err == nil {
+			req.Header.Set(wsSessionKey, t.token)
+			if res, err := t.client.Do(req); err == nil {
+				res.Body.Close()
+			}
+		}
+		t.cancel()
+		t.mu.Lock()
+		t.body.Close()
+		t.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,84 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialPoll(t *testing.T) {
+	// the server echoes the posted packets as events, and cuts each event stream after one event
+	// like a proxy limiting the length of the responses.
+	echo := make(chan []byte, 8)
+	deleted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(wsSessionKey)
+		switch {
+		case r.Method == http.MethodGet && token == "":
+			if r.Header.Get(wsAuthFieldKey) != "demo_key" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set(wsProtocolKey, r.Header.Get(wsProtocolKey))
+			w.Header().Set(wsSessionKey, "demo_token")
+		case token != "demo_token":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.Method == http.MethodPost:
+			br := bufio.NewReader(r.Body)
+			var prefix [2]byte
+			for {
+				if _, err := io.ReadFull(br, prefix[:]); err != nil {
+					break
+				}
+				b := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+				io.ReadFull(br, b)
+				echo <- b
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case r.Method == http.MethodDelete:
+			close(deleted)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(": ping\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case b := <-echo:
+			w.Write([]byte("data: " + base64.StdEncoding.EncodeToString(b) + "\n\n"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	location, _ := url.Parse(server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := newCodec(&GoflyOptions{Key: "demo_key", Compress: true})
+	_, err := dialPoll(ctx, server.Client(), location, "wrong_key", c)
+	assert.Error(t, err)
+
+	pt, err := dialPoll(ctx, server.Client(), location, "demo_key", c)
+	assert.NoError(t, err)
+	for _, packet := range []string{"an ip packet", "another ip packet"} {
+		assert.NoError(t, pt.WritePacket([]byte(packet)))
+		b, err := pt.ReadPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, packet, string(b))
+	}
+	assert.NoError(t, pt.Close())
+	<-deleted
+	assert.Error(t, pt.WritePacket([]byte("an ip packet")))
+}
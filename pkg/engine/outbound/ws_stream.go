@@ -0,0 +1,289 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// The transports of the gofly ws outbounds, they must match WebSocketSettings.Transport of the server.
+const (
+	WSTransportWebSocket = "websocket"
+	WSTransportHTTP2     = "http2" // a long lived POST over http/2, h2c for ws
+	WSTransportHTTP3     = "http3" // a long lived POST over http/3, wss only
+	WSTransportQUIC      = "quic"  // quic datagrams, wss only
+	WSTransportPoll      = "poll"  // server sent events down and posts up, for the proxies stripping the upgrades
+)
+
+const (
+	// wsProtocolKey is ws.HTTP_PROTOCOL_KEY, the subprotocol of the stream transports.
+	wsProtocolKey = "GoFly-Protocol"
+	// wsQUICALPN is the alpn of the quic transport.
+	wsQUICALPN = "gofly"
+)
+
+// newStreamRoundTripper returns the round tripper of the http2 and http3 transports.
+func newStreamRoundTripper(transport, addr string, tlsConfig *tls.Config, sd *serverDialer) http.RoundTripper {
+	if transport == WSTransportHTTP3 {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{http3.NextProtoH3}
+		return &http3.RoundTripper{
+			TLSClientConfig: tlsConfig,
+			QuicConfig:      &quic.Config{KeepAlivePeriod: wsPingInterval},
+		}
+	}
+	t := &http2.Transport{
+		AllowHTTP:       tlsConfig == nil,
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+		DialTLSContext: func(ctx context.Context, network, _ string, config *tls.Config) (net.Conn, error) {
+			c, err := sd.dialServer(ctx, network, addr)
+			if err != nil {
+				return nil, fmt.Errorf("connect to %s: %w", addr, err)
+			}
+			setKeepAlive(c)
+			if tlsConfig == nil {
+				return c, nil
+			}
+			tlsConn := tls.Client(c, config)
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+	if tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig.Clone()
+		t.TLSClientConfig.NextProtos = []string{http2.NextProtoTLS}
+	}
+	return t
+}
+
+// dialStream posts the stream of the http2 or http3 transport to location.
+func dialStream(ctx context.Context, rt http.RoundTripper, location *url.URL, key string, c *codec) (packetTransport, error) {
+	pr, pw := io.Pipe()
+	// the stream lives as long as the transport, so it does not inherit the dial context.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodPost, location.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set(wsAuthFieldKey, key)
+	req.Header.Set(wsProtocolKey, c.subprotocol())
+	req.Header.Set("Content-Type", "application/octet-stream")
+	type result struct {
+		res *http.Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := rt.RoundTrip(req)
+		done <- result{res, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		cancel()
+		pw.Close()
+		return nil, ctx.Err()
+	}
+	if r.err == nil && r.res.StatusCode != http.StatusOK {
+		r.res.Body.Close()
+		r.err = fmt.Errorf("server responded %s", r.res.Status)
+	}
+	if r.err == nil && r.res.Header.Get(wsProtocolKey) != c.subprotocol() {
+		r.res.Body.Close()
+		r.err = fmt.Errorf("unsupported protocol %q", c.subprotocol())
+	}
+	if r.err != nil {
+		cancel()
+		pw.Close()
+		return nil, r.err
+	}
+	return &streamTransport{
+		r:     bufio.NewReader(r.res.Body),
+		w:     pw,
+		codec: c,
+		done:  make(chan struct{}),
+		close: func() error {
+			cancel()
+			pw.Close()
+			return r.res.Body.Close()
+		},
+	}, nil
+}
+
+// dialQUIC dials the quic transport, the packets are sent as datagrams and those too large
+// on the stream of the request.
+func dialQUIC(ctx context.Context, addr string, location *url.URL, tlsConfig *tls.Config, key string, c *codec) (t packetTransport, err error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{wsQUICALPN}
+	conn, err := quic.DialAddr(ctx, addr, tlsConfig, &quic.Config{KeepAlivePeriod: wsPingInterval, EnableDatagrams: true})
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	defer func() {
+		if err != nil {
+			conn.CloseWithError(0, "")
+		}
+	}()
+	str, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(wsAuthFieldKey, key)
+	req.Header.Set(wsProtocolKey, c.subprotocol())
+	if deadline, ok := ctx.Deadline(); ok {
+		str.SetDeadline(deadline)
+	}
+	if err = req.Write(str); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(str)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded %s", res.Status)
+	}
+	str.SetDeadline(time.Time{})
+	st := &streamTransport{r: br, w: str, codec: c, done: make(chan struct{})}
+	st.close = func() error { return conn.CloseWithError(0, "") }
+	if conn.ConnectionState().SupportsDatagrams {
+		st.datagram = conn.SendDatagram
+		st.datagrams = make(chan []byte, 64)
+		st.streamed = make(chan streamPacket)
+		go st.readDatagrams(conn)
+		go st.readStream()
+	}
+	return st, nil
+}
+
+type streamPacket struct {
+	b   []byte
+	err error
+}
+
+// streamTransport sends the packets on a stream each prefixed by its big endian 2 bytes length,
+// or as datagrams when they are supported.
+type streamTransport struct {
+	r     *bufio.Reader
+	w     io.Writer
+	codec *codec
+	close func() error
+
+	datagram  func([]byte) error
+	datagrams chan []byte
+	streamed  chan streamPacket
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+}
+
+func (t *streamTransport) readPacket() ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(t.r, prefix[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(t.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readStream feeds the packets of the stream to ReadPacket when datagrams are read too.
+func (t *streamTransport) readStream() {
+	for {
+		b, err := t.readPacket()
+		select {
+		case t.streamed <- streamPacket{b, err}:
+		case <-t.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *streamTransport) readDatagrams(conn quic.Connection) {
+	defer close(t.datagrams)
+	for {
+		b, err := conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case t.datagrams <- b:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *streamTransport) ReadPacket() ([]byte, error) {
+	if t.datagrams == nil {
+		b, err := t.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		return t.codec.decode(b)
+	}
+	select {
+	case b, ok := <-t.datagrams:
+		if !ok {
+			return nil, errors.New("quic connection closed")
+		}
+		return t.codec.decode(b)
+	case p := <-t.streamed:
+		if p.err != nil {
+			return nil, p.err
+		}
+		return t.codec.decode(p.b)
+	}
+}
+
+func (t *streamTransport) WritePacket(b []byte) error {
+	b = t.codec.encode(b)
+	if t.datagram != nil && t.datagram(b) == nil {
+		return nil
+	}
+	if len(b) > 1<<16-1 {
+		return errors.New("packet too large")
+	}
+	m := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(m, uint16(len(b)))
+	copy(m[2:], b)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.w.Write(m)
+	return err
+}
+
+func (t *streamTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return t.close()
+}
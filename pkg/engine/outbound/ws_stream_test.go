@@ -0,0 +1,57 @@
+package outbound
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialStream(t *testing.T) {
+	// the server echoes the packets of the stream.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(wsAuthFieldKey) != "demo_key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set(wsProtocolKey, r.Header.Get(wsProtocolKey))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Body.Read(buf)
+			if err != nil {
+				return
+			}
+			w.Write(buf[:n])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	location, _ := url.Parse(server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := newCodec(&GoflyOptions{Key: "demo_key", Compress: true})
+	_, err := dialStream(ctx, server.Client().Transport, location, "wrong_key", c)
+	assert.Error(t, err)
+
+	st, err := dialStream(ctx, server.Client().Transport, location, "demo_key", c)
+	assert.NoError(t, err)
+	defer st.Close()
+	for _, packet := range []string{"an ip packet", "another ip packet"} {
+		assert.NoError(t, st.WritePacket([]byte(packet)))
+		b, err := st.ReadPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, packet, string(b))
+	}
+	assert.NoError(t, st.Close())
+	_, err = st.ReadPacket()
+	assert.Error(t, err)
+}
@@ -4,9 +4,13 @@ import (
 	"encoding/base64"
 	"fmt"
 	"gofly/pkg/device/tun"
+	"gofly/pkg/engine/outbound"
 	"net"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/xjasonlyu/tun2socks/v2/core/device"
 	"github.com/xjasonlyu/tun2socks/v2/proxy"
@@ -73,18 +77,61 @@ func parseProxy(s string) (proxy.Proxy, error) {
 	case proto.Reject.String():
 		return proxy.NewReject(), nil
 	case proto.HTTP.String():
-		return proxy.NewHTTP(parseHTTP(u))
+		return outbound.NewHTTP(parseHTTP(u))
 	case proto.Socks4.String():
-		return proxy.NewSocks4(parseSocks4(u))
+		return outbound.NewSocks4(parseSocks4(u))
 	case proto.Socks5.String():
-		return proxy.NewSocks5(parseSocks5(u))
+		ss, err := outbound.NewSocks5(parseSocks5(u))
+		if err != nil {
+			return nil, err
+		}
+		o, err := parseUDP(u)
+		if err != nil {
+			return nil, err
+		}
+		if err = ss.SetUDPOptions(o); err != nil {
+			return nil, err
+		}
+		return ss, nil
 	case proto.Shadowsocks.String():
-		return proxy.NewShadowsocks(parseShadowsocks(u))
+		return outbound.NewShadowsocks(parseShadowsocks(u))
+	case "ws", "wss":
+		o, err := parseWS(u)
+		if err != nil {
+			return nil, err
+		}
+		return outbound.NewWS(u.Host, protocol == "wss", o)
+	case "reality":
+		o, err := parseReality(u)
+		if err != nil {
+			return nil, err
+		}
+		return outbound.NewReality(u.Host, o)
+	case "ssh":
+		return outbound.NewSSH(parseSSH(u))
+	case "h2":
+		return outbound.NewHTTP2(parseHTTP2(u))
 	default:
 		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
 	}
 }
 
+// parseChain returns the outbound k.Proxy dialed through the outbounds of k.Chain, and the
+// first of them, which is dialed directly.
+func parseChain(k *Key) (p, first proxy.Proxy, err error) {
+	hops := make([]proxy.Proxy, 0, len(k.Chain)+1)
+	for _, s := range append(append([]string(nil), k.Chain...), k.Proxy) {
+		if p, err = parseProxy(s); err != nil {
+			return nil, nil, err
+		}
+		hops = append(hops, p)
+	}
+	if p, err = outbound.Chain(hops...); err != nil {
+		return nil, nil, err
+	}
+	return p, hops[0], nil
+}
+
 func parseHTTP(u *url.URL) (address, username, password string) {
 	address, username = u.Host, u.User.Username()
 	password, _ = u.User.Password()
@@ -107,6 +154,21 @@ func parseSocks5(u *url.URL) (address, username, password string) {
 	return
 }
 
+// parseUDP returns the udp settings of an outbound from the udp, uot, udp_check and
+// udp_check_server query parameters.
+func parseUDP(u *url.URL) (o outbound.UDPOptions, err error) {
+	q := u.Query()
+	o.Mode = q.Get("udp")
+	o.UoT = parseBool(q.Get("uot"))
+	o.CheckServer = q.Get("udp_check_server")
+	if s := q.Get("udp_check"); s != "" {
+		if o.CheckInterval, err = time.ParseDuration(s); err != nil {
+			return o, fmt.Errorf("invalid udp_check: %w", err)
+		}
+	}
+	return
+}
+
 func parseShadowsocks(u *url.URL) (address, method, password, obfsMode, obfsHost string) {
 	address = u.Host
 
@@ -141,3 +203,108 @@ func parseShadowsocks(u *url.URL) (address, method, password, obfsMode, obfsHost
 
 	return
 }
+
+// parseGofly parses the settings shared by the gofly outbounds, e.g.
+// ?key=demo_key&ip=172.16.222.100/24&ip=fd00::100/64&obfs=true&compress=true
+func parseGofly(u *url.URL) (o outbound.GoflyOptions, err error) {
+	q := u.Query()
+	o.Key = q.Get("key")
+	o.ObfsKey = q.Get("obfs_key")
+	o.Obfs = parseBool(q.Get("obfs"))
+	o.Compress = parseBool(q.Get("compress"))
+	if s := q.Get("mtu"); s != "" {
+		mtu, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return o, fmt.Errorf("invalid mtu: %s", s)
+		}
+		o.MTU = uint32(mtu)
+	}
+	for _, s := range q["ip"] {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return o, fmt.Errorf("invalid ip: %w", err)
+		}
+		o.Addrs = append(o.Addrs, p)
+	}
+	return
+}
+
+// parseWS parses the ws and wss outbounds, bond=N bonds N websockets into one session and
+// transport=http2|http3|quic|poll replaces the websocket.
+func parseWS(u *url.URL) (*outbound.WSOptions, error) {
+	g, err := parseGofly(u)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	o := &outbound.WSOptions{
+		GoflyOptions:       g,
+		Path:               u.Path,
+		ServerName:         q.Get("sni"),
+		InsecureSkipVerify: parseBool(q.Get("insecure")),
+		Transport:          q.Get("transport"),
+	}
+	if s := q.Get("bond"); s != "" {
+		if o.Bond, err = strconv.Atoi(s); err != nil || o.Bond < 1 {
+			return nil, fmt.Errorf("invalid bond: %s", s)
+		}
+	}
+	return o, nil
+}
+
+func parseReality(u *url.URL) (*outbound.RealityOptions, error) {
+	g, err := parseGofly(u)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	return &outbound.RealityOptions{
+		GoflyOptions: g,
+		ServerName:   q.Get("sni"),
+		PublicKey:    q.Get("public_key"),
+		ShortID:      q.Get("short_id"),
+		Fingerprint:  q.Get("fingerprint"),
+	}, nil
+}
+
+func parseSSH(u *url.URL) (address string, o *outbound.SSHOptions) {
+	address = u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "22")
+	}
+	q := u.Query()
+	o = &outbound.SSHOptions{
+		User:       u.User.Username(),
+		KeyFile:    q.Get("key_file"),
+		Passphrase: q.Get("passphrase"),
+		KnownHosts: q.Get("known_hosts"),
+		HostKey:    q.Get("host_key"),
+		Insecure:   parseBool(q.Get("insecure")),
+	}
+	// the + of a fingerprint is decoded as a space when it is not escaped.
+	if strings.HasPrefix(o.HostKey, "SHA256:") {
+		o.HostKey = strings.ReplaceAll(o.HostKey, " ", "+")
+	}
+	o.Password, _ = u.User.Password()
+	return
+}
+
+func parseHTTP2(u *url.URL) (address string, o *outbound.HTTP2Options) {
+	address = u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "443")
+	}
+	q := u.Query()
+	o = &outbound.HTTP2Options{
+		User:               u.User.Username(),
+		ServerName:         q.Get("sni"),
+		InsecureSkipVerify: parseBool(q.Get("insecure")),
+	}
+	o.Password, _ = u.User.Password()
+	return
+}
+
+func parseBool(s string) bool {
+	b, _ := strconv.ParseBool(s)
+	return b
+}
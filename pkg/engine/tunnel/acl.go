@@ -0,0 +1,27 @@
+package tunnel
+
+import (
+	"net/netip"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"gofly/pkg/acl"
+	"gofly/pkg/engine/tunnel/statistic"
+)
+
+// allowFlow evaluates the acl on a flow once its domain is known.
+func allowFlow(metadata *M.Metadata, flow *statistic.Flow) bool {
+	a := acl.Default()
+	if a == nil {
+		return true
+	}
+	ip, _ := netip.AddrFromSlice(metadata.DstIP)
+	return a.Evaluate(&acl.Request{
+		User:      flow.User,
+		Group:     flow.Group,
+		Network:   metadata.Network.String(),
+		IP:        ip.Unmap(),
+		Port:      metadata.DstPort,
+		Host:      flow.Host,
+		HostKnown: true,
+	}) != acl.Deny
+}
@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/common/pool"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"gofly/pkg/dns"
+	"gofly/pkg/engine/outbound"
+)
+
+// dnsQueryTimeout is the timeout of answering a single query.
+const dnsQueryTimeout = 10 * time.Second
+
+var (
+	_resolverMu sync.RWMutex
+
+	// _resolver answers the queries sent to the virtual resolver address.
+	_resolver *dns.Resolver
+)
+
+// SetResolver sets the resolver serving the virtual resolver address, nil disables it.
+func SetResolver(r *dns.Resolver) {
+	_resolverMu.Lock()
+	_resolver = r
+	_resolverMu.Unlock()
+}
+
+func currentResolver() *dns.Resolver {
+	_resolverMu.RLock()
+	defer _resolverMu.RUnlock()
+	return _resolver
+}
+
+// Dial dials address through the current outbound, it is used by the resolver to reach its upstreams.
+func Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("unsupported network: " + network)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	p := currentProxy()
+	if p == nil {
+		return nil, errors.New("no outbound")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// the name of the upstream is resolved by the outbound, resolving it here would leak
+		// the lookup out of the tunnel
+		if !outbound.CanDialHost(p) {
+			return nil, fmt.Errorf("dns upstream %s must be an ip address with a %s outbound", host, outbound.Scheme(p))
+		}
+		ctx = outbound.WithHost(ctx, host)
+		ip = net.IPv4zero
+	}
+	return p.DialContext(ctx, &M.Metadata{Network: M.TCP, DstIP: ip, DstPort: uint16(portInt)})
+}
+
+// isResolverAddr reports whether the flow is sent to the virtual resolver address.
+func isResolverAddr(r *dns.Resolver, metadata *M.Metadata) bool {
+	return r != nil && r.IsResolverAddr(metadata.DstIP, metadata.DstPort)
+}
+
+// serveDNSPacket answers the udp queries of a client.
+func serveDNSPacket(conn net.Conn, r *dns.Resolver) {
+	buf := pool.Get(pool.MaxSegmentSize)
+	defer pool.Put(buf)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn.SetReadDeadline(time.Now().Add(_udpSessionTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+			defer cancel()
+			resp, err := r.Exchange(ctx, query)
+			if err != nil {
+				log.Debugf("[DNS] exchange: %v", err)
+				return
+			}
+			conn.Write(resp)
+		}()
+	}
+}
+
+// serveDNSStream answers the tcp queries of a client.
+func serveDNSStream(conn net.Conn, r *dns.Resolver) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpWaitTimeout))
+		query, err := dns.ReadTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+		resp, err := r.Exchange(ctx, query)
+		cancel()
+		if err != nil {
+			log.Debugf("[DNS] exchange: %v", err)
+			return
+		}
+		if err = dns.WriteTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
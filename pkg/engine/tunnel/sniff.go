@@ -0,0 +1,162 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"gofly/pkg/engine/outbound"
+	"gofly/pkg/engine/tunnel/statistic"
+	"gofly/pkg/sniff"
+)
+
+const (
+	// sniffBufferSize is large enough for a ClientHello with post-quantum key shares.
+	sniffBufferSize = 4096
+
+	// defaultSniffTimeout is how long to wait for the client to speak first.
+	defaultSniffTimeout = 300 * time.Millisecond
+)
+
+var (
+	_sniffMu sync.RWMutex
+
+	// _sniffing holds the sniffing settings, nil disables sniffing.
+	_sniffing *sniff.Config
+)
+
+// SetSniffing sets the sniffing settings of new flows.
+func SetSniffing(c *sniff.Config) {
+	_sniffMu.Lock()
+	_sniffing = c
+	_sniffMu.Unlock()
+}
+
+func currentSniffing() *sniff.Config {
+	_sniffMu.RLock()
+	defer _sniffMu.RUnlock()
+	if _sniffing == nil || !_sniffing.Enable {
+		return nil
+	}
+	return _sniffing
+}
+
+func sniffTimeout(c *sniff.Config) time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultSniffTimeout
+}
+
+// sniffStream peeks the first bytes of conn, it returns the domain found
+// and a net.Conn which replays the peeked bytes.
+func sniffStream(conn net.Conn, c *sniff.Config) (string, net.Conn) {
+	buf := make([]byte, sniffBufferSize)
+	n := 0
+	host := ""
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout(c)))
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			break
+		}
+		var serr error
+		if host, serr = sniff.Stream(buf[:n]); serr != sniff.ErrIncomplete {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+	return host, &peekedConn{Conn: conn, peeked: buf[:n]}
+}
+
+// sniffPacket peeks the first datagram of pc, it returns the domain found
+// and a net.PacketConn which replays the peeked datagram.
+func sniffPacket(pc net.PacketConn, c *sniff.Config) (string, net.PacketConn) {
+	buf := make([]byte, sniffBufferSize)
+	pc.SetReadDeadline(time.Now().Add(sniffTimeout(c)))
+	n, addr, err := pc.ReadFrom(buf)
+	pc.SetReadDeadline(time.Time{})
+	if err != nil {
+		return "", pc
+	}
+	host, _ := sniff.Packet(buf[:n])
+	return host, &peekedPacketConn{PacketConn: pc, peeked: buf[:n], addr: addr}
+}
+
+// resolveDestination sets the domain of the flow from the sniffed host or the fake ip mapping,
+// it returns the host the outbound should dial, or "" to dial metadata.DstIP.
+func resolveDestination(metadata *M.Metadata, flow *statistic.Flow, p proxy.Proxy, sniffed string, override bool) (string, error) {
+	var fakeHost string
+	var isFake bool
+	if r := currentResolver(); r != nil {
+		fakeHost, isFake = r.FakeIPHost(metadata.DstIP)
+	}
+	if sniffed != "" {
+		flow.Host = sniffed
+	} else if isFake {
+		flow.Host = fakeHost
+	}
+	if (isFake || (override && sniffed != "")) && outbound.CanDialHost(p) {
+		return flow.Host, nil
+	}
+	if isFake {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+		defer cancel()
+		ip, err := currentResolver().LookupIP(ctx, fakeHost)
+		if err != nil {
+			return "", err
+		}
+		metadata.DstIP = ip
+	}
+	return "", nil
+}
+
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *peekedConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+type peekedPacketConn struct {
+	net.PacketConn
+	peeked []byte
+	addr   net.Addr
+}
+
+func (pc *peekedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if pc.peeked != nil {
+		n := copy(b, pc.peeked)
+		pc.peeked = nil
+		return n, pc.addr, nil
+	}
+	return pc.PacketConn.ReadFrom(b)
+}
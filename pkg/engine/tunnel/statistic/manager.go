@@ -0,0 +1,106 @@
+package statistic
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+var DefaultManager = NewManager()
+
+var ErrNotFound = errors.New("connection not found")
+
+// Manager keeps track of every open flow leaving through the engine.
+type Manager struct {
+	connections   sync.Map
+	uploadTotal   *atomic.Int64
+	downloadTotal *atomic.Int64
+
+	mutex    sync.RWMutex
+	recorder func(*TrackerInfo)
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		uploadTotal:   atomic.NewInt64(0),
+		downloadTotal: atomic.NewInt64(0),
+	}
+}
+
+// SetRecorder sets the function called with the final state of every closed flow.
+func (m *Manager) SetRecorder(f func(*TrackerInfo)) {
+	m.mutex.Lock()
+	m.recorder = f
+	m.mutex.Unlock()
+}
+
+func (m *Manager) Join(c Tracker) {
+	m.connections.Store(c.ID(), c)
+}
+
+func (m *Manager) Leave(c Tracker) {
+	if _, loaded := m.connections.LoadAndDelete(c.ID()); !loaded {
+		return
+	}
+	m.mutex.RLock()
+	recorder := m.recorder
+	m.mutex.RUnlock()
+	if recorder != nil {
+		info := c.Info()
+		info.End = time.Now()
+		recorder(info)
+	}
+}
+
+func (m *Manager) PushUploaded(size int64) {
+	m.uploadTotal.Add(size)
+}
+
+func (m *Manager) PushDownloaded(size int64) {
+	m.downloadTotal.Add(size)
+}
+
+// Get returns the open flow with the given id.
+func (m *Manager) Get(id string) (Tracker, bool) {
+	v, ok := m.connections.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(Tracker), true
+}
+
+// Close closes the open flow with the given id, recording reason as its close reason.
+func (m *Manager) Close(id string, reason string) error {
+	t, ok := m.Get(id)
+	if !ok {
+		return ErrNotFound
+	}
+	t.Info().SetCloseReason(reason)
+	return t.Close()
+}
+
+func (m *Manager) Snapshot() *Snapshot {
+	var connections []*TrackerInfo
+	m.connections.Range(func(key, value any) bool {
+		connections = append(connections, value.(Tracker).Info())
+		return true
+	})
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Start.Before(connections[j].Start)
+	})
+
+	return &Snapshot{
+		UploadTotal:   m.uploadTotal.Load(),
+		DownloadTotal: m.downloadTotal.Load(),
+		Connections:   connections,
+	}
+}
+
+type Snapshot struct {
+	DownloadTotal int64          `json:"downloadTotal"`
+	UploadTotal   int64          `json:"uploadTotal"`
+	Connections   []*TrackerInfo `json:"connections"`
+}
@@ -0,0 +1,42 @@
+package statistic
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+func TestManager_Close(t *testing.T) {
+	m := NewManager()
+	var recorded []*TrackerInfo
+	m.SetRecorder(func(info *TrackerInfo) {
+		recorded = append(recorded, info)
+	})
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	metadata := &M.Metadata{Network: M.TCP, DstIP: net.IPv4(1, 1, 1, 1), DstPort: 443}
+	conn := NewTCPTracker(c1, metadata, Flow{User: "alice", Client: "127.0.0.1:1234", Outbound: "direct://"}, m)
+	id := conn.(Tracker).ID()
+
+	go c2.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err := conn.Read(buf)
+	assert.NoError(t, err)
+
+	snapshot := m.Snapshot()
+	assert.Len(t, snapshot.Connections, 1)
+	assert.Equal(t, int64(5), snapshot.DownloadTotal)
+
+	assert.NoError(t, m.Close(id, CloseReasonAdmin))
+	assert.Equal(t, ErrNotFound, m.Close(id, CloseReasonAdmin))
+	conn.Close()
+
+	assert.Len(t, m.Snapshot().Connections, 0)
+	assert.Len(t, recorded, 1)
+	assert.Equal(t, "alice", recorded[0].User)
+	assert.Equal(t, CloseReasonAdmin, recorded[0].CloseReason())
+	assert.Equal(t, int64(5), recorded[0].DownloadTotal.Load())
+}
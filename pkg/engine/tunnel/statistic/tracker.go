@@ -0,0 +1,203 @@
+package statistic
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/atomic"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+const (
+	CloseReasonEOF   = "eof"
+	CloseReasonAdmin = "closed by admin"
+)
+
+type Tracker interface {
+	ID() string
+	Info() *TrackerInfo
+	Close() error
+}
+
+// Flow describes who a tracked connection belongs to and how it leaves the engine.
+type Flow struct {
+	User     string `json:"user"`
+	Group    string `json:"group"`
+	Client   string `json:"client"`
+	Host     string `json:"host"`
+	Outbound string `json:"outbound"`
+}
+
+type TrackerInfo struct {
+	Flow
+	UUID          uuid.UUID     `json:"id"`
+	Start         time.Time     `json:"start"`
+	End           time.Time     `json:"-"`
+	Metadata      *M.Metadata   `json:"metadata"`
+	UploadTotal   *atomic.Int64 `json:"upload"`
+	DownloadTotal *atomic.Int64 `json:"download"`
+
+	mutex       sync.Mutex
+	closeReason string
+}
+
+func newTrackerInfo(metadata *M.Metadata, flow Flow) *TrackerInfo {
+	id, _ := uuid.NewRandom()
+	return &TrackerInfo{
+		Flow:          flow,
+		UUID:          id,
+		Start:         time.Now(),
+		Metadata:      metadata,
+		UploadTotal:   atomic.NewInt64(0),
+		DownloadTotal: atomic.NewInt64(0),
+	}
+}
+
+// SetCloseReason records why the flow was closed, the first reason wins.
+func (t *TrackerInfo) SetCloseReason(reason string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closeReason == "" {
+		t.closeReason = reason
+	}
+}
+
+// CloseReason returns the recorded close reason, defaulting to CloseReasonEOF.
+func (t *TrackerInfo) CloseReason() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closeReason == "" {
+		return CloseReasonEOF
+	}
+	return t.closeReason
+}
+
+// Duration returns how long the flow was open.
+func (t *TrackerInfo) Duration() time.Duration {
+	if t.End.IsZero() {
+		return time.Since(t.Start)
+	}
+	return t.End.Sub(t.Start)
+}
+
+type tcpTracker struct {
+	net.Conn `json:"-"`
+
+	*TrackerInfo
+	manager *Manager
+}
+
+func NewTCPTracker(conn net.Conn, metadata *M.Metadata, flow Flow, manager *Manager) net.Conn {
+	tt := &tcpTracker{
+		Conn:        conn,
+		manager:     manager,
+		TrackerInfo: newTrackerInfo(metadata, flow),
+	}
+
+	manager.Join(tt)
+	return tt
+}
+
+// DefaultTCPTracker returns a new net.Conn(*tcpTracker) with default manager.
+func DefaultTCPTracker(conn net.Conn, metadata *M.Metadata, flow Flow) net.Conn {
+	return NewTCPTracker(conn, metadata, flow, DefaultManager)
+}
+
+func (tt *tcpTracker) ID() string {
+	return tt.UUID.String()
+}
+
+func (tt *tcpTracker) Info() *TrackerInfo {
+	return tt.TrackerInfo
+}
+
+func (tt *tcpTracker) Read(b []byte) (int, error) {
+	n, err := tt.Conn.Read(b)
+	download := int64(n)
+	tt.manager.PushDownloaded(download)
+	tt.DownloadTotal.Add(download)
+	return n, err
+}
+
+func (tt *tcpTracker) Write(b []byte) (int, error) {
+	n, err := tt.Conn.Write(b)
+	upload := int64(n)
+	tt.manager.PushUploaded(upload)
+	tt.UploadTotal.Add(upload)
+	return n, err
+}
+
+func (tt *tcpTracker) Close() error {
+	tt.manager.Leave(tt)
+	return tt.Conn.Close()
+}
+
+func (tt *tcpTracker) CloseRead() error {
+	if cr, ok := tt.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return errors.New("CloseRead is not implemented")
+}
+
+func (tt *tcpTracker) CloseWrite() error {
+	if cw, ok := tt.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite is not implemented")
+}
+
+type udpTracker struct {
+	net.PacketConn `json:"-"`
+
+	*TrackerInfo
+	manager *Manager
+}
+
+func NewUDPTracker(conn net.PacketConn, metadata *M.Metadata, flow Flow, manager *Manager) net.PacketConn {
+	ut := &udpTracker{
+		PacketConn:  conn,
+		manager:     manager,
+		TrackerInfo: newTrackerInfo(metadata, flow),
+	}
+
+	manager.Join(ut)
+	return ut
+}
+
+// DefaultUDPTracker returns a new net.PacketConn(*udpTracker) with default manager.
+func DefaultUDPTracker(conn net.PacketConn, metadata *M.Metadata, flow Flow) net.PacketConn {
+	return NewUDPTracker(conn, metadata, flow, DefaultManager)
+}
+
+func (ut *udpTracker) ID() string {
+	return ut.UUID.String()
+}
+
+func (ut *udpTracker) Info() *TrackerInfo {
+	return ut.TrackerInfo
+}
+
+func (ut *udpTracker) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := ut.PacketConn.ReadFrom(b)
+	download := int64(n)
+	ut.manager.PushDownloaded(download)
+	ut.DownloadTotal.Add(download)
+	return n, addr, err
+}
+
+func (ut *udpTracker) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := ut.PacketConn.WriteTo(b, addr)
+	upload := int64(n)
+	ut.manager.PushUploaded(upload)
+	ut.UploadTotal.Add(upload)
+	return n, err
+}
+
+func (ut *udpTracker) Close() error {
+	ut.manager.Leave(ut)
+	return ut.PacketConn.Close()
+}
@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/common/pool"
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"gofly/pkg/engine/outbound"
+	"gofly/pkg/engine/tunnel/statistic"
+)
+
+const (
+	// tcpConnectTimeout is the timeout of dialing the outbound.
+	tcpConnectTimeout = 5 * time.Second
+
+	// tcpWaitTimeout implements a TCP half-close timeout.
+	tcpWaitTimeout = 60 * time.Second
+)
+
+func handleTCPConn(originConn adapter.TCPConn) {
+	defer originConn.Close()
+
+	id := originConn.ID()
+	metadata := &M.Metadata{
+		Network: M.TCP,
+		SrcIP:   net.IP(id.RemoteAddress.AsSlice()),
+		SrcPort: id.RemotePort,
+		DstIP:   net.IP(id.LocalAddress.AsSlice()),
+		DstPort: id.LocalPort,
+	}
+
+	if r := currentResolver(); isResolverAddr(r, metadata) {
+		serveDNSStream(originConn, r)
+		return
+	}
+
+	p := currentProxy()
+	if p == nil {
+		log.Warnf("[TCP] dial %s: no outbound", metadata.DestinationAddress())
+		return
+	}
+	var conn net.Conn = originConn
+	var sniffed string
+	var override bool
+	if c := currentSniffing(); c != nil {
+		sniffed, conn = sniffStream(originConn, c)
+		override = c.OverrideDestination
+	}
+	flow := newFlow(metadata, p)
+	host, err := resolveDestination(metadata, &flow, p, sniffed, override)
+	if err != nil {
+		log.Warnf("[TCP] resolve %s: %v", metadata.DestinationAddress(), err)
+		return
+	}
+	if !allowFlow(metadata, &flow) {
+		log.Infof("[TCP] %s -> %s denied by acl", metadata.SourceAddress(), metadata.DestinationAddress())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tcpConnectTimeout)
+	if host != "" {
+		ctx = outbound.WithHost(ctx, host)
+	}
+	remoteConn, err := p.DialContext(ctx, metadata)
+	cancel()
+	if err != nil {
+		log.Warnf("[TCP] dial %s: %v", metadata.DestinationAddress(), err)
+		return
+	}
+	metadata.MidIP, metadata.MidPort = parseAddr(remoteConn.LocalAddr())
+
+	remoteConn = statistic.DefaultTCPTracker(remoteConn, metadata, flow)
+	defer remoteConn.Close()
+
+	log.Infof("[TCP] %s <-> %s", metadata.SourceAddress(), metadata.DestinationAddress())
+	pipe(conn, remoteConn, remoteConn.(statistic.Tracker).Info())
+}
+
+// pipe copies copy data to & from provided net.Conn(s) bidirectionally.
+func pipe(origin, remote net.Conn, info *statistic.TrackerInfo) {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go unidirectionalStream(remote, origin, "origin->remote", info, &wg)
+	go unidirectionalStream(origin, remote, "remote->origin", info, &wg)
+
+	wg.Wait()
+}
+
+func unidirectionalStream(dst, src net.Conn, dir string, info *statistic.TrackerInfo, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := pool.Get(pool.RelayBufferSize)
+	if _, err := io.CopyBuffer(dst, src, buf); err != nil {
+		log.Debugf("[TCP] copy data for %s: %v", dir, err)
+		info.SetCloseReason(dir + ": " + err.Error())
+	}
+	pool.Put(buf)
+	// Do the upload/download side TCP half-close.
+	if cr, ok := src.(interface{ CloseRead() error }); ok {
+		cr.CloseRead()
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	// Set TCP half-close timeout.
+	dst.SetReadDeadline(time.Now().Add(tcpWaitTimeout))
+}
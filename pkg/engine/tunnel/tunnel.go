@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"gofly/pkg/engine/outbound"
+	"gofly/pkg/engine/tunnel/statistic"
+	"gofly/pkg/session"
+)
+
+// Unbuffered TCP/UDP queues.
+var (
+	_tcpQueue = make(chan adapter.TCPConn)
+	_udpQueue = make(chan adapter.UDPConn)
+)
+
+var (
+	_proxyMu sync.RWMutex
+
+	// _proxy is the outbound used by the tunnel.
+	_proxy proxy.Proxy
+)
+
+func init() {
+	go process()
+}
+
+// TCPIn return fan-in TCP queue.
+func TCPIn() chan<- adapter.TCPConn {
+	return _tcpQueue
+}
+
+// UDPIn return fan-in UDP queue.
+func UDPIn() chan<- adapter.UDPConn {
+	return _udpQueue
+}
+
+// SetProxy sets the outbound used for new flows.
+func SetProxy(p proxy.Proxy) {
+	_proxyMu.Lock()
+	_proxy = p
+	_proxyMu.Unlock()
+}
+
+// Outbound returns the outbound used for new flows.
+func Outbound() proxy.Proxy {
+	return currentProxy()
+}
+
+func currentProxy() proxy.Proxy {
+	_proxyMu.RLock()
+	defer _proxyMu.RUnlock()
+	return _proxy
+}
+
+// outboundName returns a printable name of the outbound p.
+func outboundName(p proxy.Proxy) string {
+	if p == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s", outbound.Scheme(p), p.Addr())
+}
+
+// newFlow returns the flow of metadata, with the session owning its source and the outbound p.
+func newFlow(metadata *M.Metadata, p proxy.Proxy) statistic.Flow {
+	flow := statistic.Flow{Outbound: outboundName(p)}
+	if s := session.Lookup(metadata.SrcIP); s != nil {
+		flow.User, flow.Group, flow.Client = s.User, s.Group, s.Client()
+	}
+	return flow
+}
+
+func process() {
+	for {
+		select {
+		case conn := <-_tcpQueue:
+			go handleTCPConn(conn)
+		case conn := <-_udpQueue:
+			go handleUDPConn(conn)
+		}
+	}
+}
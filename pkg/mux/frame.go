@@ -0,0 +1,64 @@
+// Package mux frames several tunnels, the streams, over one websocket, and one stream over
+// several websockets bonded for throughput.
+//
+// Every message is a frame made of the type byte, the big endian id of the stream on the
+// connection and the payload. A stream is opened by the client with Open, or joined from
+// another connection with Join and the token the server answered in Opened.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The types of the frames.
+const (
+	TypeOpen   byte = 1 // opens a stream, the payload is the key of its user, the user of the connection when empty
+	TypeOpened byte = 2 // accepts Open or Join, the payload is the token joining other connections to the stream
+	TypeData   byte = 3 // a packet of the stream
+	TypeWindow byte = 4 // the payload is the big endian uint32 of bytes the peer may send in addition
+	TypeClose  byte = 5 // closes the stream on the connection, the payload is the reason
+	TypeJoin   byte = 6 // adds the connection to the stream of the token in the payload
+)
+
+// HeaderSize is the size of the frame before its payload.
+const HeaderSize = 5
+
+var ErrShortFrame = errors.New("mux: short frame")
+
+// Frame is a message of a mux connection.
+type Frame struct {
+	Type    byte
+	Stream  uint32
+	Payload []byte
+}
+
+// Append appends the encoded frame to b.
+func (f *Frame) Append(b []byte) []byte {
+	b = append(b, f.Type, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], f.Stream)
+	return append(b, f.Payload...)
+}
+
+// Parse decodes the frame of a message, the payload is a slice of b.
+func Parse(b []byte) (Frame, error) {
+	if len(b) < HeaderSize {
+		return Frame{}, ErrShortFrame
+	}
+	return Frame{Type: b[0], Stream: binary.BigEndian.Uint32(b[1:HeaderSize]), Payload: b[HeaderSize:]}, nil
+}
+
+// WindowFrame returns the Window frame granting n bytes on the stream.
+func WindowFrame(stream uint32, n uint32) *Frame {
+	p := make([]byte, 4)
+	binary.BigEndian.PutUint32(p, n)
+	return &Frame{Type: TypeWindow, Stream: stream, Payload: p}
+}
+
+// WindowSize returns the bytes granted by a Window frame.
+func WindowSize(f *Frame) (uint32, error) {
+	if len(f.Payload) != 4 {
+		return 0, ErrShortFrame
+	}
+	return binary.BigEndian.Uint32(f.Payload), nil
+}
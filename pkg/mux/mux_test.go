@@ -0,0 +1,35 @@
+package mux
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrame(t *testing.T) {
+	f := &Frame{Type: TypeData, Stream: 0x01020304, Payload: []byte("packet")}
+	b := f.Append(nil)
+	assert.Equal(t, []byte{TypeData, 1, 2, 3, 4, 'p', 'a', 'c', 'k', 'e', 't'}, b)
+	parsed, err := Parse(b)
+	assert.NoError(t, err)
+	assert.Equal(t, *f, parsed)
+	_, err = Parse(b[:4])
+	assert.ErrorIs(t, err, ErrShortFrame)
+
+	n, err := WindowSize(WindowFrame(1, 4096))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4096), n)
+}
+
+func TestWindow(t *testing.T) {
+	w := NewWindow()
+	assert.True(t, w.Take(InitialWindow-1))
+	assert.False(t, w.Take(2))
+	w.Grant(1)
+	assert.True(t, w.Take(2))
+	assert.False(t, w.Take(1))
+
+	assert.Equal(t, uint32(0), w.Consume(InitialWindow/2-1))
+	assert.Equal(t, uint32(InitialWindow/2+9), w.Consume(10))
+	assert.Equal(t, uint32(0), w.Consume(10))
+}
@@ -0,0 +1,51 @@
+package mux
+
+import "sync/atomic"
+
+// InitialWindow is the bytes of Data payloads a side may send on a new stream before
+// the peer grants more.
+const InitialWindow = 1 << 20
+
+// Window is the flow control of a stream. The packets exceeding the send window are dropped
+// rather than queued, they are ip packets which the tunneled protocols retransmit.
+type Window struct {
+	send     atomic.Int64
+	consumed atomic.Int64
+}
+
+func NewWindow() *Window {
+	w := &Window{}
+	w.send.Store(InitialWindow)
+	return w
+}
+
+// Take reserves n bytes of the send window, it returns false when the peer did not grant them.
+func (w *Window) Take(n int) bool {
+	for {
+		cur := w.send.Load()
+		if cur < int64(n) {
+			return false
+		}
+		if w.send.CompareAndSwap(cur, cur-int64(n)) {
+			return true
+		}
+	}
+}
+
+// Grant adds the bytes of a Window frame to the send window.
+func (w *Window) Grant(n uint32) {
+	w.send.Add(int64(n))
+}
+
+// Consume counts n received bytes, it returns the bytes to grant to the peer once half of
+// the initial window was received, 0 before.
+func (w *Window) Consume(n int) uint32 {
+	consumed := w.consumed.Add(int64(n))
+	if consumed < InitialWindow/2 {
+		return 0
+	}
+	if !w.consumed.CompareAndSwap(consumed, 0) {
+		return 0
+	}
+	return uint32(consumed)
+}
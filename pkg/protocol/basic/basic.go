@@ -4,10 +4,18 @@ import (
 	"context"
 	"github.com/klauspost/compress/snappy"
 	"github.com/patrickmn/go-cache"
+	"gofly/pkg/acl"
+	"gofly/pkg/audit"
+	"gofly/pkg/ban"
 	"gofly/pkg/cipher"
 	"gofly/pkg/config"
+	"gofly/pkg/connlimit"
 	"gofly/pkg/logger"
+	"gofly/pkg/quota"
+	"gofly/pkg/ratelimit"
+	"gofly/pkg/session"
 	"gofly/pkg/statistics"
+	"gofly/pkg/webhook"
 	"gofly/pkg/x/xcrypto"
 	"gofly/pkg/x/xproto"
 	"time"
@@ -36,11 +44,30 @@ type Server struct {
 	Statistics      *statistics.Statistics
 	xp              *xcrypto.XCrypto
 	authKey         *xproto.AuthKey
+	users           map[string]*config.UserConfig
+	userAuthKeys    map[xproto.AuthKey]*config.UserConfig
+	certUsers       map[string]*config.UserConfig // the users by the identity of their client certificate
 }
 
+// anonymous is the user authenticated by the shared VTunSettings.Key.
+var anonymous = &config.UserConfig{}
+
 func (x *Server) Init() {
 	cipher.SetKey(x.Config.VTunSettings.Key)
 	x.authKey = xproto.ParseAuthKeyFromString(x.Config.VTunSettings.Key)
+	x.users = make(map[string]*config.UserConfig, len(x.Config.Users))
+	x.userAuthKeys = make(map[xproto.AuthKey]*config.UserConfig, len(x.Config.Users))
+	x.certUsers = make(map[string]*config.UserConfig, len(x.Config.Users))
+	for i := range x.Config.Users {
+		u := &x.Config.Users[i]
+		x.users[u.Key] = u
+		x.userAuthKeys[*xproto.ParseAuthKeyFromString(u.Key)] = u
+		if id := u.Certificate; id != "" {
+			x.certUsers[id] = u
+		} else if u.Name != "" {
+			x.certUsers[u.Name] = u
+		}
+	}
 	x.xp = &xcrypto.XCrypto{}
 	err := x.xp.Init(x.Config.VTunSettings.Key)
 	if err != nil {
@@ -57,18 +84,28 @@ func (x *Server) ConvertSrcAddr(packet []byte) {
 }
 
 func (x *Server) BasicEncode(b []byte) ([]byte, error) {
+	return x.Encode(b, x.Config.VTunSettings.Compress)
+}
+
+func (x *Server) BasicDecode(b []byte) ([]byte, error) {
+	return x.Decode(b, x.Config.VTunSettings.Compress)
+}
+
+// Encode is BasicEncode with the snappy compression negotiated by the client.
+func (x *Server) Encode(b []byte, compress bool) ([]byte, error) {
 	if x.Config.VTunSettings.Obfs {
 		b = cipher.XOR(b)
 	}
-	if x.Config.VTunSettings.Compress {
+	if compress {
 		b = snappy.Encode(nil, b)
 	}
 	return b, nil
 }
 
-func (x *Server) BasicDecode(b []byte) ([]byte, error) {
+// Decode is BasicDecode with the snappy compression negotiated by the client.
+func (x *Server) Decode(b []byte, compress bool) ([]byte, error) {
 	var err error
-	if x.Config.VTunSettings.Compress {
+	if compress {
 		b, err = snappy.Decode(nil, b)
 		if err != nil {
 			return nil, err
@@ -117,6 +154,178 @@ func (x *Server) AuthKey() *xproto.AuthKey {
 	return x.authKey
 }
 
+// Authenticate returns the user owning key, the shared VTunSettings.Key authenticates an anonymous user.
+// Everyone is allowed when neither a shared key nor users are configured.
+func (x *Server) Authenticate(key string) (*config.UserConfig, bool) {
+	if x.Config.VTunSettings.Key == "" && len(x.users) == 0 {
+		return anonymous, true
+	}
+	if key == "" {
+		return nil, false
+	}
+	if key == x.Config.VTunSettings.Key {
+		return anonymous, true
+	}
+	u, ok := x.users[key]
+	return u, ok
+}
+
+// AuthenticateAuthKey is Authenticate for the AuthKey sent by the reality clients.
+func (x *Server) AuthenticateAuthKey(key *xproto.AuthKey) (*config.UserConfig, bool) {
+	if x.Config.VTunSettings.Key == "" && len(x.users) == 0 {
+		return anonymous, true
+	}
+	if key == nil {
+		return nil, false
+	}
+	if x.Config.VTunSettings.Key != "" && key.Equals(x.authKey) {
+		return anonymous, true
+	}
+	u, ok := x.userAuthKeys[*key]
+	return u, ok
+}
+
+// AuthenticateCertificate returns the user of the first of the identities of a verified
+// client certificate which names a user.
+func (x *Server) AuthenticateCertificate(identities []string) (*config.UserConfig, bool) {
+	for _, id := range identities {
+		if u, ok := x.certUsers[id]; ok {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// FilterPacket evaluates the acl on a packet sent by the client of s. A denied packet
+// must be dropped, and reply, when not nil, must be sent back to the client.
+func (x *Server) FilterPacket(s *session.Session, packet []byte) (allowed bool, reply []byte) {
+	a := acl.Default()
+	if a == nil {
+		return true, nil
+	}
+	user, group := sessionUser(s)
+	r, ok := acl.PacketRequest(packet, user, group)
+	if !ok || a.Evaluate(r) != acl.Deny {
+		return true, nil
+	}
+	if a.Reject() {
+		return false, acl.RejectPacket(packet)
+	}
+	return false, nil
+}
+
+// AllowUp reports whether the rate limits and the quotas let a packet of n bytes sent by
+// the client of s in, a packet which is not allowed must be dropped. An error is returned when
+// the client must be disconnected. The allowed packets are accounted to s.
+func (x *Server) AllowUp(s *session.Session, n int) (bool, error) {
+	user, group := sessionUser(s)
+	if l := ratelimit.Default(); l != nil && !l.AllowUp(user, group, n) {
+		return false, nil
+	}
+	if q := quota.Default(); q != nil {
+		if allowed, err := q.AllowUp(user, group, n); !allowed {
+			return false, err
+		}
+	}
+	x.Statistics.AddRX(s, n)
+	return true, nil
+}
+
+// AllowDown is AllowUp for a packet sent to the client of s.
+func (x *Server) AllowDown(s *session.Session, n int) (bool, error) {
+	user, group := sessionUser(s)
+	if l := ratelimit.Default(); l != nil && !l.AllowDown(user, group, n) {
+		return false, nil
+	}
+	if q := quota.Default(); q != nil {
+		if allowed, err := q.AllowDown(user, group, n); !allowed {
+			return false, err
+		}
+	}
+	x.Statistics.AddTX(s, n)
+	return true, nil
+}
+
+// CheckQuota returns an error when user must not connect as its quota is used up.
+func (x *Server) CheckQuota(user *config.UserConfig) error {
+	if q := quota.Default(); q != nil {
+		return q.Check(user.Name, user.Group)
+	}
+	return nil
+}
+
+func sessionUser(s *session.Session) (user, group string) {
+	if s != nil {
+		user, group = s.User, s.Group
+	}
+	return
+}
+
+// OpenSession records that the client of s is connected, it returns an error when the
+// connection limits refuse s and the client must be disconnected.
+func (x *Server) OpenSession(s *session.Session) error {
+	if err := connlimit.OpenSession(s); err != nil {
+		x.Statistics.AddRejected(err)
+		return err
+	}
+	x.Statistics.Push(s)
+	webhook.Emit(sessionEvent(webhook.ClientConnected, s, nil))
+	return nil
+}
+
+// CloseSession records that the client of s is disconnected, err is the reason.
+func (x *Server) CloseSession(s *session.Session, err error) {
+	x.Statistics.Remove(s)
+	connlimit.CloseSession(s)
+	session.Close(s)
+	webhook.Emit(sessionEvent(webhook.ClientDisconnected, s, err))
+}
+
+// AuthFailed records that the client at the address client was refused.
+func (x *Server) AuthFailed(client string, err error) {
+	webhook.Emit(&webhook.Event{Type: webhook.AuthFailed, Client: client, Detail: err.Error()})
+}
+
+// AuditHandshake writes the handshake e to the audit log, user is nil when the client was
+// not authenticated and err is nil when the handshake succeeded.
+func (x *Server) AuditHandshake(e *audit.Entry, user *config.UserConfig, err error) {
+	e.Type = audit.Handshake
+	e.Protocol = x.Config.VTunSettings.Protocol
+	e.Outcome = audit.Success
+	if user != nil {
+		e.User, e.Group = user.Name, user.Group
+	}
+	if err != nil {
+		e.Outcome = audit.Failure
+		e.Detail = err.Error()
+	}
+	audit.Log(e)
+}
+
+// CountHandshake counts the handshake from remote for the brute-force protection, user is nil
+// when the client did not authenticate.
+func (x *Server) CountHandshake(remote string, user *config.UserConfig, err error) {
+	if err != nil && user == nil {
+		ban.Fail(remote)
+		return
+	}
+	ban.Succeed(remote)
+}
+
+func sessionEvent(typ string, s *session.Session, err error) *webhook.Event {
+	e := &webhook.Event{
+		Type:    typ,
+		User:    s.User,
+		Group:   s.Group,
+		Session: s.ID,
+		Client:  s.Client(),
+	}
+	if err != nil {
+		e.Detail = err.Error()
+	}
+	return e
+}
+
 func GetTimeout() time.Time {
 	return time.Now().Add(time.Second * 9)
 }
@@ -0,0 +1,134 @@
+package basic
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/acl"
+	"gofly/pkg/config"
+	"gofly/pkg/logger"
+	"gofly/pkg/session"
+	"gofly/pkg/x/xproto"
+)
+
+func TestServer_Authenticate(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	x := &Server{Config: &config.Config{}}
+	x.Init()
+	// without a key nor users every client is accepted, over the websockets like over reality.
+	_, ok := x.Authenticate("")
+	assert.True(t, ok)
+	_, ok = x.AuthenticateAuthKey(xproto.ParseAuthKeyFromString("any_key"))
+	assert.True(t, ok)
+
+	x.Config.VTunSettings.Key = "demo_key"
+	x.Config.Users = []config.UserConfig{{Name: "alice", Key: "alice_key"}}
+	x.Init()
+	_, ok = x.Authenticate("")
+	assert.False(t, ok)
+	_, ok = x.AuthenticateAuthKey(xproto.ParseAuthKeyFromString("wrong_key"))
+	assert.False(t, ok)
+	_, ok = x.AuthenticateAuthKey(xproto.ParseAuthKeyFromString("demo_key"))
+	assert.True(t, ok)
+	user, ok := x.AuthenticateAuthKey(xproto.ParseAuthKeyFromString("alice_key"))
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user.Name)
+}
+
+// testPeer records the packets written to it, only may restrict its sources to one address.
+type testPeer struct {
+	Sources
+	only    string
+	written [][]byte
+}
+
+func (p *testPeer) AllowSource(key string) bool {
+	if p.only != "" {
+		return key == p.only
+	}
+	return p.Sources.AllowSource(key)
+}
+
+func (p *testPeer) Session() *session.Session {
+	return nil
+}
+
+func (p *testPeer) WritePacket(b []byte) error {
+	p.written = append(p.written, append([]byte(nil), b...))
+	return nil
+}
+
+func (p *testPeer) CloseWithError(error) {}
+
+// testPacket returns an ip packet from the address src to dst.
+func testPacket(src, dst byte) []byte {
+	packet := make([]byte, 20)
+	packet[0] = 0x45
+	copy(packet[12:], []byte{10, 0, 0, src, 10, 0, 0, dst})
+	return packet
+}
+
+func TestServer_RoutePacket(t *testing.T) {
+	x := &Server{Config: &config.Config{}}
+	x.ConnectionCache = cache.New(time.Minute, time.Minute)
+	var tun [][]byte
+	x.WriteFunc = func(b []byte) int {
+		tun = append(tun, append([]byte(nil), b...))
+		return len(b)
+	}
+	alice, bob := &testPeer{}, &testPeer{}
+	x.RoutePacket(alice, testPacket(2, 3))
+	assert.Equal(t, [][]byte{testPacket(2, 3)}, tun)
+
+	// the clients are learnt from their packets, the packets between them skip the tun device.
+	x.RoutePacket(bob, testPacket(3, 2))
+	assert.Equal(t, [][]byte{testPacket(3, 2)}, alice.written)
+	assert.Len(t, tun, 1)
+
+	x.Config.VTunSettings.ClientIsolation = true
+	x.RoutePacket(bob, testPacket(3, 2))
+	assert.Len(t, alice.written, 1)
+	assert.Len(t, tun, 2)
+}
+
+func TestServer_RoutePacketSources(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	x := &Server{Config: &config.Config{}}
+	x.ConnectionCache = cache.New(time.Minute, time.Minute)
+	var tun [][]byte
+	x.WriteFunc = func(b []byte) int {
+		tun = append(tun, append([]byte(nil), b...))
+		return len(b)
+	}
+	alice, mallory := &testPeer{only: "10.0.0.2"}, &testPeer{only: "10.0.0.4"}
+	x.RoutePacket(alice, testPacket(2, 1))
+	// a client sending from the address of another one neither reaches the tun device nor takes its packets.
+	x.RoutePacket(mallory, testPacket(2, 1))
+	assert.Len(t, tun, 1)
+	peer, _ := x.ConnectionCache.Get("10.0.0.2")
+	assert.Same(t, alice, peer)
+
+	// the packets denied by the acl do not bind their source.
+	a, err := acl.New(&acl.Config{Rules: []acl.Rule{{Action: "deny", CIDR: []string{"10.0.0.9/32"}}}})
+	assert.NoError(t, err)
+	acl.SetDefault(a)
+	defer acl.SetDefault(nil)
+	x.RoutePacket(mallory, testPacket(4, 9))
+	_, ok := x.ConnectionCache.Get("10.0.0.4")
+	assert.False(t, ok)
+	assert.Len(t, tun, 1)
+}
+
+func TestSources_AllowSource(t *testing.T) {
+	var s Sources
+	for i := 0; i < MaxPeerSources; i++ {
+		assert.True(t, s.AllowSource(net.IPv4(10, 1, byte(i>>8), byte(i)).String()))
+	}
+	assert.False(t, s.AllowSource("10.2.0.0"))
+	// the addresses already used stay allowed.
+	assert.True(t, s.AllowSource("10.1.0.0"))
+}
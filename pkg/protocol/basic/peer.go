@@ -0,0 +1,158 @@
+package basic
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gofly/pkg/logger"
+	"gofly/pkg/session"
+	"gofly/pkg/utils"
+)
+
+// The subprotocols name the version of the gofly protocol and the codec of its messages, the
+// clients offering none of them keep the codec of VTunSettings.Compress.
+// The v1 messages are packets, the v2 messages are the frames of package mux.
+const (
+	SubprotocolPlain      = "gofly.v1"         // the packets are sent as they are
+	SubprotocolSnappy     = "gofly.v1.snappy"  // the packets are compressed by snappy
+	SubprotocolDeflate    = "gofly.v1.deflate" // the packets are compressed by permessage-deflate
+	SubprotocolMuxPlain   = "gofly.v2"
+	SubprotocolMuxSnappy  = "gofly.v2.snappy"
+	SubprotocolMuxDeflate = "gofly.v2.deflate"
+)
+
+// StreamSubprotocol returns the v1 subprotocol of the streams first offered by a client, in the
+// order preferred by VTunSettings.Compress. An offer may list several subprotocols separated
+// by commas.
+func (x *Server) StreamSubprotocol(offered []string) (string, bool) {
+	protocols := []string{SubprotocolPlain, SubprotocolSnappy}
+	if x.Config.VTunSettings.Compress {
+		protocols = []string{SubprotocolSnappy, SubprotocolPlain}
+	}
+	if len(offered) == 0 {
+		return protocols[0], true
+	}
+	for _, p := range protocols {
+		for _, v := range offered {
+			for _, o := range strings.Split(v, ",") {
+				if strings.TrimSpace(o) == p {
+					return p, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// MaxPeerSources is the number of virtual addresses a client choosing its own may send from,
+// so that a client sending from random addresses does not grow the caches.
+const MaxPeerSources = 256
+
+// Peer is a client of a server, the ConnectionCache maps the addresses of its packets to it.
+type Peer interface {
+	Session() *session.Session
+	// AllowSource reports whether the client may send the packets from the virtual address key.
+	AllowSource(key string) bool
+	// WritePacket encodes and sends a packet.
+	WritePacket(b []byte) error
+	CloseWithError(err error)
+}
+
+// Sources implements Peer.AllowSource for the clients choosing their own addresses, the
+// first MaxPeerSources addresses a client sends from are allowed.
+type Sources struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func (x *Sources) AllowSource(key string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.keys[key]; ok {
+		return true
+	}
+	if len(x.keys) >= MaxPeerSources {
+		return false
+	}
+	if x.keys == nil {
+		x.keys = make(map[string]struct{})
+	}
+	x.keys[key] = struct{}{}
+	return true
+}
+
+// RoutePacket routes a packet sent by the client of src, to another client or to the tun device.
+// The packets from an address src may not use are dropped, the source of the other ones is
+// bound to src once the acl let them through.
+func (x *Server) RoutePacket(src Peer, data []byte) {
+	key := utils.GetSrcKey(data)
+	if key == "" {
+		return
+	}
+	s := src.Session()
+	if allowed, reply := x.FilterPacket(s, data); !allowed {
+		if reply != nil {
+			if err := src.WritePacket(reply); err != nil {
+				logger.Logger.Sugar().Errorf("try to write message error: %v\n", err)
+			}
+		}
+		return
+	}
+	if !src.AllowSource(key) {
+		logger.Logger.Sugar().Debugf("dropped a packet from %s, not an address of the client", key)
+		return
+	}
+	x.ConnectionCache.Set(key, src, 24*time.Hour)
+	if s != nil {
+		session.Bind(key, s)
+	}
+	if dstKey := utils.GetDstKey(data); dstKey != "" {
+		if dst, ok := x.ConnectionCache.Get(dstKey); ok && !x.Config.VTunSettings.ClientIsolation {
+			if err := x.Send(dst.(Peer), data); err != nil {
+				logger.Logger.Sugar().Errorf("try to write message error: %v\n", err)
+			}
+		} else {
+			x.ConvertSrcAddr(data)
+			x.WriteFunc(data)
+		}
+	}
+}
+
+// Send sends a packet to the client of p within the down rate and quota of its session.
+func (x *Server) Send(p Peer, b []byte) error {
+	if allowed, err := x.AllowDown(p.Session(), len(b)); !allowed {
+		if err != nil {
+			p.CloseWithError(err)
+		}
+		return err
+	}
+	return p.WritePacket(b)
+}
+
+// ToClients sends the packets of the tun device to their clients until CTX is done or the tun
+// device fails.
+func (x *Server) ToClients() {
+	buffer := make([]byte, x.Config.VTunSettings.BufferSize)
+	for ContextOpened(x.CTX) {
+		n, err := x.ReadFunc(buffer)
+		if err != nil {
+			logger.Logger.Error("getData Error", zap.Error(err))
+			break
+		}
+		if n == 0 {
+			continue
+		}
+		b := buffer[:n]
+		x.ConvertDstAddr(b)
+		if key := utils.GetDstKey(b); key != "" {
+			if v, ok := x.ConnectionCache.Get(key); ok {
+				if err = x.Send(v.(Peer), b); err != nil {
+					logger.Logger.Error("write data error", zap.Error(err))
+					x.ConnectionCache.Delete(key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package grpc
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// AuthFieldKey is the metadata carrying the key of the client.
+	AuthFieldKey = "key"
+	// ProtocolKey is the metadata of the codec, the client sends the subprotocols it supports and
+	// the server answers the chosen one in the header of the stream.
+	ProtocolKey = "gofly-protocol"
+	// StreamName is the bidirectional streaming method of the service.
+	StreamName = "Stream"
+)
+
+// Packet is the message of the stream:
+//
+//	message Packet {
+//	  bytes data = 1;
+//	}
+type Packet struct {
+	Data []byte
+}
+
+// codec marshals the packets without generated code, the proto name keeps the content type
+// application/grpc expected by the proxies.
+type codec struct{}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	p, ok := v.(*Packet)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message %T", v)
+	}
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, p.Data), nil
+}
+
+func (codec) Unmarshal(b []byte, v any) error {
+	p, ok := v.(*Packet)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", v)
+	}
+	p.Data = nil
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == 1 && typ == protowire.BytesType {
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			p.Data = data
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	if p.Data == nil {
+		return errors.New("empty packet")
+	}
+	return nil
+}
+
+// serviceDesc describes the service named name, its only method streams the packets both ways.
+func serviceDesc(name string, handler grpc.StreamHandler) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: name,
+		HandlerType: (*any)(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    StreamName,
+			Handler:       handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+	}
+}
@@ -0,0 +1,260 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+	"gofly/pkg/audit"
+	"gofly/pkg/ban"
+	"gofly/pkg/certwatch"
+	"gofly/pkg/config"
+	"gofly/pkg/connlimit"
+	"gofly/pkg/logger"
+	"gofly/pkg/protocol/basic"
+	"gofly/pkg/realip"
+	"gofly/pkg/session"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// Server streams the packets over grpc, over tls for grpcs or cleartext http/2 for grpc behind
+// a proxy terminating tls.
+type Server struct {
+	basic.Server
+}
+
+// client is a stream carrying the packets of one session.
+type client struct {
+	basic.Sources
+	x        *Server
+	s        *session.Session
+	stream   grpc.ServerStream
+	compress bool
+	cancel   context.CancelCauseFunc
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *client) Session() *session.Session {
+	return c.s
+}
+
+func (c *client) WritePacket(b []byte) error {
+	b, err := c.x.Encode(b, c.compress)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errStreamClosed
+	}
+	return c.stream.SendMsg(&Packet{Data: b})
+}
+
+func (c *client) CloseWithError(err error) {
+	c.cancel(err)
+}
+
+// newServer returns the grpc server of the service, with the credentials of watcher if any.
+func (x *Server) newServer(watcher *certwatch.Watcher) *grpc.Server {
+	params := keepalive.ServerParameters{Time: 30 * time.Second}
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(codec{}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 10 * time.Second, PermitWithoutStream: true}),
+	}
+	if timeout := time.Second * time.Duration(x.Config.VTunSettings.Timeout); timeout > 0 {
+		params.Timeout = timeout
+		opts = append(opts, grpc.ConnectionTimeout(timeout))
+	}
+	opts = append(opts, grpc.KeepaliveParams(params))
+	if watcher != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{GetCertificate: watcher.GetStdCertificate})))
+	}
+	svr := grpc.NewServer(opts...)
+	svr.RegisterService(serviceDesc(x.Config.GRPCSettings.ServiceName, x.onStream), nil)
+	return svr
+}
+
+// StartServerForApi starts the grpc server
+func (x *Server) StartServerForApi() {
+	x.ConnectionCache = cache.New(15*time.Minute, 24*time.Hour)
+	var watcher *certwatch.Watcher
+	if x.Config.VTunSettings.Protocol == "grpcs" {
+		// the certificate is reloaded when its files change, the open streams are kept.
+		var err error
+		watcher, err = certwatch.New(&certwatch.Config{
+			CertFile:      x.Config.GRPCSettings.TLSCertificateFilePath,
+			KeyFile:       x.Config.GRPCSettings.TLSCertificateKeyFilePath,
+			CheckInterval: x.Config.GRPCSettings.CertificateCheckInterval,
+			WarnBefore:    x.Config.GRPCSettings.CertificateWarnBefore,
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		certwatch.SetDefault(watcher)
+		go watcher.Run(x.CTX)
+	}
+	l, err := net.Listen("tcp", x.Config.VTunSettings.LocalAddr)
+	if err != nil {
+		logger.Logger.Sugar().Errorf("listen failed: %v", zap.Error(err))
+		return
+	}
+	svr := x.newServer(watcher)
+	// server -> client
+	go x.ToClients()
+	// client -> server
+	go func() {
+		if err := svr.Serve(connlimit.NewListener(ban.NewListener(realip.NewListener(l)), x.Statistics.AddRejected)); err != nil {
+			logger.Logger.Sugar().Errorf("serve failed: %v", zap.Error(err))
+		}
+	}()
+	logger.Logger.Sugar().Infof("gofly %s server started on %v, service %s", x.Config.VTunSettings.Protocol, x.Config.VTunSettings.LocalAddr, x.Config.GRPCSettings.ServiceName)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	select {
+	case <-interrupt:
+	case <-x.CTX.Done():
+	}
+	svr.Stop()
+}
+
+// remoteAddr returns the address of the client of ctx, resolved from the metadata set by a
+// trusted proxy like the headers of the ws requests.
+func remoteAddr(ctx context.Context, md metadata.MD) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	header := http.Header{}
+	for k, v := range md {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	return realip.ClientAddr(&http.Request{RemoteAddr: p.Addr.String(), Header: header})
+}
+
+// checkPermission returns the user of the key in md whose quota is not used up, every attempt
+// is written to the audit log.
+func (x *Server) checkPermission(ctx context.Context, md metadata.MD, remote string) (user *config.UserConfig, err error) {
+	defer func() {
+		e := &audit.Entry{Remote: remote}
+		if v := md.Get(":authority"); len(v) > 0 {
+			e.SNI = v[0]
+		}
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && info.State.ServerName != "" {
+				e.SNI = info.State.ServerName
+			}
+		}
+		x.AuditHandshake(e, user, err)
+		x.CountHandshake(remote, user, err)
+	}()
+	var key string
+	if v := md.Get(AuthFieldKey); len(v) > 0 {
+		key = v[0]
+	}
+	user, ok := x.Authenticate(key)
+	if !ok {
+		return nil, errors.New("authentication failed")
+	}
+	if err = x.CheckQuota(user); err != nil {
+		return user, fmt.Errorf("user %s: %w", user.Name, err)
+	}
+	return user, nil
+}
+
+// onStream serves the stream of a client until it ends or its session is kicked.
+func (x *Server) onStream(_ any, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	remote := remoteAddr(ctx, md)
+	if err := ban.Check(remote); err != nil {
+		logger.Logger.Sugar().Debugf("refused %s: %v", remote, err)
+		return status.Error(codes.PermissionDenied, "forbidden")
+	}
+	user, err := x.checkPermission(ctx, md, remote)
+	if err != nil {
+		x.AuthFailed(remote, err)
+		return status.Error(codes.Unauthenticated, "forbidden")
+	}
+	protocol, ok := x.StreamSubprotocol(md.Get(ProtocolKey))
+	if !ok {
+		return status.Error(codes.InvalidArgument, "unsupported protocol")
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	c := &client{x: x, stream: stream, compress: protocol == basic.SubprotocolSnappy, cancel: cancel}
+	addr, _ := net.ResolveTCPAddr("tcp", remote)
+	c.s = session.New(user.Name, user.Group, x.Config.VTunSettings.Protocol, addr)
+	c.s.OnKick(c.CloseWithError)
+	if err = x.OpenSession(c.s); err != nil {
+		logger.Logger.Sugar().Debugf("refused %s: %v", remote, err)
+		return status.Error(codes.PermissionDenied, "forbidden")
+	}
+	c.mu.Lock()
+	err = stream.SendHeader(metadata.Pairs(ProtocolKey, protocol))
+	c.mu.Unlock()
+	if err != nil {
+		x.CloseSession(c.s, err)
+		return err
+	}
+	logger.Logger.Sugar().Debugf("open: %s over grpc", remote)
+
+	go func() { cancel(x.readStream(c)) }()
+	<-ctx.Done()
+	err = context.Cause(ctx)
+	// the stream must not be written once its handler returned.
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	x.CloseSession(c.s, err)
+	logger.Logger.Sugar().Debugf("closed: %s -> %v", remote, zap.Error(err))
+	if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return status.Error(codes.Aborted, err.Error())
+}
+
+// readStream handles the packets of the client of c until its stream fails.
+func (x *Server) readStream(c *client) error {
+	for {
+		var p Packet
+		if err := c.stream.RecvMsg(&p); err != nil {
+			return err
+		}
+		if allowed, err := x.AllowUp(c.s, len(p.Data)); !allowed {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := x.Decode(p.Data, c.compress)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("decode error: %v", zap.Error(err))
+			continue
+		}
+		x.RoutePacket(c, b)
+	}
+}
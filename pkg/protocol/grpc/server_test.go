@@ -0,0 +1,99 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/config"
+	"gofly/pkg/logger"
+	"gofly/pkg/protocol/basic"
+	"gofly/pkg/statistics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCodec(t *testing.T) {
+	b, err := codec{}.Marshal(&Packet{Data: []byte("an ip packet")})
+	assert.NoError(t, err)
+	// an unknown varint field is skipped.
+	b = append([]byte{0x10, 0x01}, b...)
+	var p Packet
+	assert.NoError(t, codec{}.Unmarshal(b, &p))
+	assert.Equal(t, "an ip packet", string(p.Data))
+	assert.Error(t, codec{}.Unmarshal([]byte{0x10, 0x01}, &p))
+	assert.Error(t, codec{}.Unmarshal([]byte{0x0a, 0x05, 0x01}, &p))
+}
+
+func TestServer_Stream(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	x := &Server{}
+	x.Config = &config.Config{Users: []config.UserConfig{{Name: "alice", Key: "alice_key"}}}
+	assert.NoError(t, x.Config.GRPCSettings.Check())
+	x.Init()
+	x.Statistics = statistics.New()
+	x.ConnectionCache = cache.New(time.Minute, time.Minute)
+	received := make(chan []byte, 1)
+	x.WriteFunc = func(b []byte) int {
+		received <- append([]byte(nil), b...)
+		return len(b)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	svr := x.newServer(nil)
+	go svr.Serve(l)
+	defer svr.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	assert.NoError(t, err)
+	defer conn.Close()
+	open := func(key string) (grpc.ClientStream, error) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), AuthFieldKey, key, ProtocolKey, "gofly.v3, "+basic.SubprotocolSnappy)
+		st, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, "/gofly.Tunnel/"+StreamName)
+		if err != nil {
+			return nil, err
+		}
+		_, err = st.Header()
+		return st, err
+	}
+
+	st, err := open("wrong_key")
+	if err == nil {
+		err = st.RecvMsg(&Packet{})
+	}
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	st, err = open("alice_key")
+	assert.NoError(t, err)
+	header, err := st.Header()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{basic.SubprotocolSnappy}, header.Get(ProtocolKey))
+
+	packet := make([]byte, 20)
+	packet[0] = 0x45
+	copy(packet[12:], []byte{10, 0, 0, 2, 10, 0, 0, 1})
+	encoded, err := x.Encode(packet, true)
+	assert.NoError(t, err)
+	assert.NoError(t, st.SendMsg(&Packet{Data: encoded}))
+	assert.Equal(t, packet, <-received)
+
+	v, ok := x.ConnectionCache.Get("10.0.0.2")
+	assert.True(t, ok)
+	assert.NoError(t, x.Send(v.(basic.Peer), packet))
+	var p Packet
+	assert.NoError(t, st.RecvMsg(&p))
+	assert.Equal(t, encoded, p.Data)
+
+	// the stream ends with its session.
+	v.(*client).CloseWithError(context.DeadlineExceeded)
+	assert.Equal(t, codes.Aborted, status.Code(st.RecvMsg(&p)))
+}
@@ -9,13 +9,18 @@ import (
 	"github.com/patrickmn/go-cache"
 	"github.com/xtls/reality"
 	"go.uber.org/zap"
+	"gofly/pkg/audit"
+	"gofly/pkg/ban"
 	"gofly/pkg/cipher"
 	"gofly/pkg/config"
+	"gofly/pkg/connlimit"
 	"gofly/pkg/logger"
 	"gofly/pkg/protocol/basic"
-	"gofly/pkg/utils"
+	"gofly/pkg/realip"
+	"gofly/pkg/session"
 	"gofly/pkg/x/xproto"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -82,6 +87,34 @@ func NewServer(lis net.Listener, config *ServerConfig) (*ServerListener, error)
 
 type Server struct {
 	basic.Server
+	clients sync.Map // net.Conn -> *client
+}
+
+// client is an authenticated connection.
+type client struct {
+	x       *Server
+	conn    net.Conn
+	session *session.Session
+	authKey *xproto.AuthKey
+	// sources are the virtual addresses sent in the handshake, the only ones the client may use.
+	sources [2]string
+}
+
+func (c *client) Session() *session.Session {
+	return c.session
+}
+
+func (c *client) AllowSource(key string) bool {
+	return key == c.sources[0] || key == c.sources[1]
+}
+
+func (c *client) WritePacket(b []byte) error {
+	_, err := c.x.writeToClient(c.conn, b)
+	return err
+}
+
+func (c *client) CloseWithError(err error) {
+	c.x.closeTheClient(c.conn, err)
 }
 
 // StartServerForApi starts the tcp server
@@ -101,14 +134,14 @@ func (x *Server) StartServerForApi() {
 	}
 	defer listener.Close()
 	serverConfig := ServerConfig(x.Config.RealitySettings)
-	server, err := NewServer(listener, &serverConfig)
+	server, err := NewServer(connlimit.NewListener(ban.NewListener(realip.NewListener(listener)), x.Statistics.AddRejected), &serverConfig)
 	if err != nil {
 		panic(err)
 	}
 	defer server.Listener.Close()
 	logger.Logger.Sugar().Infof("gofly %s server started on %v", x.Config.VTunSettings.Protocol, x.Config.VTunSettings.LocalAddr)
 	// server -> client
-	go x.ToClient()
+	go x.ToClients()
 	// client -> server
 	for basic.ContextOpened(x.CTX) {
 		conn, err := server.Listener.Accept()
@@ -116,86 +149,86 @@ func (x *Server) StartServerForApi() {
 			logger.Logger.Sugar().Errorf("accept error, %v\n", err)
 			continue
 		}
-		x.Statistics.Push(conn.RemoteAddr())
 		logger.Logger.Sugar().Debugf("accept connect: %s", conn.RemoteAddr().String())
-		err = x.HandshakeFromClient(conn, x.AuthKey())
+		c, err := x.HandshakeFromClient(conn)
 		if err != nil {
 			x.closeTheClient(conn, errors.New("active shutdown"))
 			logger.Logger.Sugar().Errorf("error, %v\n", err)
 			continue
 		}
-		go x.ToServer(conn)
+		go x.ToServer(conn, c)
 	}
 }
 
-// ToClient sends packets from iFace to conn
-func (x *Server) ToClient() {
-	buffer := make([]byte, x.Config.VTunSettings.BufferSize)
-	var n int
-	var err error
-	var ns int
-	for basic.ContextOpened(x.CTX) {
-		n, err = x.ReadFunc(buffer)
-		if err != nil {
-			logger.Logger.Sugar().Errorf("error, %v\n", err)
-			continue
-		}
-		b := buffer[:n]
-		x.ConvertDstAddr(b)
-		if key := utils.GetDstKey(b); key != "" {
-			if v, ok := x.ConnectionCache.Get(key); ok {
-				x.ConnectionCache.Set(key, v, 15*time.Minute)
-				conn := v.(net.Conn)
-				b, err = x.ExtendEncode(b)
-				if err != nil {
-					logger.Logger.Sugar().Errorf("encode error, %v\n", err)
-					x.closeTheClient(conn, err)
-					continue
-				}
-				ph := &xproto.ServerSendPacketHeader{
-					ProtocolVersion: xproto.ProtocolVersion,
-					Length:          len(b),
-				}
-				ns, err = conn.Write(xproto.Merge(ph.Bytes(), b))
-				if err != nil {
-					logger.Logger.Sugar().Errorf("error, %v\n", err)
-					x.ConnectionCache.Delete(key)
-					x.closeTheClient(conn, err)
-					continue
-				}
-				x.Statistics.IncrTransportBytes(ns)
-				x.Statistics.IncrClientReceivedBytes(conn.RemoteAddr(), ns)
-			} else if v, _, ok := x.ConnectionCache.GetWithExpiration(key); ok {
-				x.closeTheClient(v.(net.Conn), errors.New("active shutdown, cache was expired"))
-				x.ConnectionCache.Delete(key)
-			}
-		}
+// writeToClient encodes a packet and sends it to the client with its header.
+func (x *Server) writeToClient(conn net.Conn, b []byte) (int, error) {
+	b, err := x.ExtendEncode(b)
+	if err != nil {
+		return 0, err
+	}
+	ph := &xproto.ServerSendPacketHeader{
+		ProtocolVersion: xproto.ProtocolVersion,
+		Length:          len(b),
 	}
+	return conn.Write(xproto.Merge(ph.Bytes(), b))
 }
 
-func (x *Server) HandshakeFromClient(conn net.Conn, authKey *xproto.AuthKey) error {
+// HandshakeFromClient authenticates the client of conn, every attempt is written to the audit log.
+func (x *Server) HandshakeFromClient(conn net.Conn) (c *client, err error) {
+	var user *config.UserConfig
+	defer func() {
+		e := &audit.Entry{Remote: conn.RemoteAddr().String()}
+		if rc, ok := conn.(*reality.Conn); ok {
+			e.SNI = rc.ConnectionState().ServerName
+			e.ShortID = hex.EncodeToString(rc.ClientShortId[:])
+		}
+		x.AuditHandshake(e, user, err)
+		x.CountHandshake(e.Remote, user, err)
+	}()
 	handshake := make([]byte, xproto.ClientHandshakePacketLength)
 	n, err := conn.Read(handshake)
 	if err != nil {
-		return fmt.Errorf("error, %v\n", err)
+		return nil, fmt.Errorf("error, %v\n", err)
 	}
 	if n != xproto.ClientHandshakePacketLength {
-		return fmt.Errorf("received handshake length <%d> not equals <%d>!\n", n, xproto.ClientHandshakePacketLength)
+		return nil, fmt.Errorf("received handshake length <%d> not equals <%d>!\n", n, xproto.ClientHandshakePacketLength)
 	}
 	hs := xproto.ParseClientHandshakePacket(handshake[:n])
 	if hs == nil {
-		return fmt.Errorf("hs == nil")
+		return nil, fmt.Errorf("hs == nil")
 	}
-	if !hs.Key.Equals(authKey) {
-		return fmt.Errorf("authentication failed")
+	user, ok := x.AuthenticateAuthKey(hs.Key)
+	if !ok {
+		err = errors.New("authentication failed")
+		x.AuthFailed(conn.RemoteAddr().String(), err)
+		return nil, err
 	}
-	x.ConnectionCache.Set(hs.CIDRv4.String(), conn, 15*time.Minute)
-	x.ConnectionCache.Set(hs.CIDRv6.String(), conn, 15*time.Minute)
-	return nil
+	if err = x.CheckQuota(user); err != nil {
+		err = fmt.Errorf("user %s: %w", user.Name, err)
+		x.AuthFailed(conn.RemoteAddr().String(), err)
+		return nil, err
+	}
+	c = &client{
+		x:       x,
+		conn:    conn,
+		session: session.New(user.Name, user.Group, x.Config.VTunSettings.Protocol, conn.RemoteAddr()),
+		authKey: hs.Key,
+		sources: [2]string{hs.CIDRv4.String(), hs.CIDRv6.String()},
+	}
+	c.session.OnKick(c.CloseWithError)
+	if err = x.OpenSession(c.session); err != nil {
+		return nil, err
+	}
+	for _, key := range c.sources {
+		x.ConnectionCache.Set(key, c, 15*time.Minute)
+		session.Bind(key, c.session)
+	}
+	x.clients.Store(conn, c)
+	return c, nil
 }
 
 // ToServer sends packets from conn to iFace
-func (x *Server) ToServer(conn net.Conn) {
+func (x *Server) ToServer(conn net.Conn, c *client) {
 	defer x.closeTheClient(conn, errors.New("active shutdown"))
 	header := make([]byte, xproto.ClientSendPacketHeaderLength)
 	packet := make([]byte, x.Config.VTunSettings.BufferSize)
@@ -220,7 +253,7 @@ func (x *Server) ToServer(conn net.Conn) {
 			logger.Logger.Sugar().Errorln("ph == nil")
 			break
 		}
-		if !ph.Key.Equals(x.AuthKey()) {
+		if !ph.Key.Equals(c.authKey) {
 			logger.Logger.Sugar().Errorln("authentication failed")
 			break
 		}
@@ -234,33 +267,27 @@ func (x *Server) ToServer(conn net.Conn) {
 			break
 		}
 		total += length
+		if allowed, err := x.AllowUp(c.session, total); !allowed {
+			if err != nil {
+				logger.Logger.Sugar().Errorf("error, %v\n", err)
+				break
+			}
+			continue
+		}
 		b := packet[:length]
 		b, err = x.ExtendDecode(b)
 		if err != nil {
 			logger.Logger.Sugar().Errorf("decode error, %v\n", err)
 			break
 		}
-		if dstKey := utils.GetDstKey(b); dstKey != "" {
-			if v, ok := x.ConnectionCache.Get(dstKey); ok && !x.Config.VTunSettings.ClientIsolation {
-				dstConn := v.(net.Conn)
-				_, err = dstConn.Write(b)
-				if err != nil {
-					logger.Logger.Sugar().Errorf("error, %v\n", err)
-					x.closeTheClient(dstConn, err)
-					continue
-				}
-			} else {
-				x.ConvertSrcAddr(b)
-				x.WriteFunc(b)
-				x.Statistics.IncrReceivedBytes(total)
-				x.Statistics.IncrClientTransportBytes(conn.RemoteAddr(), total)
-			}
-		}
+		x.RoutePacket(c, b)
 	}
 }
 
 func (x *Server) closeTheClient(conn net.Conn, err error) {
-	x.Statistics.Remove(conn.RemoteAddr())
+	if c, ok := x.clients.LoadAndDelete(conn); ok {
+		x.CloseSession(c.(*client).session, err)
+	}
 	defer conn.Close()
 	logger.Logger.Sugar().Debugf("closed: %s -> %v", conn.RemoteAddr().String(), zap.Error(err))
 }
@@ -0,0 +1,74 @@
+package ws
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/lesismal/llib/std/crypto/tls"
+	"github.com/lesismal/nbio/nbhttp"
+	"gofly/pkg/config"
+)
+
+// loadClientCAs returns the pool of the CAs the client certificates must be signed by.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// peerTLS returns the server name requested by the client of r and its verified certificate
+// chains, empty when r was not sent over tls.
+func peerTLS(w http.ResponseWriter, r *http.Request) (string, [][]*x509.Certificate) {
+	if r.TLS != nil {
+		return r.TLS.ServerName, r.TLS.VerifiedChains
+	}
+	res, ok := w.(*nbhttp.Response)
+	if !ok || res.Parser == nil || res.Parser.Processor == nil {
+		return "", nil
+	}
+	if c, ok := res.Parser.Processor.Conn().(*tls.Conn); ok {
+		state := c.ConnectionState()
+		return state.ServerName, state.VerifiedChains
+	}
+	return "", nil
+}
+
+// identities returns the values of the field of cert naming its user.
+func identities(cert *x509.Certificate, field string) []string {
+	switch field {
+	case config.IdentityDNSSAN:
+		return cert.DNSNames
+	case config.IdentityEmailSAN:
+		return cert.EmailAddresses
+	case config.IdentityURISAN:
+		ids := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			ids = append(ids, u.String())
+		}
+		return ids
+	default:
+		return []string{cert.Subject.CommonName}
+	}
+}
+
+// authenticateCertificate returns the user named by the verified client certificate of r.
+func (x *Server) authenticateCertificate(chains [][]*x509.Certificate) (*config.UserConfig, error) {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, errors.New("client certificate required")
+	}
+	ids := identities(chains[0][0], x.Config.WebSocketSettings.ClientAuth.Identity)
+	user, ok := x.AuthenticateCertificate(ids)
+	if !ok {
+		return nil, fmt.Errorf("no user for the client certificate %v", ids)
+	}
+	return user, nil
+}
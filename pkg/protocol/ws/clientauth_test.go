@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/config"
+)
+
+func TestServer_ClientAuth(t *testing.T) {
+	x := &Server{}
+	x.Config = &config.Config{Users: []config.UserConfig{
+		{Name: "alice", Key: "alice_key"},
+		{Name: "bob", Key: "bob_key", Certificate: "laptop-42.corp.example.com"},
+	}}
+	x.Config.VTunSettings.Key = "demo_key"
+	x.Config.WebSocketSettings.ClientAuth = config.ClientAuthConfig{CAFilePath: "ca.pem", Identity: config.IdentityDNSSAN}
+	assert.NoError(t, x.Config.WebSocketSettings.Check())
+	x.Init()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "alice"},
+		DNSNames:     []string{"laptop-42.corp.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	request := func(key string, verified bool) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/?key="+key, nil)
+		r.TLS = &tls.ConnectionState{ServerName: "vpn.example.com"}
+		if verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		return r
+	}
+
+	user, err := x.checkPermission(httptest.NewRecorder(), request("", true))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", user.Name)
+	_, err = x.checkPermission(httptest.NewRecorder(), request("bob_key", false))
+	assert.Error(t, err)
+
+	// the identity is the common name.
+	x.Config.WebSocketSettings.ClientAuth.Identity = config.IdentityCommonName
+	user, err = x.checkPermission(httptest.NewRecorder(), request("", true))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user.Name)
+
+	// the key must belong to the user of the certificate.
+	x.Config.WebSocketSettings.ClientAuth.RequireKey = true
+	_, err = x.checkPermission(httptest.NewRecorder(), request("", true))
+	assert.Error(t, err)
+	_, err = x.checkPermission(httptest.NewRecorder(), request("bob_key", true))
+	assert.Error(t, err)
+	user, err = x.checkPermission(httptest.NewRecorder(), request("alice_key", true))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user.Name)
+}
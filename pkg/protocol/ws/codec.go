@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"strings"
+
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"gofly/pkg/protocol/basic"
+)
+
+// subprotocols returns the subprotocols of the server by preference, the first of them offered by
+// a client is chosen whatever the order of its offer.
+func (x *Server) subprotocols() []string {
+	var protocols []string
+	for _, version := range []string{"gofly.v2", "gofly.v1"} {
+		if x.Config.WebSocketSettings.PerMessageDeflate {
+			protocols = append(protocols, version+".deflate")
+		}
+		if x.Config.VTunSettings.Compress {
+			protocols = append(protocols, version+".snappy", version)
+		} else {
+			protocols = append(protocols, version, version+".snappy")
+		}
+	}
+	return protocols
+}
+
+// compressed reports whether the packets of c are compressed by snappy.
+func (x *Server) compressed(c *websocket.Conn) bool {
+	switch c.Subprotocol() {
+	case "":
+		return x.Config.VTunSettings.Compress
+	case basic.SubprotocolSnappy, basic.SubprotocolMuxSnappy:
+		return true
+	default:
+		return false
+	}
+}
+
+// multiplexed reports whether the messages of c are mux frames.
+func multiplexed(c *websocket.Conn) bool {
+	return strings.HasPrefix(c.Subprotocol(), "gofly.v2")
+}
+
+// encode encodes a packet with the codec negotiated by c.
+func (x *Server) encode(c *websocket.Conn, b []byte) ([]byte, error) {
+	return x.Encode(b, x.compressed(c))
+}
+
+// decode decodes a message with the codec negotiated by c.
+func (x *Server) decode(c *websocket.Conn, b []byte) ([]byte, error) {
+	return x.Decode(b, x.compressed(c))
+}
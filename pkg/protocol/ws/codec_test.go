@@ -0,0 +1,45 @@
+package ws
+
+import (
+	"testing"
+
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/config"
+	"gofly/pkg/protocol/basic"
+)
+
+func TestServer_Subprotocols(t *testing.T) {
+	x := &Server{}
+	x.Config = &config.Config{}
+	assert.Equal(t, []string{basic.SubprotocolMuxPlain, basic.SubprotocolMuxSnappy, basic.SubprotocolPlain, basic.SubprotocolSnappy}, x.subprotocols())
+	x.Config.VTunSettings.Compress = true
+	x.Config.WebSocketSettings.PerMessageDeflate = true
+	assert.Equal(t, []string{
+		basic.SubprotocolMuxDeflate, basic.SubprotocolMuxSnappy, basic.SubprotocolMuxPlain,
+		basic.SubprotocolDeflate, basic.SubprotocolSnappy, basic.SubprotocolPlain,
+	}, x.subprotocols())
+
+	u := websocket.NewUpgrader()
+	conn := func(subprotocol string) *websocket.Conn {
+		return websocket.NewConn(u, nil, subprotocol, true, false)
+	}
+	// the clients without a subprotocol keep the codec of the config.
+	assert.True(t, x.compressed(conn("")))
+	assert.True(t, x.compressed(conn(basic.SubprotocolSnappy)))
+	assert.False(t, x.compressed(conn(basic.SubprotocolPlain)))
+	assert.False(t, x.compressed(conn(basic.SubprotocolDeflate)))
+	assert.True(t, x.compressed(conn(basic.SubprotocolMuxSnappy)))
+	assert.False(t, multiplexed(conn(basic.SubprotocolSnappy)))
+	assert.True(t, multiplexed(conn(basic.SubprotocolMuxDeflate)))
+
+	packet := []byte("a packet, a packet, a packet")
+	for _, p := range x.subprotocols() {
+		c := conn(p)
+		b, err := x.encode(c, packet)
+		assert.NoError(t, err)
+		b, err = x.decode(c, b)
+		assert.NoError(t, err)
+		assert.Equal(t, packet, b, p)
+	}
+}
@@ -0,0 +1,124 @@
+package ws
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gofly/pkg/logger"
+)
+
+// newFallback returns the handler of the requests which are not authorized websocket upgrades,
+// so that the listener looks like the site it falls back to.
+func (x *Server) newFallback() http.Handler {
+	c := &x.Config.WebSocketSettings.Fallback
+	switch {
+	case c.Origin != "":
+		origin, _ := url.Parse(c.Origin)
+		proxy := httputil.NewSingleHostReverseProxy(origin)
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Host = origin.Host
+			// the credentials of the refused clients are not sent to the origin.
+			req.Header.Del(AuthFieldKey)
+			for k := range req.Header {
+				if strings.HasPrefix(http.CanonicalHeaderKey(k), "Gofly-") {
+					req.Header.Del(k)
+				}
+			}
+			if q := req.URL.Query(); q.Has(AuthFieldKey) {
+				q.Del(AuthFieldKey)
+				req.URL.RawQuery = q.Encode()
+			}
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			logger.Logger.Sugar().Debugf("fallback %s: %v", req.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		return proxy
+	case c.Dir != "":
+		return http.FileServer(http.Dir(c.Dir))
+	default:
+		return http.HandlerFunc(decoy)
+	}
+}
+
+const (
+	decoyIndex = `<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome to nginx!</title>
+<style>
+html { color-scheme: light dark; }
+body { width: 35em; margin: 0 auto;
+font-family: Tahoma, Verdana, Arial, sans-serif; }
+</style>
+</head>
+<body>
+<h1>Welcome to nginx!</h1>
+<p>If you see this page, the nginx web server is successfully installed and
+working. Further configuration is required.</p>
+
+<p>For online documentation and support please refer to
+<a href="http://nginx.org/">nginx.org</a>.<br/>
+Commercial support is available at
+<a href="http://nginx.com/">nginx.com</a>.</p>
+
+<p><em>Thank you for using nginx.</em></p>
+</body>
+</html>
+`
+	decoyError = `<html>
+<head><title>%d %s</title></head>
+<body>
+<center><h1>%d %s</h1></center>
+<hr><center>nginx</center>
+</body>
+</html>
+`
+)
+
+// decoy answers like a freshly installed nginx, the fallback of the servers without a site.
+func decoy(w http.ResponseWriter, req *http.Request) {
+	status, body := http.StatusOK, decoyIndex
+	switch {
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		status = http.StatusMethodNotAllowed
+	case req.URL.Path != "/" && req.URL.Path != "/index.html":
+		status = http.StatusNotFound
+	}
+	if status != http.StatusOK {
+		text := http.StatusText(status)
+		body = fmt.Sprintf(decoyError, status, text, status, text)
+	}
+	h := w.Header()
+	h.Set("Server", "nginx")
+	h.Set("Content-Type", "text/html")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if req.Method != http.MethodHead {
+		io.WriteString(w, body)
+	}
+}
+
+// isUpgrade reports whether req asks for a websocket upgrade the upgrader accepts, it answers
+// the other ones with its own error response instead of the fallback one.
+func isUpgrade(req *http.Request) bool {
+	if req.Method != http.MethodGet || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" || req.Header.Get("Sec-WebSocket-Key") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/config"
+	"gofly/pkg/protocol/basic"
+)
+
+func TestServer_Fallback(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx")
+		// the credentials of the refused clients do not reach the origin.
+		if r.Header.Get(AuthFieldKey) != "" || r.Header.Get(HTTP_PROTOCOL_KEY) != "" || r.URL.Query().Has(AuthFieldKey) {
+			w.WriteHeader(http.StatusTeapot)
+		}
+		io.WriteString(w, "welcome to "+r.Host+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	x := &Server{}
+	x.Config = &config.Config{}
+	x.Config.VTunSettings.Key = "demo_key"
+	x.Config.WebSocketSettings.Fallback.Origin = origin.URL
+	assert.NoError(t, x.Config.WebSocketSettings.Check())
+	x.fallback = x.newFallback()
+
+	get := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		x.onWebsocket(w, r)
+		return w
+	}
+	plain := get(httptest.NewRequest(http.MethodGet, "/ws", nil))
+	assert.Equal(t, http.StatusOK, plain.Code)
+	assert.Equal(t, "nginx", plain.Header().Get("Server"))
+	assert.Equal(t, "welcome to "+origin.Listener.Addr().String()+"/ws", plain.Body.String())
+
+	// an upgrade with a wrong key gets the same response.
+	r := httptest.NewRequest(http.MethodGet, "/ws?key=wrong", nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set(AuthFieldKey, "wrong")
+	r.Header.Set(HTTP_PROTOCOL_KEY, basic.SubprotocolPlain)
+	assert.True(t, isUpgrade(r))
+	refused := get(r)
+	assert.Equal(t, plain.Code, refused.Code)
+	assert.Equal(t, plain.Header().Get("Server"), refused.Header().Get("Server"))
+	assert.Equal(t, plain.Body.String(), refused.Body.String())
+
+	// so does an upgrade the upgrader would refuse.
+	r.Header.Set(AuthFieldKey, "demo_key")
+	r.Header.Del("Sec-WebSocket-Key")
+	assert.False(t, isUpgrade(r))
+	refused = get(r)
+	assert.Equal(t, plain.Code, refused.Code)
+	assert.Empty(t, refused.Header().Get("Sec-Websocket-Version"))
+	assert.Equal(t, plain.Body.String(), refused.Body.String())
+
+	// and an upgrade on a connection which can not be taken over.
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	assert.True(t, isUpgrade(r))
+	refused = get(r)
+	assert.Equal(t, plain.Code, refused.Code)
+	assert.Equal(t, plain.Body.String(), refused.Body.String())
+}
+
+func TestServer_FallbackDecoy(t *testing.T) {
+	x := &Server{}
+	x.Config = &config.Config{}
+	assert.NoError(t, x.Config.WebSocketSettings.Check())
+	x.fallback = x.newFallback()
+
+	get := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		x.onWebsocket(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	index := get(http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, index.Code)
+	assert.Equal(t, "nginx", index.Header().Get("Server"))
+	assert.Equal(t, "text/html", index.Header().Get("Content-Type"))
+	assert.Contains(t, index.Body.String(), "Welcome to nginx!")
+	assert.Equal(t, http.StatusNotFound, get(http.MethodGet, "/ws").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, get(http.MethodPost, "/").Code)
+}
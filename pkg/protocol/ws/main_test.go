@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/config"
+	"gofly/pkg/logger"
+	"gofly/pkg/statistics"
+)
+
+func TestMain(m *testing.M) {
+	// the logger is set once, the handlers of a test may still log while the next one starts.
+	logger.Logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server of the users alice and bob whose tun device is received, t
+// waits for its handlers once the servers of the test are closed.
+func newTestServer(t *testing.T) (*Server, chan []byte) {
+	x := &Server{}
+	x.Config = &config.Config{Users: []config.UserConfig{
+		{Name: "alice", Key: "alice_key"},
+		{Name: "bob", Key: "bob_key"},
+	}}
+	x.Config.VTunSettings.Timeout = 60
+	assert.NoError(t, x.Config.WebSocketSettings.Check())
+	x.Init()
+	x.Statistics = statistics.New()
+	x.ConnectionCache = cache.New(time.Minute, time.Minute)
+	x.fallback = x.newFallback()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, x.waitHandlers(ctx))
+	})
+	received := make(chan []byte, 2)
+	x.WriteFunc = func(b []byte) int {
+		received <- append([]byte(nil), b...)
+		return len(b)
+	}
+	return x, received
+}
+
+// testPacket returns an ip packet from 10.0.0.2 to 10.0.0.1.
+func testPacket() []byte {
+	packet := make([]byte, 20)
+	packet[0] = 0x45
+	copy(packet[12:], []byte{10, 0, 0, 2, 10, 0, 0, 1})
+	return packet
+}
+
+func prefixed(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
@@ -0,0 +1,275 @@
+package ws
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"go.uber.org/zap"
+	"gofly/pkg/audit"
+	"gofly/pkg/config"
+	"gofly/pkg/logger"
+	"gofly/pkg/mux"
+	"gofly/pkg/protocol/basic"
+	"gofly/pkg/session"
+	"gofly/pkg/x/xutils"
+)
+
+var (
+	errStreamClosed = errors.New("mux stream closed")
+	errUnknownToken = errors.New("unknown mux token")
+)
+
+// muxConn is a websocket which negotiated the mux framing, each of its streams is a session.
+type muxConn struct {
+	*websocket.Conn
+	user   *config.UserConfig
+	remote net.Addr
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+}
+
+// muxLink is a stream on one of its connections.
+type muxLink struct {
+	c  *muxConn
+	id uint32
+}
+
+// muxStream is a tunnel carried by one or more websockets, the packets to the client are
+// spread over them.
+type muxStream struct {
+	basic.Sources
+	x        *Server
+	s        *session.Session
+	token    string
+	compress bool
+	window   *mux.Window
+
+	mu    sync.Mutex
+	links []muxLink
+	next  int
+}
+
+func (st *muxStream) Session() *session.Session {
+	return st.s
+}
+
+func (st *muxStream) WritePacket(b []byte) error {
+	b, err := st.x.Encode(b, st.compress)
+	if err != nil {
+		return err
+	}
+	if !st.window.Take(len(b)) {
+		return nil
+	}
+	st.mu.Lock()
+	if len(st.links) == 0 {
+		st.mu.Unlock()
+		return errStreamClosed
+	}
+	l := st.links[st.next%len(st.links)]
+	st.next++
+	st.mu.Unlock()
+	return l.c.writeFrame(&mux.Frame{Type: mux.TypeData, Stream: l.id, Payload: b})
+}
+
+// CloseWithError closes the stream on all its connections, which stay open.
+func (st *muxStream) CloseWithError(err error) {
+	st.mu.Lock()
+	links := st.links
+	st.links = nil
+	st.mu.Unlock()
+	for _, l := range links {
+		l.c.mu.Lock()
+		delete(l.c.streams, l.id)
+		l.c.mu.Unlock()
+		l.c.writeFrame(&mux.Frame{Type: mux.TypeClose, Stream: l.id, Payload: []byte(err.Error())})
+	}
+	if links != nil {
+		st.x.closeStream(st, err)
+	}
+}
+
+// removeLink removes the stream from c, it returns true when c was its last connection.
+func (st *muxStream) removeLink(c *muxConn) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.links) == 0 {
+		return false
+	}
+	links := st.links[:0]
+	for _, l := range st.links {
+		if l.c != c {
+			links = append(links, l)
+		}
+	}
+	st.links = links
+	return len(links) == 0
+}
+
+func (c *muxConn) writeFrame(f *mux.Frame) error {
+	return c.WriteMessage(websocket.BinaryMessage, f.Append(make([]byte, 0, mux.HeaderSize+len(f.Payload))))
+}
+
+func (c *muxConn) stream(id uint32) (*muxStream, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, ok := c.streams[id]
+	return st, ok
+}
+
+// onMuxMessage handles a frame from the client of c.
+func (x *Server) onMuxMessage(c *muxConn, data []byte) {
+	f, err := mux.Parse(data)
+	if err != nil {
+		c.CloseWithError(err)
+		return
+	}
+	switch f.Type {
+	case mux.TypeOpen:
+		err = x.openStream(c, f.Stream, string(f.Payload))
+	case mux.TypeJoin:
+		err = x.joinStream(c, f.Stream, string(f.Payload))
+	case mux.TypeData:
+		st, ok := c.stream(f.Stream)
+		if !ok {
+			return
+		}
+		if n := st.window.Consume(len(f.Payload)); n > 0 {
+			c.writeFrame(mux.WindowFrame(f.Stream, n))
+		}
+		if allowed, err := x.AllowUp(st.s, len(f.Payload)); !allowed {
+			if err != nil {
+				st.CloseWithError(err)
+			}
+			return
+		}
+		packet, err := x.Decode(f.Payload, st.compress)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("decode error: %v", zap.Error(err))
+			return
+		}
+		x.RoutePacket(st, packet)
+		return
+	case mux.TypeWindow:
+		st, ok := c.stream(f.Stream)
+		if !ok {
+			return
+		}
+		n, err := mux.WindowSize(&f)
+		if err != nil {
+			c.CloseWithError(err)
+			return
+		}
+		st.window.Grant(n)
+		return
+	case mux.TypeClose:
+		st, ok := c.stream(f.Stream)
+		if !ok {
+			return
+		}
+		c.mu.Lock()
+		delete(c.streams, f.Stream)
+		c.mu.Unlock()
+		if st.removeLink(c) {
+			x.closeStream(st, nil)
+		}
+		return
+	default:
+		err = fmt.Errorf("unsupported mux frame type %d", f.Type)
+	}
+	if err != nil {
+		logger.Logger.Sugar().Debugf("refused mux stream %d of %s: %v", f.Stream, c.RemoteAddr().String(), err)
+		c.writeFrame(&mux.Frame{Type: mux.TypeClose, Stream: f.Stream, Payload: []byte(err.Error())})
+	}
+}
+
+// openStream opens the stream id of the user of key, or of the user of c when key is empty.
+func (x *Server) openStream(c *muxConn, id uint32, key string) (err error) {
+	if _, ok := c.stream(id); ok {
+		return fmt.Errorf("mux stream %d is open", id)
+	}
+	user := c.user
+	if key != "" {
+		var ok bool
+		user, ok = x.Authenticate(key)
+		defer func() {
+			x.AuditHandshake(&audit.Entry{Remote: c.remote.String()}, user, err)
+			x.CountHandshake(c.remote.String(), user, err)
+		}()
+		if !ok {
+			return errors.New("authentication failed")
+		}
+		if err = x.CheckQuota(user); err != nil {
+			return fmt.Errorf("user %s: %w", user.Name, err)
+		}
+	}
+	st := &muxStream{
+		x:        x,
+		s:        session.New(user.Name, user.Group, x.Config.VTunSettings.Protocol, c.remote),
+		token:    hex.EncodeToString(xutils.RandomBytes(16)),
+		compress: x.compressed(c.Conn),
+		window:   mux.NewWindow(),
+		links:    []muxLink{{c: c, id: id}},
+	}
+	st.s.OnKick(st.CloseWithError)
+	if err = x.OpenSession(st.s); err != nil {
+		return err
+	}
+	x.bonds.Store(st.token, st)
+	c.mu.Lock()
+	c.streams[id] = st
+	c.mu.Unlock()
+	return c.writeFrame(&mux.Frame{Type: mux.TypeOpened, Stream: id, Payload: []byte(st.token)})
+}
+
+// joinStream adds c to the stream of token as the stream id.
+func (x *Server) joinStream(c *muxConn, id uint32, token string) error {
+	if _, ok := c.stream(id); ok {
+		return fmt.Errorf("mux stream %d is open", id)
+	}
+	v, ok := x.bonds.Load(token)
+	if !ok {
+		return errUnknownToken
+	}
+	st := v.(*muxStream)
+	if st.s.User != c.user.Name {
+		return fmt.Errorf("mux stream of %s joined by %s", st.s.User, c.user.Name)
+	}
+	if st.compress != x.compressed(c.Conn) {
+		return errors.New("the codecs of the bonded connections differ")
+	}
+	st.mu.Lock()
+	if len(st.links) == 0 {
+		st.mu.Unlock()
+		return errStreamClosed
+	}
+	st.links = append(st.links, muxLink{c: c, id: id})
+	st.mu.Unlock()
+	c.mu.Lock()
+	c.streams[id] = st
+	c.mu.Unlock()
+	return c.writeFrame(&mux.Frame{Type: mux.TypeOpened, Stream: id, Payload: []byte(token)})
+}
+
+// closeMux closes the streams which were carried by c alone.
+func (x *Server) closeMux(c *muxConn, err error) {
+	c.mu.Lock()
+	streams := c.streams
+	c.streams = map[uint32]*muxStream{}
+	c.mu.Unlock()
+	for _, st := range streams {
+		if st.removeLink(c) {
+			x.closeStream(st, err)
+		}
+	}
+}
+
+func (x *Server) closeStream(st *muxStream, err error) {
+	x.bonds.Delete(st.token)
+	x.CloseSession(st.s, err)
+}
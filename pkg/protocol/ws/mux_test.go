@@ -0,0 +1,90 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/mux"
+	"gofly/pkg/protocol/basic"
+	"golang.org/x/net/websocket"
+)
+
+func TestServer_Mux(t *testing.T) {
+	x, received := newTestServer(t)
+	server := httptest.NewServer(http.HandlerFunc(x.onWebsocket))
+	defer server.Close()
+
+	dial := func() *websocket.Conn {
+		c, err := websocket.NewConfig(strings.Replace(server.URL, "http", "ws", 1), server.URL)
+		assert.NoError(t, err)
+		c.Header.Set(AuthFieldKey, "alice_key")
+		c.Protocol = []string{basic.SubprotocolMuxPlain}
+		ws, err := websocket.DialConfig(c)
+		assert.NoError(t, err)
+		ws.PayloadType = websocket.BinaryFrame
+		ws.SetDeadline(time.Now().Add(5 * time.Second))
+		return ws
+	}
+	write := func(ws *websocket.Conn, f *mux.Frame) {
+		_, err := ws.Write(f.Append(nil))
+		assert.NoError(t, err)
+	}
+	read := func(ws *websocket.Conn) mux.Frame {
+		var b []byte
+		assert.NoError(t, websocket.Message.Receive(ws, &b))
+		f, err := mux.Parse(b)
+		assert.NoError(t, err)
+		return f
+	}
+
+	// the second websocket joins the stream opened by the first one.
+	c1, c2 := dial(), dial()
+	defer c1.Close()
+	defer c2.Close()
+	write(c1, &mux.Frame{Type: mux.TypeOpen, Stream: 1})
+	opened := read(c1)
+	assert.Equal(t, mux.TypeOpened, opened.Type)
+	write(c2, &mux.Frame{Type: mux.TypeJoin, Stream: 7, Payload: opened.Payload})
+	assert.Equal(t, mux.Frame{Type: mux.TypeOpened, Stream: 7, Payload: opened.Payload}, read(c2))
+	write(c2, &mux.Frame{Type: mux.TypeJoin, Stream: 8, Payload: []byte("unknown")})
+	assert.Equal(t, mux.TypeClose, read(c2).Type)
+	write(c2, &mux.Frame{Type: mux.TypeOpen, Stream: 9, Payload: []byte("wrong_key")})
+	assert.Equal(t, mux.TypeClose, read(c2).Type)
+
+	// a stream of another user on the same websocket.
+	write(c2, &mux.Frame{Type: mux.TypeOpen, Stream: 10, Payload: []byte("bob_key")})
+	assert.Equal(t, mux.TypeOpened, read(c2).Type)
+
+	packet := testPacket()
+	write(c2, &mux.Frame{Type: mux.TypeData, Stream: 7, Payload: packet})
+	assert.Equal(t, packet, <-received)
+
+	// the packets to the client are spread over the bonded websockets.
+	v, ok := x.ConnectionCache.Get("10.0.0.2")
+	assert.True(t, ok)
+	st := v.(*muxStream)
+	assert.Equal(t, "alice", st.s.User)
+	assert.NoError(t, x.Send(st, packet))
+	assert.NoError(t, x.Send(st, packet))
+	assert.Equal(t, mux.Frame{Type: mux.TypeData, Stream: 1, Payload: packet}, read(c1))
+	assert.Equal(t, mux.Frame{Type: mux.TypeData, Stream: 7, Payload: packet}, read(c2))
+
+	// the stream is closed with its last websocket.
+	c1.Close()
+	assert.Eventually(t, func() bool {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return len(st.links) == 1
+	}, time.Second, 10*time.Millisecond)
+	_, ok = x.bonds.Load(string(opened.Payload))
+	assert.True(t, ok)
+	c2.Close()
+	assert.Eventually(t, func() bool {
+		_, ok := x.bonds.Load(string(opened.Payload))
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
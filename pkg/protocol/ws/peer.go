@@ -0,0 +1,27 @@
+package ws
+
+import (
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"gofly/pkg/protocol/basic"
+	"gofly/pkg/session"
+)
+
+// wsPeer is a websocket carrying the packets of one session.
+type wsPeer struct {
+	basic.Sources
+	x *Server
+	c *websocket.Conn
+	s *session.Session
+}
+
+func (p *wsPeer) Session() *session.Session {
+	return p.s
+}
+
+func (p *wsPeer) WritePacket(b []byte) error {
+	return p.x.writeToClient(p.c, b)
+}
+
+func (p *wsPeer) CloseWithError(err error) {
+	p.c.CloseWithError(err)
+}
@@ -0,0 +1,298 @@
+package ws
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gofly/pkg/config"
+	"gofly/pkg/logger"
+	"gofly/pkg/protocol/basic"
+	"gofly/pkg/session"
+)
+
+// HTTP_SESSION_KEY carries the token of a poll session, it correlates the event stream of a
+// client with its posts.
+const HTTP_SESSION_KEY = "GoFly-Session"
+
+const (
+	// pollQueue is the number of packets kept for a client between its event streams.
+	pollQueue = 256
+	// pollKeepalive is the interval of the comments keeping an idle event stream open.
+	pollKeepalive = 15 * time.Second
+	// maxPollPost is the largest body of the posts of a client.
+	maxPollPost = 1 << 20
+)
+
+var (
+	errPollClosed = errors.New("poll session closed by the client")
+	errPollIdle   = errors.New("poll session without event stream")
+)
+
+// isPoll reports whether r belongs to the poll transport for the proxies stripping the upgrades:
+// the packets to the client are the events of a GET, each base64 encoded, and the packets of the
+// client are posted in batches each prefixed by its big endian 2 bytes length.
+func isPoll(r *http.Request) bool {
+	if r.Header.Get(HTTP_SESSION_KEY) != "" {
+		return true
+	}
+	return r.Method == http.MethodGet && r.Header.Get(HTTP_PROTOCOL_KEY) != "" &&
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// pollPeer is a client of the poll transport, its packets are queued until an event stream
+// of the client sends them.
+type pollPeer struct {
+	basic.Sources
+	x        *Server
+	s        *session.Session
+	token    string
+	compress bool
+	packets  chan []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	events chan struct{} // closed when another event stream replaces the current one
+	idle   *time.Timer
+}
+
+func (p *pollPeer) Session() *session.Session {
+	return p.s
+}
+
+func (p *pollPeer) WritePacket(b []byte) error {
+	b, err := p.x.Encode(b, p.compress)
+	if err != nil {
+		return err
+	}
+	select {
+	case p.packets <- b:
+	case <-p.closed:
+		return errStreamClosed
+	default:
+		// the queue is full while the client reconnects, the packet is dropped like by a
+		// congested link.
+	}
+	return nil
+}
+
+// CloseWithError ends the poll session, there is no connection whose end would close it.
+func (p *pollPeer) CloseWithError(err error) {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.x.polls.Delete(p.token)
+		p.mu.Lock()
+		if p.idle != nil {
+			p.idle.Stop()
+		}
+		p.mu.Unlock()
+		p.x.CloseSession(p.s, err)
+	})
+}
+
+// attach makes the caller the event stream of p, the previous one ends.
+func (p *pollPeer) attach() chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.events != nil {
+		close(p.events)
+	}
+	if p.idle != nil {
+		p.idle.Stop()
+		p.idle = nil
+	}
+	p.events = make(chan struct{})
+	return p.events
+}
+
+// detach ends the event stream events of p, the session is closed unless the client opens
+// another one within the timeout.
+func (p *pollPeer) detach(events chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.events != events {
+		return
+	}
+	p.events = nil
+	timeout := time.Second * time.Duration(p.x.Config.VTunSettings.Timeout)
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	p.idle = time.AfterFunc(timeout, func() { p.CloseWithError(errPollIdle) })
+}
+
+// appendEvent appends the event of the encoded packet b to buf.
+func appendEvent(buf, b []byte) []byte {
+	buf = append(buf, "data: "...)
+	n := len(buf)
+	buf = append(buf, make([]byte, base64.StdEncoding.EncodedLen(len(b)))...)
+	base64.StdEncoding.Encode(buf[n:], b)
+	return append(buf, "\n\n"...)
+}
+
+// serveEvents writes the packets of p as events until the event stream is replaced, fails,
+// or done is closed. The queued packets are batched into one write.
+func (x *Server) serveEvents(p *pollPeer, events chan struct{}, write func(b []byte) error, done <-chan struct{}) error {
+	defer p.detach(events)
+	ticker := time.NewTicker(pollKeepalive)
+	defer ticker.Stop()
+	var buf []byte
+	for {
+		buf = buf[:0]
+		select {
+		case b := <-p.packets:
+			buf = appendEvent(buf, b)
+			for more := true; more && len(buf) < maxStreamPacket; {
+				select {
+				case b = <-p.packets:
+					buf = appendEvent(buf, b)
+				default:
+					more = false
+				}
+			}
+		case <-ticker.C:
+			buf = append(buf, ": ping\n\n"...)
+		case <-events:
+			return nil
+		case <-p.closed:
+			return errStreamClosed
+		case <-done:
+			return nil
+		}
+		if err := write(buf); err != nil {
+			return err
+		}
+	}
+}
+
+// serveEventStream serves the event stream of the client of p.
+func (x *Server) serveEventStream(w http.ResponseWriter, r *http.Request, p *pollPeer) {
+	events := p.attach()
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// nginx and the proxies following it do not buffer the events.
+	h.Set("X-Accel-Buffering", "no")
+	if flusher, ok := w.(http.Flusher); ok {
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		err := x.serveEvents(p, events, func(b []byte) error {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}, r.Context().Done())
+		logger.Logger.Sugar().Debugf("event stream ended: %s -> %v", r.RemoteAddr, zap.Error(err))
+		return
+	}
+	// nbhttp buffers the responses until their handler returns, the events are written to
+	// the hijacked connection instead.
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		p.detach(events)
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		p.detach(events)
+		logger.Logger.Sugar().Errorf("hijack error: %v", zap.Error(err))
+		return
+	}
+	var head bytes.Buffer
+	head.WriteString("HTTP/1.1 200 OK\r\n")
+	h.Set("Connection", "close")
+	h.Write(&head)
+	head.WriteString("\r\n")
+	if _, err = conn.Write(head.Bytes()); err != nil {
+		p.detach(events)
+		conn.Close()
+		return
+	}
+	// nbhttp reuses r once the handler returns.
+	remote := r.RemoteAddr
+	x.handlers.Add(1)
+	go func() {
+		defer x.handlers.Done()
+		defer conn.Close()
+		err := x.serveEvents(p, events, func(b []byte) error {
+			_, err := conn.Write(b)
+			return err
+		}, nil)
+		logger.Logger.Sugar().Debugf("event stream ended: %s -> %v", remote, zap.Error(err))
+	}()
+}
+
+// onPoll opens the poll session of the client authenticated as user and serves its first
+// event stream, the token of the session is sent in the header of the response.
+func (x *Server) onPoll(w http.ResponseWriter, r *http.Request, user *config.UserConfig) {
+	protocol, ok := x.StreamSubprotocol(r.Header.Values(HTTP_PROTOCOL_KEY))
+	if !ok {
+		http.Error(w, "unsupported protocol", http.StatusBadRequest)
+		return
+	}
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	p := &pollPeer{
+		x:        x,
+		token:    base64.RawURLEncoding.EncodeToString(token),
+		compress: protocol == basic.SubprotocolSnappy,
+		packets:  make(chan []byte, pollQueue),
+		closed:   make(chan struct{}),
+	}
+	remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	p.s = session.New(user.Name, user.Group, x.Config.VTunSettings.Protocol, remote)
+	p.s.OnKick(p.CloseWithError)
+	if err := x.OpenSession(p.s); err != nil {
+		logger.Logger.Sugar().Debugf("refused %s: %v", r.RemoteAddr, err)
+		x.fallback.ServeHTTP(w, r)
+		return
+	}
+	x.polls.Store(p.token, p)
+	logger.Logger.Sugar().Debugf("open: %s over poll", r.RemoteAddr)
+	w.Header().Set(HTTP_PROTOCOL_KEY, protocol)
+	w.Header().Set(HTTP_SESSION_KEY, p.token)
+	x.serveEventStream(w, r, p)
+}
+
+// onPollSession serves the requests of the poll session named by token: GET resumes its event
+// stream, POST sends a batch of packets and DELETE closes it. The unknown tokens get the fallback.
+func (x *Server) onPollSession(w http.ResponseWriter, r *http.Request, token string) {
+	v, ok := x.polls.Load(token)
+	if !ok {
+		x.fallback.ServeHTTP(w, r)
+		return
+	}
+	p := v.(*pollPeer)
+	switch r.Method {
+	case http.MethodGet:
+		x.serveEventStream(w, r, p)
+	case http.MethodPost:
+		err := x.readPrefixed(p, p.compress, http.MaxBytesReader(w, r.Body, maxPollPost))
+		if !errors.Is(err, io.EOF) {
+			p.CloseWithError(err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		p.CloseWithError(errPollClosed)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		x.fallback.ServeHTTP(w, r)
+	}
+}
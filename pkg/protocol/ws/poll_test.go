@@ -0,0 +1,55 @@
+package ws
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/ban"
+	"gofly/pkg/protocol/basic"
+)
+
+func TestServer_PollSession(t *testing.T) {
+	x, _ := newTestServer(t)
+	server := httptest.NewServer(http.HandlerFunc(x.onWebsocket))
+	defer server.Close()
+	dial := dialPoll(t, x, server.URL)
+	_, c := dial("alice_key")
+	defer c.close()
+	p := c.(*pollClient)
+	assert.NotEmpty(t, p.token)
+
+	// a resumed event stream replaces the previous one.
+	resumed := getEvents(t, server.URL, http.Header{HTTP_SESSION_KEY: {p.token}})
+	assert.Equal(t, http.StatusOK, resumed.StatusCode)
+	_, err := p.events.ReadString('\n')
+	assert.Error(t, err)
+	p.res.Body.Close()
+	p.res, p.events = resumed, bufio.NewReader(resumed.Body)
+	packet := testPacket()
+	p.write(packet)
+	v, ok := x.ConnectionCache.Get("10.0.0.2")
+	assert.True(t, ok)
+	assert.NoError(t, x.Send(v.(basic.Peer), packet))
+	assert.Equal(t, packet, p.read())
+
+	// the closed sessions are unknown, their requests get the fallback.
+	assert.Equal(t, http.StatusNoContent, p.do(http.MethodDelete, nil).StatusCode)
+	assert.Equal(t, "nginx", p.do(http.MethodPost, prefixed(packet)).Header.Get("Server"))
+
+	// the session of a client banned since it opened it is closed.
+	m, err := ban.New(&ban.Config{MaxFailures: 1})
+	assert.NoError(t, err)
+	defer m.Close()
+	_, c = dial("bob_key")
+	defer c.close()
+	p = c.(*pollClient)
+	ban.SetDefault(m)
+	defer ban.SetDefault(nil)
+	m.Fail("127.0.0.1:1")
+	assert.Equal(t, "nginx", p.do(http.MethodPost, prefixed(packet)).Header.Get("Server"))
+	_, ok = x.polls.Load(p.token)
+	assert.False(t, ok)
+}
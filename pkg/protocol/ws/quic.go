@@ -0,0 +1,134 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+	"gofly/pkg/ban"
+	"gofly/pkg/logger"
+	"gofly/pkg/protocol/basic"
+)
+
+// quicLinger is how long a refused quic connection is kept for its client to read the response.
+const quicLinger = 5 * time.Second
+
+// serveQUIC serves a quic connection of the gofly protocol. Its first stream carries an http/1.1
+// request authenticated like a websocket upgrade and its response, then the packets are sent
+// as datagrams, or on the stream prefixed by their length when they do not fit a datagram.
+func (x *Server) serveQUIC(conn quic.Connection) {
+	ctx := conn.Context()
+	// the keep alives hold the connection open, the client has Timeout to send its request.
+	deadline := time.Now().Add(time.Second * time.Duration(x.Config.VTunSettings.Timeout))
+	actx, cancel := context.WithDeadline(ctx, deadline)
+	str, err := conn.AcceptStream(actx)
+	cancel()
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return
+	}
+	str.SetReadDeadline(deadline)
+	r, err := http.ReadRequest(bufio.NewReader(str))
+	if err != nil {
+		conn.CloseWithError(0, "bad request")
+		return
+	}
+	r = r.WithContext(ctx)
+	r.RemoteAddr = conn.RemoteAddr().String()
+	state := conn.ConnectionState().TLS
+	r.TLS = &state
+
+	respond := func(status int, header http.Header) error {
+		res := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Header: header}
+		return res.Write(str)
+	}
+	if err = ban.Check(r.RemoteAddr); err != nil {
+		logger.Logger.Sugar().Debugf("refused %s: %v", r.RemoteAddr, err)
+		x.refuse(conn, str, r)
+		return
+	}
+	user, err := x.checkPermission(nil, r)
+	if err != nil {
+		x.AuthFailed(r.RemoteAddr, err)
+		x.refuse(conn, str, r)
+		return
+	}
+	str.SetReadDeadline(time.Time{})
+	protocol, ok := x.StreamSubprotocol(r.Header.Values(HTTP_PROTOCOL_KEY))
+	if !ok {
+		respond(http.StatusBadRequest, nil)
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	p := &streamPeer{x: x, compress: protocol == basic.SubprotocolSnappy, w: str}
+	if conn.ConnectionState().SupportsDatagrams {
+		p.datagram = conn.SendDatagram
+	}
+	p.close = func(err error) { conn.CloseWithError(0, err.Error()) }
+	if err = x.openStreamSession(p, user, conn.RemoteAddr()); err != nil {
+		logger.Logger.Sugar().Debugf("refused %s: %v", r.RemoteAddr, err)
+		x.refuse(conn, str, r)
+		return
+	}
+	p.mu.Lock()
+	err = respond(http.StatusOK, http.Header{HTTP_PROTOCOL_KEY: {protocol}})
+	p.mu.Unlock()
+	if err != nil {
+		x.CloseSession(p.s, err)
+		return
+	}
+	logger.Logger.Sugar().Debugf("open: %s over QUIC", r.RemoteAddr)
+
+	if p.datagram != nil {
+		x.handlers.Add(1)
+		go func() {
+			defer x.handlers.Done()
+			x.readDatagrams(ctx, p, conn)
+		}()
+	}
+	err = x.readStream(p, str)
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.CloseWithError(err)
+	x.CloseSession(p.s, err)
+	logger.Logger.Sugar().Debugf("closed: %s -> %v", r.RemoteAddr, zap.Error(err))
+}
+
+// refuse writes the fallback response of r on str like to the refused websocket clients, conn is
+// closed once the client got it.
+func (x *Server) refuse(conn quic.Connection, str quic.Stream, r *http.Request) {
+	rec := httptest.NewRecorder()
+	x.fallback.ServeHTTP(rec, r)
+	if err := rec.Result().Write(str); err != nil {
+		conn.CloseWithError(0, "")
+		return
+	}
+	str.Close()
+	linger := time.NewTimer(quicLinger)
+	defer linger.Stop()
+	select {
+	case <-conn.Context().Done():
+	case <-linger.C:
+	}
+	conn.CloseWithError(0, "")
+}
+
+// readDatagrams handles the datagrams of conn until it is closed.
+func (x *Server) readDatagrams(ctx context.Context, p *streamPeer, conn quic.Connection) {
+	for {
+		b, err := conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if err = x.onPeerMessage(p, p.compress, b); err != nil {
+			p.CloseWithError(err)
+			return
+		}
+	}
+}
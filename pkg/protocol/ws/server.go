@@ -4,20 +4,29 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/lesismal/nbio/logging"
 	"github.com/lesismal/nbio/nbhttp"
 	"github.com/lesismal/nbio/nbhttp/websocket"
 	"github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
+	"gofly/pkg/audit"
+	"gofly/pkg/ban"
+	"gofly/pkg/certwatch"
+	"gofly/pkg/config"
+	"gofly/pkg/connlimit"
 	"gofly/pkg/logger"
 	"gofly/pkg/protocol/basic"
-	"gofly/pkg/utils"
+	"gofly/pkg/realip"
+	"gofly/pkg/session"
 	"gofly/pkg/x/xutils"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/lesismal/llib/std/crypto/tls"
@@ -27,13 +36,26 @@ const AuthFieldKey = "key"
 
 type Server struct {
 	basic.Server
+	fallback http.Handler
+	bonds    sync.Map       // the token of a mux stream to the *muxStream joined by it
+	polls    sync.Map       // the token of a poll session to its *pollPeer
+	handlers sync.WaitGroup // the websockets, streams and quic connections being served
 }
 
-func (x *Server) newUpgrade() *websocket.Upgrader {
+// newUpgrade returns the upgrader of the client at remote authenticated as user, done is called
+// once the websocket is closed.
+func (x *Server) newUpgrade(user *config.UserConfig, remote net.Addr, done func()) *websocket.Upgrader {
 	u := websocket.NewUpgrader()
 	u.KeepaliveTime = time.Second * 25
 	u.HandshakeTimeout = time.Second * time.Duration(x.Config.VTunSettings.Timeout)
 	u.CheckOrigin = func(r *http.Request) bool { return true }
+	u.Subprotocols = x.subprotocols()
+	if x.Config.WebSocketSettings.PerMessageDeflate {
+		u.EnableCompression(true)
+		if level := x.Config.WebSocketSettings.CompressionLevel; level > 0 {
+			u.SetCompressionLevel(level)
+		}
+	}
 	u.SetPingHandler(func(c *websocket.Conn, s string) {
 		logger.Logger.Sugar().Debugf("received ping message <%v> from %s\n", s, c.Conn.RemoteAddr().String())
 		err := c.WriteMessage(websocket.PongMessage, []byte(s))
@@ -45,44 +67,96 @@ func (x *Server) newUpgrade() *websocket.Upgrader {
 	u.SetPongHandler(func(c *websocket.Conn, s string) {
 		logger.Logger.Sugar().Debugf("received pong message <%v> from %s\n", s, c.Conn.RemoteAddr().String())
 	})
+	u.OnOpen(func(c *websocket.Conn) {
+		// the snappy compressed messages are not deflated a second time.
+		c.EnableWriteCompression(!x.compressed(c))
+		if multiplexed(c) {
+			c.SetSession(&muxConn{Conn: c, user: user, remote: remote, streams: map[uint32]*muxStream{}})
+			return
+		}
+		s := session.New(user.Name, user.Group, x.Config.VTunSettings.Protocol, remote)
+		s.OnKick(func(err error) { c.CloseWithError(err) })
+		if err := x.OpenSession(s); err != nil {
+			logger.Logger.Sugar().Debugf("refused %s: %v", c.RemoteAddr().String(), err)
+			c.CloseWithError(err)
+			return
+		}
+		c.SetSession(&wsPeer{x: x, c: c, s: s})
+	})
 	u.OnMessage(func(c *websocket.Conn, messageType websocket.MessageType, data []byte) {
-		var err error
-		if messageType == websocket.BinaryMessage {
-			n := len(data)
-			x.Statistics.IncrReceivedBytes(n)
-			data, err = x.BasicDecode(data)
+		if messageType != websocket.BinaryMessage {
+			return
+		}
+		switch p := c.Session().(type) {
+		case *muxConn:
+			x.onMuxMessage(p, data)
+		case *wsPeer:
+			if allowed, err := x.AllowUp(p.s, len(data)); !allowed {
+				if err != nil {
+					c.CloseWithError(err)
+				}
+				return
+			}
+			data, err := x.decode(c, data)
 			if err != nil {
 				logger.Logger.Sugar().Errorf("decode error: %v", zap.Error(err))
 				return
 			}
-			if key := utils.GetSrcKey(data); key != "" {
-				x.ConnectionCache.Set(key, c, 24*time.Hour)
-				if dstKey := utils.GetDstKey(data); dstKey != "" {
-					if dstConn, ok := x.ConnectionCache.Get(dstKey); ok && !x.Config.VTunSettings.ClientIsolation {
-						if err = dstConn.(*websocket.Conn).WriteMessage(websocket.BinaryMessage, data); err != nil {
-							logger.Logger.Sugar().Errorf("try to write message error: %v\n", err)
-						}
-					} else {
-						x.ConvertSrcAddr(data)
-						x.WriteFunc(data)
-						x.Statistics.IncrClientTransportBytes(c.RemoteAddr(), n)
-					}
-				}
-			}
+			x.RoutePacket(p, data)
 		}
 	})
 
 	u.OnClose(func(c *websocket.Conn, err error) {
-		x.Statistics.Remove(c.RemoteAddr())
+		defer done()
+		switch p := c.Session().(type) {
+		case *muxConn:
+			x.closeMux(p, err)
+		case *wsPeer:
+			x.CloseSession(p.s, err)
+		}
 		logger.Logger.Sugar().Debugf("closed: %s -> %v", c.RemoteAddr().String(), zap.Error(err))
 	})
 	return u
 }
 
+// onWebsocket upgrades the authorized websocket requests, the other requests get the fallback
+// response so that a refused client can not tell the listener from the fallback site.
 func (x *Server) onWebsocket(w http.ResponseWriter, r *http.Request) {
-	if !x.checkPermission(r) {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte("forbidden"))
+	r.RemoteAddr = realip.ClientAddr(r)
+	token := r.Header.Get(HTTP_SESSION_KEY)
+	if !isUpgrade(r) && !isStream(r) && !isPoll(r) {
+		x.fallback.ServeHTTP(w, r)
+		return
+	}
+	if err := ban.Check(r.RemoteAddr); err != nil {
+		logger.Logger.Sugar().Debugf("refused %s: %v", r.RemoteAddr, err)
+		// the poll session of a client banned since it was opened is closed.
+		if v, ok := x.polls.Load(token); ok {
+			v.(*pollPeer).CloseWithError(err)
+		}
+		x.fallback.ServeHTTP(w, r)
+		return
+	}
+	if token != "" {
+		x.onPollSession(w, r, token)
+		return
+	}
+	user, err := x.checkPermission(w, r)
+	if err != nil {
+		x.AuthFailed(r.RemoteAddr, err)
+		x.fallback.ServeHTTP(w, r)
+		return
+	}
+	if isStream(r) {
+		x.onStream(w, r, user)
+		return
+	}
+	if isPoll(r) {
+		x.onPoll(w, r, user)
+		return
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		x.fallback.ServeHTTP(w, r)
 		return
 	}
 	responseHeader := http.Header{}
@@ -92,16 +166,20 @@ func (x *Server) onWebsocket(w http.ResponseWriter, r *http.Request) {
 		responseHeader.Set(HTTP_RESPONSE_ID_KEY, responseId)
 		logger.Logger.Sugar().Debugf("response id: %s", responseId)
 	}
-	upgrade := x.newUpgrade()
+	remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	x.handlers.Add(1)
+	var once sync.Once
+	done := func() { once.Do(x.handlers.Done) }
+	upgrade := x.newUpgrade(user, remote, done)
 	conn, err := upgrade.Upgrade(w, r, responseHeader)
 	if err != nil {
+		// the requests the upgrader refuses were sent to the fallback, it only fails once it
+		// took the connection over so nothing more can be written to it.
+		done()
 		logger.Logger.Sugar().Errorf("upgrade error: %v", zap.Error(err))
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte("forbidden"))
 		return
 	}
 	conn.SetReadDeadline(time.Time{})
-	x.Statistics.Push(conn.RemoteAddr())
 	logger.Logger.Sugar().Debugf("open: %s", conn.RemoteAddr().String())
 }
 
@@ -113,47 +191,102 @@ func (x *Server) StartServerForApi() {
 	}
 	x.ConnectionCache = cache.New(15*time.Minute, 24*time.Hour)
 	// server -> client
-	go x.toClient()
+	go x.ToClients()
 	// client -> server
+	x.fallback = x.newFallback()
 	mux := &http.ServeMux{}
 	mux.HandleFunc(x.Config.WebSocketSettings.Path, x.onWebsocket)
-	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "text/plain")
-		w.Header().Set("Content-Length", "6")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("CF-Cache-Status", "DYNAMIC")
-		w.Header().Set("Server", "cloudflare")
-		w.Write([]byte(`follow`))
-	})
+	if x.Config.WebSocketSettings.Path != "/" {
+		mux.Handle("/", x.fallback)
+	}
 
-	var svr *nbhttp.Server
-	if x.Config.VTunSettings.Protocol == "wss" {
-		if x.Config.WebSocketSettings.TLSCertificateFilePath == "" || x.Config.WebSocketSettings.TLSCertificateKeyFilePath == "" {
-			log.Panic(errors.New("tls certificate file location not set"))
+	listen := func(network, addr string) (net.Listener, error) {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return nil, err
 		}
-		cert, err := tls.LoadX509KeyPair(x.Config.WebSocketSettings.TLSCertificateFilePath, x.Config.WebSocketSettings.TLSCertificateKeyFilePath)
+		return realip.NewListener(l), nil
+	}
+	// nbio takes over the file descriptors of the connections, it refuses the wrapped ones.
+	rawListen := func(network, addr string) (net.Listener, error) {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return realip.NewRawListener(l), nil
+	}
+	var watcher *certwatch.Watcher
+	if x.Config.VTunSettings.Protocol == "wss" {
+		// the certificate is reloaded when its files change, the open connections are kept.
+		var err error
+		watcher, err = certwatch.New(&certwatch.Config{
+			CertFile:      x.Config.WebSocketSettings.TLSCertificateFilePath,
+			KeyFile:       x.Config.WebSocketSettings.TLSCertificateKeyFilePath,
+			CheckInterval: x.Config.WebSocketSettings.CertificateCheckInterval,
+			WarnBefore:    x.Config.WebSocketSettings.CertificateWarnBefore,
+		})
 		if err != nil {
 			log.Panic(err)
 		}
+		certwatch.SetDefault(watcher)
+		go watcher.Run(x.CTX)
+	} else if x.Config.WebSocketSettings.ClientAuth.Enabled() {
+		log.Panic(errors.New("client_auth requires the wss protocol"))
+	}
+	switch x.Config.WebSocketSettings.Transport {
+	case config.TransportHTTP2, config.TransportHTTP3:
+		x.serveHTTP(mux, listen, watcher)
+		return
+	}
+
+	var svr *nbhttp.Server
+	if watcher != nil {
+		var err error
 		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: watcher.GetCertificate,
+		}
+		if c := &x.Config.WebSocketSettings.ClientAuth; c.Enabled() {
+			tlsConfig.ClientCAs, err = loadClientCAs(c.CAFilePath)
+			if err != nil {
+				log.Panic(err)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 		}
 		svr = nbhttp.NewServer(nbhttp.Config{
 			Network:   "tcp",
 			AddrsTLS:  []string{x.Config.VTunSettings.LocalAddr},
 			TLSConfig: tlsConfig,
 			Handler:   mux,
+			Listen:    rawListen,
 		})
 	} else {
 		svr = nbhttp.NewServer(nbhttp.Config{
 			Network: "tcp",
 			Addrs:   []string{x.Config.VTunSettings.LocalAddr},
 			Handler: mux,
+			Listen:  rawListen,
 		})
 	}
 
+	// the connections are banned and limited before their tls handshake, by the address of
+	// the client sent in their PROXY protocol header if any.
+	svr.OnOpen(func(c net.Conn) {
+		addr := realip.ConnAddr(c.RemoteAddr().String())
+		if err := ban.Check(addr); err != nil {
+			logger.Logger.Sugar().Debugf("refused %s: %v", addr, err)
+			c.Close()
+			return
+		}
+		if err := connlimit.OpenConn(addr); err != nil {
+			logger.Logger.Sugar().Debugf("refused %s: %v", addr, err)
+			x.Statistics.AddRejected(err)
+			c.Close()
+		}
+	})
+	svr.OnClose(func(c net.Conn, err error) {
+		connlimit.CloseConn(realip.ConnAddr(c.RemoteAddr().String()))
+		realip.Forget(c.RemoteAddr().String())
+	})
 	err := svr.Start()
 	if err != nil {
 		logger.Logger.Sugar().Errorf("nbio.Start failed: %v", zap.Error(err))
@@ -169,55 +302,69 @@ func (x *Server) StartServerForApi() {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 	svr.Shutdown(ctx)
+	x.waitHandlers(ctx)
 }
 
-// checkPermission checks the permission of the request
-// Validation is successful if the header or request parameters contain specific data.
-func (x *Server) checkPermission(req *http.Request) bool {
-	if x.Config.VTunSettings.Key == "" {
-		return true
-	}
-	key1 := req.Header.Get(AuthFieldKey)
-	key2 := req.URL.Query().Get(AuthFieldKey)
-	if key1 != x.Config.VTunSettings.Key && key2 != x.Config.VTunSettings.Key {
-		return false
+// waitHandlers waits for the handlers of the clients to return, or for ctx to be done.
+func (x *Server) waitHandlers(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		x.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return true
 }
 
-// toClient WireGuard to GateWay - ReadFunc
-func (x *Server) toClient() {
-	buffer := make([]byte, x.Config.VTunSettings.BufferSize)
-	for basic.ContextOpened(x.CTX) {
-		n, err := x.ReadFunc(buffer)
+// checkPermission checks the permission of the request and returns the authenticated user
+// Validation is successful if the header or request parameters contain the key of a user,
+// or the client certificate names a user when client_auth is enabled, and its quota is not
+// used up. Every attempt is written to the audit log.
+func (x *Server) checkPermission(w http.ResponseWriter, req *http.Request) (user *config.UserConfig, err error) {
+	serverName, chains := peerTLS(w, req)
+	defer func() {
+		e := &audit.Entry{Remote: req.RemoteAddr, SNI: req.Host}
+		if serverName != "" {
+			e.SNI = serverName
+		}
+		x.AuditHandshake(e, user, err)
+		x.CountHandshake(req.RemoteAddr, user, err)
+	}()
+	user, ok := x.Authenticate(req.Header.Get(AuthFieldKey))
+	if !ok {
+		user, ok = x.Authenticate(req.URL.Query().Get(AuthFieldKey))
+	}
+	if c := &x.Config.WebSocketSettings.ClientAuth; c.Enabled() {
+		certUser, err := x.authenticateCertificate(chains)
 		if err != nil {
-			logger.Logger.Error("getData Error", zap.Error(err))
-			break
+			return nil, err
 		}
-		if n == 0 {
-			continue
-		}
-		b := buffer[:n]
-		x.ConvertDstAddr(b)
-		if key := utils.GetDstKey(b); key != "" {
-			if v, ok := x.ConnectionCache.Get(key); ok {
-				b, err = x.BasicEncode(b)
-				if err != nil {
-					logger.Logger.Error("encode error", zap.Error(err))
-					x.ConnectionCache.Delete(key)
-					continue
-				}
-				ns := len(b)
-				conn := v.(*websocket.Conn)
-				err = conn.WriteMessage(websocket.BinaryMessage, b)
-				if err != nil {
-					logger.Logger.Error("write data error", zap.Error(err))
-					x.ConnectionCache.Delete(key)
-					continue
-				}
-				x.Statistics.IncrTransportBytes(ns)
-				x.Statistics.IncrClientReceivedBytes(conn.RemoteAddr(), ns)
-			}
+		if c.RequireKey && (!ok || user.Name != certUser.Name) {
+			return nil, fmt.Errorf("the key does not belong to user %s", certUser.Name)
 		}
+		user, ok = certUser, true
+	}
+	if !ok {
+		return nil, errors.New("authentication failed")
+	}
+	if err = x.CheckQuota(user); err != nil {
+		return user, fmt.Errorf("user %s: %w", user.Name, err)
+	}
+	return user, nil
+}
+
+// writeToClient encodes a packet and sends it to the client.
+func (x *Server) writeToClient(conn *websocket.Conn, b []byte) error {
+	b, err := x.encode(conn, b)
+	if err != nil {
+		return err
+	}
+	if err = conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return err
 	}
+	return nil
 }
@@ -0,0 +1,177 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+	"gofly/pkg/config"
+	"gofly/pkg/logger"
+	"gofly/pkg/protocol/basic"
+	"gofly/pkg/session"
+)
+
+// HTTP_PROTOCOL_KEY replaces Sec-WebSocket-Protocol for the stream transports, the client sends
+// the subprotocols it supports and the server answers the chosen one.
+const HTTP_PROTOCOL_KEY = "GoFly-Protocol"
+
+// maxStreamPacket is the largest encoded packet of a stream, its length prefix is 2 bytes.
+const maxStreamPacket = 1<<16 - 1
+
+var errPacketTooLarge = errors.New("packet too large")
+
+// isStream reports whether r is the long lived POST of the http/2 or http/3 stream transport,
+// its bodies carry the packets each prefixed by its big endian 2 bytes length.
+func isStream(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.ProtoMajor >= 2 && r.Header.Get(HTTP_PROTOCOL_KEY) != ""
+}
+
+// streamPeer is a client of a stream transport.
+type streamPeer struct {
+	basic.Sources
+	x        *Server
+	s        *session.Session
+	compress bool
+
+	mu     sync.Mutex
+	w      io.Writer
+	flush  func()
+	closed bool
+	// datagram sends an encoded packet unreliably, nil when only the stream carries the packets.
+	datagram func(b []byte) error
+
+	closeOnce sync.Once
+	close     func(err error)
+}
+
+func (p *streamPeer) Session() *session.Session {
+	return p.s
+}
+
+func (p *streamPeer) WritePacket(b []byte) error {
+	b, err := p.x.Encode(b, p.compress)
+	if err != nil {
+		return err
+	}
+	if p.datagram != nil {
+		if err = p.datagram(b); err == nil {
+			return nil
+		}
+	}
+	if len(b) > maxStreamPacket {
+		return errPacketTooLarge
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errStreamClosed
+	}
+	var prefix [2]byte
+	binary.BigEndian.PutUint16(prefix[:], uint16(len(b)))
+	if _, err = p.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err = p.w.Write(b); err != nil {
+		return err
+	}
+	if p.flush != nil {
+		p.flush()
+	}
+	return nil
+}
+
+func (p *streamPeer) CloseWithError(err error) {
+	p.closeOnce.Do(func() { p.close(err) })
+}
+
+// onPeerMessage handles an encoded packet of the client of p, compressed by snappy when
+// compress is set.
+func (x *Server) onPeerMessage(p basic.Peer, compress bool, b []byte) error {
+	if allowed, err := x.AllowUp(p.Session(), len(b)); !allowed {
+		return err
+	}
+	packet, err := x.Decode(b, compress)
+	if err != nil {
+		logger.Logger.Sugar().Errorf("decode error: %v", zap.Error(err))
+		return nil
+	}
+	x.RoutePacket(p, packet)
+	return nil
+}
+
+// readPrefixed handles the length prefixed packets of r until it fails, or returns io.EOF
+// at the end of r.
+func (x *Server) readPrefixed(p basic.Peer, compress bool, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var prefix [2]byte
+	for {
+		if _, err := io.ReadFull(br, prefix[:]); err != nil {
+			return err
+		}
+		b := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+		if _, err := io.ReadFull(br, b); err != nil {
+			return err
+		}
+		if err := x.onPeerMessage(p, compress, b); err != nil {
+			return err
+		}
+	}
+}
+
+// readStream handles the length prefixed packets of r until it fails.
+func (x *Server) readStream(p *streamPeer, r io.Reader) error {
+	return x.readPrefixed(p, p.compress, r)
+}
+
+// openStreamSession opens the session of the stream peer p authenticated as user.
+func (x *Server) openStreamSession(p *streamPeer, user *config.UserConfig, remote net.Addr) error {
+	p.s = session.New(user.Name, user.Group, x.Config.VTunSettings.Protocol, remote)
+	p.s.OnKick(p.CloseWithError)
+	return x.OpenSession(p.s)
+}
+
+// onStream serves the stream of the client authenticated as user, the packets of the response
+// are flushed one by one.
+func (x *Server) onStream(w http.ResponseWriter, r *http.Request, user *config.UserConfig) {
+	x.handlers.Add(1)
+	defer x.handlers.Done()
+	protocol, ok := x.StreamSubprotocol(r.Header.Values(HTTP_PROTOCOL_KEY))
+	if !ok {
+		http.Error(w, "unsupported protocol", http.StatusBadRequest)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	p := &streamPeer{x: x, compress: protocol == basic.SubprotocolSnappy, w: w}
+	if flusher != nil {
+		p.flush = flusher.Flush
+	}
+	p.close = func(error) { r.Body.Close() }
+	remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err := x.openStreamSession(p, user, remote); err != nil {
+		logger.Logger.Sugar().Debugf("refused %s: %v", r.RemoteAddr, err)
+		x.fallback.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set(HTTP_PROTOCOL_KEY, protocol)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	p.mu.Lock()
+	w.WriteHeader(http.StatusOK)
+	if p.flush != nil {
+		p.flush()
+	}
+	p.mu.Unlock()
+	logger.Logger.Sugar().Debugf("open: %s over HTTP/%d", r.RemoteAddr, r.ProtoMajor)
+
+	err := x.readStream(p, r.Body)
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.CloseWithError(err)
+	x.CloseSession(p.s, err)
+	logger.Logger.Sugar().Debugf("closed: %s -> %v", r.RemoteAddr, zap.Error(err))
+}
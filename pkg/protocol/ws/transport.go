@@ -0,0 +1,143 @@
+package ws
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+	"gofly/pkg/ban"
+	"gofly/pkg/certwatch"
+	"gofly/pkg/config"
+	"gofly/pkg/connlimit"
+	"gofly/pkg/logger"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// quicALPN is the protocol of the quic connections carrying the packets as datagrams, the
+// other quic connections speak http/3.
+const quicALPN = "gofly"
+
+// stdTLSConfig returns the crypto/tls config of the http2 and http3 transports.
+func (x *Server) stdTLSConfig(watcher *certwatch.Watcher) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: watcher.GetStdCertificate,
+		NextProtos:     []string{http2.NextProtoTLS, "http/1.1"},
+	}
+	if c := &x.Config.WebSocketSettings.ClientAuth; c.Enabled() {
+		pool, err := loadClientCAs(c.CAFilePath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// serveHTTP serves handler with net/http until interrupted: http/2 over tls for wss or over
+// cleartext for ws, and http/3 on the same port when the transport is http3. The websocket
+// upgrades of http/1.1 are served too.
+func (x *Server) serveHTTP(handler http.Handler, listen func(network, addr string) (net.Listener, error), watcher *certwatch.Watcher) {
+	l, err := listen("tcp", x.Config.VTunSettings.LocalAddr)
+	if err != nil {
+		logger.Logger.Sugar().Errorf("listen failed: %v", zap.Error(err))
+		return
+	}
+	// the connections are banned and limited before their tls handshake.
+	l = connlimit.NewListener(ban.NewListener(l), x.Statistics.AddRejected)
+	svr := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Second * time.Duration(x.Config.VTunSettings.Timeout),
+	}
+	if watcher == nil {
+		if x.Config.WebSocketSettings.Transport == config.TransportHTTP3 {
+			log.Panic(errors.New("the http3 transport requires the wss protocol"))
+		}
+		svr.Handler = h2c.NewHandler(handler, &http2.Server{})
+	} else {
+		svr.TLSConfig, err = x.stdTLSConfig(watcher)
+		if err != nil {
+			log.Panic(err)
+		}
+		l = tls.NewListener(l, svr.TLSConfig)
+	}
+	if x.Config.WebSocketSettings.Transport == config.TransportHTTP3 {
+		ql, err := x.listenQUIC(svr.TLSConfig)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("quic listen failed: %v", zap.Error(err))
+			return
+		}
+		defer ql.Close()
+		h3 := &http3.Server{Handler: handler}
+		go x.acceptQUIC(ql, h3)
+		altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, ql.Addr().(*net.UDPAddr).Port)
+		svr.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Alt-Svc", altSvc)
+			handler.ServeHTTP(w, r)
+		})
+	}
+	go func() {
+		if err := svr.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Logger.Sugar().Errorf("serve failed: %v", zap.Error(err))
+		}
+	}()
+
+	logger.Logger.Sugar().Infof("gofly %s server started on %v over %s", x.Config.VTunSettings.Protocol, x.Config.VTunSettings.LocalAddr, x.Config.WebSocketSettings.Transport)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	svr.Shutdown(ctx)
+	x.waitHandlers(ctx)
+}
+
+// listenQUIC listens for the quic connections of the http3 transport.
+func (x *Server) listenQUIC(tlsConfig *tls.Config) (*quic.Listener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{http3.NextProtoH3, quicALPN}
+	return quic.ListenAddr(x.Config.VTunSettings.LocalAddr, tlsConfig, &quic.Config{
+		MaxIdleTimeout:  time.Second * time.Duration(x.Config.VTunSettings.Timeout),
+		KeepAlivePeriod: 10 * time.Second,
+		EnableDatagrams: true,
+	})
+}
+
+// acceptQUIC serves the quic connections by their negotiated protocol.
+func (x *Server) acceptQUIC(l *quic.Listener, h3 *http3.Server) {
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		remote := conn.RemoteAddr().String()
+		if err = connlimit.OpenConn(remote); err != nil {
+			logger.Logger.Sugar().Debugf("refused %s: %v", remote, err)
+			x.Statistics.AddRejected(err)
+			conn.CloseWithError(0, err.Error())
+			continue
+		}
+		x.handlers.Add(1)
+		go func() {
+			defer x.handlers.Done()
+			defer connlimit.CloseConn(remote)
+			if conn.ConnectionState().TLS.NegotiatedProtocol == quicALPN {
+				x.serveQUIC(conn)
+				return
+			}
+			h3.ServeQUICConn(conn)
+		}()
+	}
+}
@@ -0,0 +1,319 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/protocol/basic"
+)
+
+// testClient is the client side of a transport.
+type testClient interface {
+	write(packet []byte)
+	read() []byte
+	close()
+}
+
+// testDial opens a client authenticated by key, it returns the response to its handshake.
+type testDial func(key string) (*http.Response, testClient)
+
+// streamClient is a client of the http/2 stream transport.
+type streamClient struct {
+	t   *testing.T
+	x   *Server
+	w   *io.PipeWriter
+	res *http.Response
+}
+
+func dialStream(t *testing.T, x *Server, client *http.Client, location string) testDial {
+	return func(key string) (*http.Response, testClient) {
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest(http.MethodPost, location, pr)
+		assert.NoError(t, err)
+		req.Header.Set(AuthFieldKey, key)
+		req.Header.Set(HTTP_PROTOCOL_KEY, "gofly.v3, "+basic.SubprotocolSnappy)
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, res.ProtoMajor)
+		return res, &streamClient{t: t, x: x, w: pw, res: res}
+	}
+}
+
+func (c *streamClient) write(packet []byte) {
+	b, err := c.x.Encode(packet, true)
+	assert.NoError(c.t, err)
+	_, err = c.w.Write(prefixed(b))
+	assert.NoError(c.t, err)
+}
+
+func (c *streamClient) read() []byte {
+	var prefix [2]byte
+	_, err := io.ReadFull(c.res.Body, prefix[:])
+	assert.NoError(c.t, err)
+	b := make([]byte, int(prefix[0])<<8|int(prefix[1]))
+	_, err = io.ReadFull(c.res.Body, b)
+	assert.NoError(c.t, err)
+	b, err = c.x.Decode(b, true)
+	assert.NoError(c.t, err)
+	return b
+}
+
+func (c *streamClient) close() {
+	c.w.Close()
+	c.res.Body.Close()
+}
+
+// quicClient is a client of the quic transport, its packets alternate the datagrams and the stream.
+type quicClient struct {
+	t       *testing.T
+	conn    quic.Connection
+	str     quic.Stream
+	written int
+}
+
+func dialQUIC(t *testing.T, addr string) testDial {
+	return func(key string) (*http.Response, testClient) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := quic.DialAddr(ctx, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{quicALPN},
+		}, &quic.Config{EnableDatagrams: true})
+		assert.NoError(t, err)
+		str, err := conn.OpenStreamSync(ctx)
+		assert.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, "https://gofly/", nil)
+		assert.NoError(t, err)
+		req.Header.Set(AuthFieldKey, key)
+		req.Header.Set(HTTP_PROTOCOL_KEY, basic.SubprotocolPlain)
+		assert.NoError(t, req.Write(str))
+		res, err := http.ReadResponse(bufio.NewReader(str), req)
+		assert.NoError(t, err)
+		return res, &quicClient{t: t, conn: conn, str: str}
+	}
+}
+
+func (c *quicClient) write(packet []byte) {
+	if c.written++; c.written%2 == 1 {
+		assert.NoError(c.t, c.conn.SendDatagram(packet))
+		return
+	}
+	_, err := c.str.Write(prefixed(packet))
+	assert.NoError(c.t, err)
+}
+
+func (c *quicClient) read() []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b, err := c.conn.ReceiveDatagram(ctx)
+	assert.NoError(c.t, err)
+	return b
+}
+
+func (c *quicClient) close() {
+	c.conn.CloseWithError(0, "")
+}
+
+// pollClient is a client of the poll transport.
+type pollClient struct {
+	t        *testing.T
+	x        *Server
+	location string
+	token    string
+	res      *http.Response
+	events   *bufio.Reader
+}
+
+func dialPoll(t *testing.T, x *Server, location string) testDial {
+	return func(key string) (*http.Response, testClient) {
+		res := getEvents(t, location, http.Header{AuthFieldKey: {key}, HTTP_PROTOCOL_KEY: {basic.SubprotocolSnappy}})
+		return res, &pollClient{
+			t:        t,
+			x:        x,
+			location: location,
+			token:    res.Header.Get(HTTP_SESSION_KEY),
+			res:      res,
+			events:   bufio.NewReader(res.Body),
+		}
+	}
+}
+
+// getEvents gets the event stream of a poll session with header.
+func getEvents(t *testing.T, location string, header http.Header) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	assert.NoError(t, err)
+	req.Header = header
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return res
+}
+
+// do sends a request of the poll session named by token.
+func (c *pollClient) do(method string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, c.location, bytes.NewReader(body))
+	assert.NoError(c.t, err)
+	req.Header.Set(HTTP_SESSION_KEY, c.token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(c.t, err)
+	res.Body.Close()
+	return res
+}
+
+func (c *pollClient) write(packet []byte) {
+	b, err := c.x.Encode(packet, true)
+	assert.NoError(c.t, err)
+	assert.Equal(c.t, http.StatusNoContent, c.do(http.MethodPost, prefixed(b)).StatusCode)
+}
+
+func (c *pollClient) read() []byte {
+	for {
+		line, err := c.events.ReadString('\n')
+		assert.NoError(c.t, err)
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: ")
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(data)
+		assert.NoError(c.t, err)
+		b, err = c.x.Decode(b, true)
+		assert.NoError(c.t, err)
+		return b
+	}
+}
+
+func (c *pollClient) close() {
+	if c.token != "" {
+		c.do(http.MethodDelete, nil)
+	}
+	c.res.Body.Close()
+}
+
+// flushless hides the http.Flusher of a ResponseWriter like nbhttp, the events are written to
+// the hijacked connection.
+type flushless struct {
+	http.ResponseWriter
+	http.Hijacker
+}
+
+// serveQUICTest serves the quic connections of x, it returns the address of the listener.
+func serveQUICTest(t *testing.T, x *Server) string {
+	tlsServer := httptest.NewUnstartedServer(nil)
+	tlsServer.StartTLS()
+	tlsServer.Close()
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: tlsServer.TLS.Certificates,
+		NextProtos:   []string{http3.NextProtoH3, quicALPN},
+	}, &quic.Config{EnableDatagrams: true})
+	assert.NoError(t, err)
+	accepted := make(chan struct{})
+	go func() {
+		x.acceptQUIC(l, &http3.Server{Handler: http.HandlerFunc(x.onWebsocket)})
+		close(accepted)
+	}()
+	t.Cleanup(func() {
+		// the connections are closed by their clients, the listener closing its socket
+		// first would leave them open until they time out.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, x.waitHandlers(ctx))
+		l.Close()
+		<-accepted
+	})
+	return l.Addr().String()
+}
+
+func TestServer_Transports(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		serve func(t *testing.T, x *Server) testDial
+	}{
+		{"http2", func(t *testing.T, x *Server) testDial {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(x.onWebsocket))
+			server.EnableHTTP2 = true
+			server.StartTLS()
+			t.Cleanup(server.Close)
+			return dialStream(t, x, server.Client(), server.URL)
+		}},
+		{"quic", func(t *testing.T, x *Server) testDial {
+			return dialQUIC(t, serveQUICTest(t, x))
+		}},
+		{"poll", func(t *testing.T, x *Server) testDial {
+			server := httptest.NewServer(http.HandlerFunc(x.onWebsocket))
+			t.Cleanup(server.Close)
+			return dialPoll(t, x, server.URL)
+		}},
+		{"poll hijacked", func(t *testing.T, x *Server) testDial {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				x.onWebsocket(flushless{w, w.(http.Hijacker)}, r)
+			}))
+			t.Cleanup(server.Close)
+			return dialPoll(t, x, server.URL)
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			x, received := newTestServer(t)
+			dial := tt.serve(t, x)
+
+			// the refused clients get the fallback response.
+			res, c := dial("wrong_key")
+			assert.Equal(t, "nginx", res.Header.Get("Server"))
+			assert.Empty(t, res.Header.Get(HTTP_PROTOCOL_KEY))
+			c.close()
+
+			res, c = dial("alice_key")
+			defer c.close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.NotEmpty(t, res.Header.Get(HTTP_PROTOCOL_KEY))
+			packet := testPacket()
+			for i := 0; i < 2; i++ {
+				c.write(packet)
+				assert.Equal(t, packet, <-received)
+			}
+			v, ok := x.ConnectionCache.Get("10.0.0.2")
+			assert.True(t, ok)
+			assert.NoError(t, x.Send(v.(basic.Peer), packet))
+			assert.Equal(t, packet, c.read())
+		})
+	}
+}
+
+func TestServer_QUICRequestTimeout(t *testing.T) {
+	x, _ := newTestServer(t)
+	x.Config.VTunSettings.Timeout = 1
+	addr := serveQUICTest(t, x)
+
+	for _, request := range []string{"", "POST / HTTP/1.1\r\n"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := quic.DialAddr(ctx, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{quicALPN},
+		}, &quic.Config{EnableDatagrams: true, KeepAlivePeriod: 100 * time.Millisecond})
+		assert.NoError(t, err)
+		// a client sending no request, or a partial one, is closed once the timeout is over.
+		if request != "" {
+			str, err := conn.OpenStreamSync(ctx)
+			assert.NoError(t, err)
+			_, err = str.Write([]byte(request))
+			assert.NoError(t, err)
+		}
+		select {
+		case <-conn.Context().Done():
+		case <-ctx.Done():
+			t.Errorf("connection still open with request %q", request)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,21 @@
+package quota
+
+const (
+	ActionDisconnect = "disconnect"
+	ActionThrottle   = "throttle"
+)
+
+type Config struct {
+	Path     string            `yaml:"path"`      //the file keeping the usage across restarts
+	ResetDay int               `yaml:"reset_day"` //the day of the month the usage is reset on, 1 when empty
+	WarnAt   []int             `yaml:"warn_at"`   //the percentages of the quota logged as warnings
+	Action   string            `yaml:"action"`    //disconnect or throttle an exceeded user, disconnect when empty
+	Throttle string            `yaml:"throttle"`  //bytes per second of a throttled user in each direction
+	Groups   map[string]string `yaml:"groups"`    //the quota of every user of the group, like 100GB
+	Users    map[string]string `yaml:"users"`     //replaces the quota of the group of the user
+}
+
+// Enabled reports whether any quota is configured.
+func (c *Config) Enabled() bool {
+	return len(c.Groups) > 0 || len(c.Users) > 0
+}
@@ -0,0 +1,368 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-units"
+	"gofly/pkg/logger"
+	"gofly/pkg/webhook"
+	"golang.org/x/time/rate"
+)
+
+// ErrExceeded is returned for the traffic of a user whose quota is used up, the user must be disconnected.
+var ErrExceeded = errors.New("traffic quota exceeded")
+
+const (
+	flushInterval = time.Minute
+	// throttleBurst is the largest packet, a smaller bucket would never let it through.
+	throttleBurst = 65535
+)
+
+// Usage is the traffic of a user in the current period.
+type Usage struct {
+	User     string `json:"user"`
+	Group    string `json:"group"`
+	Up       uint64 `json:"up"`
+	Down     uint64 `json:"down"`
+	Quota    uint64 `json:"quota"`
+	Warned   int    `json:"warned,omitempty"` //the highest warning threshold logged
+	Exceeded bool   `json:"exceeded"`
+
+	throttleUp   *rate.Limiter
+	throttleDown *rate.Limiter
+}
+
+func (u *Usage) used() uint64 {
+	return u.Up + u.Down
+}
+
+// Snapshot is the usage of every user, it is also the content of the persisted file.
+type Snapshot struct {
+	PeriodStart time.Time `json:"period_start"`
+	Users       []*Usage  `json:"users"`
+}
+
+// Manager accounts the traffic of the users against their quotas.
+type Manager struct {
+	path     string
+	resetDay int
+	warnAt   []int
+	throttle rate.Limit // zero when the exceeded users are disconnected
+	groups   map[string]uint64
+	users    map[string]uint64
+
+	mu          sync.Mutex
+	periodStart time.Time
+	usage       map[string]*Usage
+	dirty       bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(c *Config) (*Manager, error) {
+	m := &Manager{
+		path:     c.Path,
+		resetDay: c.ResetDay,
+		warnAt:   append([]int(nil), c.WarnAt...),
+		groups:   make(map[string]uint64, len(c.Groups)),
+		users:    make(map[string]uint64, len(c.Users)),
+		usage:    make(map[string]*Usage),
+		done:     make(chan struct{}),
+	}
+	if m.resetDay == 0 {
+		m.resetDay = 1
+	}
+	if m.resetDay < 1 || m.resetDay > 31 {
+		return nil, fmt.Errorf("invalid quota reset_day: %d", c.ResetDay)
+	}
+	sort.Ints(m.warnAt)
+	switch c.Action {
+	case "", ActionDisconnect:
+	case ActionThrottle:
+		r, err := units.RAMInBytes(c.Throttle)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid quota throttle: %q", c.Throttle)
+		}
+		m.throttle = rate.Limit(r)
+	default:
+		return nil, fmt.Errorf("unsupported quota action: %s", c.Action)
+	}
+	for name, s := range c.Groups {
+		q, err := parseSize(s)
+		if err != nil {
+			return nil, fmt.Errorf("quota of group %s: %w", name, err)
+		}
+		m.groups[name] = q
+	}
+	for name, s := range c.Users {
+		q, err := parseSize(s)
+		if err != nil {
+			return nil, fmt.Errorf("quota of user %s: %w", name, err)
+		}
+		m.users[name] = q
+	}
+	m.periodStart = m.currentPeriod(time.Now())
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	m.wg.Add(1)
+	go m.run()
+	return m, nil
+}
+
+func parseSize(s string) (uint64, error) {
+	size, err := units.RAMInBytes(s)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint64(size), nil
+}
+
+// currentPeriod returns the start of the period containing t, the last reset day at midnight.
+func (m *Manager) currentPeriod(t time.Time) time.Time {
+	start := m.resetDate(t.Year(), t.Month())
+	if t.Before(start) {
+		start = m.resetDate(t.Year(), t.Month()-1)
+	}
+	return start
+}
+
+// resetDate returns the reset day of the month, the last day of a shorter month.
+func (m *Manager) resetDate(year int, month time.Month) time.Time {
+	day := m.resetDay
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.Local).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// quota returns the quota of user, zero when it is unlimited.
+func (m *Manager) quota(user, group string) uint64 {
+	if user == "" {
+		return 0
+	}
+	if q, ok := m.users[user]; ok {
+		return q
+	}
+	return m.groups[group]
+}
+
+// Check returns ErrExceeded when the quota of user is used up and it must be disconnected.
+func (m *Manager) Check(user, group string) error {
+	q := m.quota(user, group)
+	if q == 0 || m.throttle != 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.usage[user]; ok && u.used() >= q {
+		return ErrExceeded
+	}
+	return nil
+}
+
+// AllowUp accounts a packet of n bytes sent by user, it reports whether the packet may enter.
+func (m *Manager) AllowUp(user, group string, n int) (bool, error) {
+	return m.allow(user, group, n, true)
+}
+
+// AllowDown accounts a packet of n bytes sent to user, it reports whether the packet may be sent.
+func (m *Manager) AllowDown(user, group string, n int) (bool, error) {
+	return m.allow(user, group, n, false)
+}
+
+func (m *Manager) allow(user, group string, n int, up bool) (bool, error) {
+	q := m.quota(user, group)
+	if q == 0 {
+		return true, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.usage[user]
+	if !ok {
+		u = &Usage{User: user}
+		m.usage[user] = u
+	}
+	u.Group, u.Quota = group, q
+	if u.Exceeded && u.used() < q {
+		// the quota was raised.
+		u.Exceeded, u.throttleUp, u.throttleDown = false, nil, nil
+	}
+	if u.Exceeded {
+		if m.throttle == 0 {
+			return false, ErrExceeded
+		}
+		if up && !u.throttleUp.AllowN(time.Now(), n) || !up && !u.throttleDown.AllowN(time.Now(), n) {
+			return false, nil
+		}
+	}
+	if up {
+		u.Up += uint64(n)
+	} else {
+		u.Down += uint64(n)
+	}
+	m.dirty = true
+	m.warn(u)
+	if !u.Exceeded && u.used() >= u.Quota {
+		m.exceed(u)
+	}
+	return true, nil
+}
+
+// warn logs the highest threshold reached by u once per period.
+func (m *Manager) warn(u *Usage) {
+	percent := int(u.used() * 100 / u.Quota)
+	for i := len(m.warnAt) - 1; i >= 0; i-- {
+		if t := m.warnAt[i]; percent >= t {
+			if t > u.Warned {
+				u.Warned = t
+				logger.Logger.Sugar().Warnf("user %s used %d%% of its traffic quota", u.User, t)
+			}
+			return
+		}
+	}
+}
+
+func (m *Manager) exceed(u *Usage) {
+	u.Exceeded = true
+	webhook.Emit(&webhook.Event{
+		Type:   webhook.QuotaExceeded,
+		User:   u.User,
+		Group:  u.Group,
+		Detail: fmt.Sprintf("used %d of %d bytes", u.used(), u.Quota),
+	})
+	if m.throttle != 0 {
+		m.throttleUsage(u)
+		logger.Logger.Sugar().Warnf("user %s exceeded its traffic quota, throttled", u.User)
+		return
+	}
+	logger.Logger.Sugar().Warnf("user %s exceeded its traffic quota, disconnected", u.User)
+}
+
+func (m *Manager) throttleUsage(u *Usage) {
+	u.throttleUp = rate.NewLimiter(m.throttle, throttleBurst)
+	u.throttleDown = rate.NewLimiter(m.throttle, throttleBurst)
+}
+
+// Snapshot returns the usage of every user in the current period.
+func (m *Manager) Snapshot() *Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &Snapshot{PeriodStart: m.periodStart, Users: make([]*Usage, 0, len(m.usage))}
+	for _, u := range m.usage {
+		c := *u
+		c.throttleUp, c.throttleDown = nil, nil
+		s.Users = append(s.Users, &c)
+	}
+	sort.Slice(s.Users, func(i, j int) bool { return s.Users[i].User < s.Users[j].User })
+	return s
+}
+
+// reset starts a new period when now is past the current one.
+func (m *Manager) reset(now time.Time) {
+	period := m.currentPeriod(now)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !period.After(m.periodStart) {
+		return
+	}
+	m.periodStart = period
+	m.usage = make(map[string]*Usage)
+	m.dirty = true
+	logger.Logger.Sugar().Infof("traffic quotas reset for the period starting %s", period.Format("2006-01-02"))
+}
+
+func (m *Manager) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.reset(now)
+			if err := m.flush(); err != nil {
+				logger.Logger.Sugar().Errorf("save traffic quotas: %v", err)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// load reads the usage of the current period, the usage of a past period is dropped.
+func (m *Manager) load() error {
+	if m.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s Snapshot
+	if err = json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("parse %s: %w", m.path, err)
+	}
+	if !s.PeriodStart.Equal(m.periodStart) {
+		return nil
+	}
+	for _, u := range s.Users {
+		if u.Exceeded && m.throttle != 0 {
+			m.throttleUsage(u)
+		}
+		m.usage[u.User] = u
+	}
+	return nil
+}
+
+// flush writes the usage to the file when it changed.
+func (m *Manager) flush() error {
+	if m.path == "" {
+		return nil
+	}
+	m.mu.Lock()
+	dirty := m.dirty
+	m.dirty = false
+	m.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	b, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// Close stops the periodic reset and saves the usage.
+func (m *Manager) Close() error {
+	close(m.done)
+	m.wg.Wait()
+	return m.flush()
+}
+
+var _default atomic.Pointer[Manager]
+
+// Default returns the quotas enforced by the servers, nil when there are no quotas.
+func Default() *Manager {
+	return _default.Load()
+}
+
+func SetDefault(m *Manager) {
+	_default.Store(m)
+}
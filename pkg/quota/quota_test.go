@@ -0,0 +1,82 @@
+package quota
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/logger"
+)
+
+func TestManager(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	path := filepath.Join(t.TempDir(), "quota.json")
+	c := &Config{
+		Path:   path,
+		WarnAt: []int{50, 90},
+		Groups: map[string]string{"staff": "1KB"},
+		Users:  map[string]string{"bob": "2KB"},
+	}
+	m, err := New(c)
+	assert.NoError(t, err)
+
+	allowed, err := m.AllowUp("alice", "staff", 600)
+	assert.True(t, allowed)
+	assert.NoError(t, err)
+	allowed, err = m.AllowDown("alice", "staff", 600)
+	assert.True(t, allowed)
+	assert.NoError(t, err)
+	_, err = m.AllowDown("alice", "staff", 600)
+	assert.ErrorIs(t, err, ErrExceeded)
+	assert.ErrorIs(t, m.Check("alice", "staff"), ErrExceeded)
+
+	// bob has his own quota, the anonymous users have none.
+	assert.NoError(t, m.Check("bob", "staff"))
+	allowed, _ = m.AllowUp("bob", "staff", 1500)
+	assert.True(t, allowed)
+	allowed, _ = m.AllowUp("", "staff", 1<<20)
+	assert.True(t, allowed)
+
+	// the usage survives a restart.
+	assert.NoError(t, m.Close())
+	m, err = New(c)
+	assert.NoError(t, err)
+	defer m.Close()
+	s := m.Snapshot()
+	assert.Len(t, s.Users, 2)
+	assert.Equal(t, &Usage{User: "alice", Group: "staff", Up: 600, Down: 600, Quota: 1024, Warned: 90, Exceeded: true}, s.Users[0])
+	assert.Equal(t, &Usage{User: "bob", Group: "staff", Up: 1500, Quota: 2048, Warned: 50}, s.Users[1])
+	assert.ErrorIs(t, m.Check("alice", "staff"), ErrExceeded)
+
+	// a new period starts with an empty usage.
+	m.reset(time.Now().AddDate(0, 1, 0))
+	assert.NoError(t, m.Check("alice", "staff"))
+}
+
+func TestManager_Throttle(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	m, err := New(&Config{Action: ActionThrottle, Throttle: "1KB", Users: map[string]string{"bob": "1KB"}})
+	assert.NoError(t, err)
+	defer m.Close()
+
+	allowed, _ := m.AllowUp("bob", "", 2000)
+	assert.True(t, allowed)
+	assert.NoError(t, m.Check("bob", ""))
+	// the throttled bucket holds one large packet.
+	allowed, err = m.AllowUp("bob", "", 65535)
+	assert.True(t, allowed)
+	assert.NoError(t, err)
+	allowed, err = m.AllowUp("bob", "", 65535)
+	assert.False(t, allowed)
+	assert.NoError(t, err)
+}
+
+func TestManager_CurrentPeriod(t *testing.T) {
+	m := &Manager{resetDay: 31}
+	assert.Equal(t, time.Date(2023, 2, 28, 0, 0, 0, 0, time.Local), m.currentPeriod(time.Date(2023, 3, 15, 12, 0, 0, 0, time.Local)))
+	assert.Equal(t, time.Date(2023, 3, 31, 0, 0, 0, 0, time.Local), m.currentPeriod(time.Date(2023, 3, 31, 0, 0, 0, 0, time.Local)))
+	m.resetDay = 1
+	assert.Equal(t, time.Date(2022, 12, 1, 0, 0, 0, 0, time.Local), m.currentPeriod(time.Date(2022, 12, 31, 23, 0, 0, 0, time.Local)))
+}
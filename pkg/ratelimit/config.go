@@ -0,0 +1,24 @@
+package ratelimit
+
+// Limit is a token bucket in each direction, sizes are like 512KB or 10MB.
+type Limit struct {
+	Up    string `yaml:"up"`    //bytes per second sent by the client, unlimited when empty
+	Down  string `yaml:"down"`  //bytes per second sent to the client, unlimited when empty
+	Burst string `yaml:"burst"` //the bucket size, one second of traffic when empty
+}
+
+type Config struct {
+	Global    Limit            `yaml:"global"`    //shared by all the clients
+	Anonymous Limit            `yaml:"anonymous"` //shared by the clients of the shared key, they have no user
+	Groups    map[string]Limit `yaml:"groups"`    //applied to every user of the group
+	Users     map[string]Limit `yaml:"users"`     //replaces the limit of the group of the user
+}
+
+// Enabled reports whether any limit is configured.
+func (c *Config) Enabled() bool {
+	return !c.Global.empty() || !c.Anonymous.empty() || len(c.Groups) > 0 || len(c.Users) > 0
+}
+
+func (l *Limit) empty() bool {
+	return l.Up == "" && l.Down == ""
+}
@@ -0,0 +1,199 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-units"
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the largest packet, a smaller bucket would never let it through.
+const minBurst = 65535
+
+// bucket is the parsed Limit, a nil direction is unlimited.
+type bucket struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+func parseLimit(l *Limit) (*bucket, error) {
+	var burst int64
+	if l.Burst != "" {
+		var err error
+		if burst, err = units.RAMInBytes(l.Burst); err != nil {
+			return nil, fmt.Errorf("invalid burst %q: %w", l.Burst, err)
+		}
+	}
+	up, err := newLimiter(l.Up, burst)
+	if err != nil {
+		return nil, err
+	}
+	down, err := newLimiter(l.Down, burst)
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{up: up, down: down}, nil
+}
+
+func newLimiter(s string, burst int64) (*rate.Limiter, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r, err := units.RAMInBytes(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate %q: %w", s, err)
+	}
+	if r <= 0 {
+		return nil, fmt.Errorf("invalid rate %q", s)
+	}
+	if burst == 0 {
+		burst = r
+	}
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return rate.NewLimiter(rate.Limit(r), int(burst)), nil
+}
+
+// Stats counts the packets dropped by the limits.
+type Stats struct {
+	DroppedUp   uint64 `json:"dropped_up"`
+	DroppedDown uint64 `json:"dropped_down"`
+}
+
+// Limiter polices the packets of the clients: a packet exceeding a limit is dropped,
+// the tcp flows of the client slow down as they would on a slower link.
+type Limiter struct {
+	global    *bucket
+	anonymous *bucket
+	groups    map[string]*Limit
+	users     map[string]*Limit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket // the bucket of every user seen, shared by its sessions
+
+	droppedUp   atomic.Uint64
+	droppedDown atomic.Uint64
+}
+
+func New(c *Config) (*Limiter, error) {
+	l := &Limiter{
+		groups:  make(map[string]*Limit, len(c.Groups)),
+		users:   make(map[string]*Limit, len(c.Users)),
+		buckets: make(map[string]*bucket),
+	}
+	var err error
+	if l.global, err = parseLimit(&c.Global); err != nil {
+		return nil, fmt.Errorf("global rate limit: %w", err)
+	}
+	if l.anonymous, err = parseLimit(&c.Anonymous); err != nil {
+		return nil, fmt.Errorf("anonymous rate limit: %w", err)
+	}
+	for name, limit := range c.Groups {
+		limit := limit
+		if _, err = parseLimit(&limit); err != nil {
+			return nil, fmt.Errorf("rate limit of group %s: %w", name, err)
+		}
+		l.groups[name] = &limit
+	}
+	for name, limit := range c.Users {
+		limit := limit
+		if _, err = parseLimit(&limit); err != nil {
+			return nil, fmt.Errorf("rate limit of user %s: %w", name, err)
+		}
+		l.users[name] = &limit
+	}
+	return l, nil
+}
+
+// userBucket returns the bucket of user, nil when neither the user nor its group is limited.
+// The clients without user share the anonymous bucket.
+func (l *Limiter) userBucket(user, group string) *bucket {
+	if user == "" {
+		return l.anonymous
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[user]; ok {
+		return b
+	}
+	limit, ok := l.users[user]
+	if !ok {
+		limit = l.groups[group]
+	}
+	var b *bucket
+	if limit != nil {
+		// the limits were checked by New.
+		b, _ = parseLimit(limit)
+	}
+	l.buckets[user] = b
+	return b
+}
+
+// AllowUp reports whether a packet of n bytes sent by user may enter.
+func (l *Limiter) AllowUp(user, group string, n int) bool {
+	var own *rate.Limiter
+	if b := l.userBucket(user, group); b != nil {
+		own = b.up
+	}
+	if allow(own, l.global.up, n) {
+		return true
+	}
+	l.droppedUp.Add(1)
+	return false
+}
+
+// AllowDown reports whether a packet of n bytes may be sent to user.
+func (l *Limiter) AllowDown(user, group string, n int) bool {
+	var own *rate.Limiter
+	if b := l.userBucket(user, group); b != nil {
+		own = b.down
+	}
+	if allow(own, l.global.down, n) {
+		return true
+	}
+	l.droppedDown.Add(1)
+	return false
+}
+
+// allow takes n tokens from the bucket of the user and from the global one, or from none.
+// The user bucket is checked first so a user over its limit does not drain the global bucket
+// shared by the others.
+func allow(own, global *rate.Limiter, n int) bool {
+	now := time.Now()
+	var r *rate.Reservation
+	if own != nil {
+		if r = own.ReserveN(now, n); !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			return false
+		}
+	}
+	if global != nil && !global.AllowN(now, n) {
+		if r != nil {
+			r.CancelAt(now)
+		}
+		return false
+	}
+	return true
+}
+
+func (l *Limiter) Stats() *Stats {
+	return &Stats{
+		DroppedUp:   l.droppedUp.Load(),
+		DroppedDown: l.droppedDown.Load(),
+	}
+}
+
+var _default atomic.Pointer[Limiter]
+
+// Default returns the limiter enforced by the servers, nil when there are no limits.
+func Default() *Limiter {
+	return _default.Load()
+}
+
+func SetDefault(l *Limiter) {
+	_default.Store(l)
+}
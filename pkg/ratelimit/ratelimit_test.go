@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	l, err := New(&Config{
+		Groups: map[string]Limit{"staff": {Down: "64KB"}},
+		Users:  map[string]Limit{"bob": {Up: "128KB", Burst: "128KB"}},
+	})
+	assert.NoError(t, err)
+
+	// alice gets the limit of her group, the burst is one second of traffic.
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if l.AllowDown("alice", "staff", 1500) {
+			allowed++
+		}
+	}
+	assert.Equal(t, 65536/1500, allowed)
+	assert.True(t, l.AllowUp("alice", "staff", 1500))
+
+	// bob replaces the limit of his group.
+	assert.True(t, l.AllowDown("bob", "staff", 65535))
+	assert.True(t, l.AllowDown("bob", "staff", 65535))
+	assert.True(t, l.AllowUp("bob", "staff", 65535))
+	assert.True(t, l.AllowUp("bob", "staff", 65535))
+	assert.False(t, l.AllowUp("bob", "staff", 65535))
+
+	// the anonymous users are only limited by the global limit.
+	assert.True(t, l.AllowDown("", "staff", 65535))
+	assert.True(t, l.AllowDown("", "staff", 65535))
+
+	assert.Equal(t, &Stats{DroppedUp: 1, DroppedDown: 100 - 65536/1500}, l.Stats())
+
+	_, err = New(&Config{Global: Limit{Up: "fast"}})
+	assert.Error(t, err)
+}
+
+func TestLimiter_Global(t *testing.T) {
+	l, err := New(&Config{
+		Global:    Limit{Down: "128KB", Burst: "128KB"},
+		Anonymous: Limit{Down: "64KB"},
+		Users:     map[string]Limit{"bob": {Down: "64KB"}},
+	})
+	assert.NoError(t, err)
+
+	// the packets dropped by the limit of bob do not drain the global bucket.
+	assert.True(t, l.AllowDown("bob", "", 65535))
+	for i := 0; i < 10; i++ {
+		assert.False(t, l.AllowDown("bob", "", 65535))
+	}
+	assert.True(t, l.AllowDown("alice", "", 65535))
+
+	// the anonymous users share their limit.
+	l, err = New(&Config{Anonymous: Limit{Up: "64KB"}})
+	assert.NoError(t, err)
+	assert.True(t, l.AllowUp("", "", 65535))
+	assert.False(t, l.AllowUp("", "", 65535))
+	assert.True(t, l.AllowUp("alice", "", 65535))
+}
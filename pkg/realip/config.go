@@ -0,0 +1,12 @@
+package realip
+
+type Config struct {
+	ProxyProtocol bool     `yaml:"proxy_protocol"` //the connections from the trusted sources start with a PROXY protocol v1 or v2 header
+	Trusted       []string `yaml:"trusted"`        //ips and cidrs of the load balancers and proxies in front of the listeners
+	Headers       []string `yaml:"headers"`        //the headers carrying the client ip on the ws path, CF-Connecting-IP and X-Forwarded-For when empty
+}
+
+// Enabled reports whether any source is trusted.
+func (c *Config) Enabled() bool {
+	return len(c.Trusted) > 0
+}
@@ -0,0 +1,186 @@
+package realip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"gofly/pkg/logger"
+)
+
+const (
+	headerTimeout = 5 * time.Second
+	// v1MaxLength is the longest v1 header, CRLF included.
+	v1MaxLength = 107
+	// minHeader is the shortest header, "PROXY UNKNOWN\r\n", and it is also enough to tell
+	// a v2 header by its signature.
+	minHeader = 15
+)
+
+var errNoHeader = errors.New("missing PROXY protocol header")
+
+// NewListener returns a listener reading the PROXY protocol header of the connections from
+// the trusted sources, their RemoteAddr is the client sent in the header. It returns l when
+// the PROXY protocol is disabled.
+func (x *Resolver) NewListener(l net.Listener) net.Listener {
+	return x.newListener(l, false)
+}
+
+// NewRawListener is NewListener for a poller taking over the file descriptors of the
+// connections, such as nbio which only takes the *net.TCPConn: the accepted connections are
+// returned as they are and ConnAddr returns the client sent in their header, until Forget.
+func (x *Resolver) NewRawListener(l net.Listener) net.Listener {
+	return x.newListener(l, true)
+}
+
+func (x *Resolver) newListener(l net.Listener, raw bool) net.Listener {
+	if !x.proxyProtocol {
+		return l
+	}
+	pl := &listener{Listener: l, x: x, raw: raw, conns: make(chan net.Conn), done: make(chan struct{})}
+	go pl.run()
+	return pl
+}
+
+// ConnAddr returns the client sent in the header of the connection from addr accepted by a
+// raw listener, or addr.
+func (x *Resolver) ConnAddr(addr string) string {
+	if v, ok := x.proxied.Load(addr); ok {
+		return v.(string)
+	}
+	return addr
+}
+
+// Forget drops the client of the connection from addr, once it is closed.
+func (x *Resolver) Forget(addr string) {
+	x.proxied.Delete(addr)
+}
+
+type listener struct {
+	net.Listener
+	x   *Resolver
+	raw bool
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+// run accepts the connections and reads their headers concurrently, so that a slow source
+// does not delay the others.
+func (l *listener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.once.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+		if !l.x.Trusted(conn.RemoteAddr().String()) {
+			l.deliver(conn)
+			continue
+		}
+		go func() {
+			remote, err := readHeader(conn)
+			if err != nil {
+				logger.Logger.Sugar().Debugf("proxy protocol from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			if !l.raw {
+				l.deliver(&proxiedConn{Conn: conn, remote: remote})
+				return
+			}
+			addr := conn.RemoteAddr().String()
+			l.x.proxied.Store(addr, remote.String())
+			if !l.deliver(conn) {
+				l.x.Forget(addr)
+			}
+		}()
+	}
+}
+
+// deliver hands conn to Accept, it reports false when conn was closed as the listener is.
+func (l *listener) deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		conn.Close()
+		return false
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// readHeader reads the header of conn without reading past it and returns the client it sends:
+// the connection may be handed to a poller reading its file descriptor, which would miss any
+// byte buffered here.
+func readHeader(conn net.Conn) (net.Addr, error) {
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	b := make([]byte, minHeader, v1MaxLength)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(b, proxyproto.SIGV2):
+		// the signature, the version and command, the family and the length of the addresses.
+		b = append(b, 0)
+		if _, err := io.ReadFull(conn, b[minHeader:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(b[14:16]))
+		b = append(b, make([]byte, length)...)
+		if _, err := io.ReadFull(conn, b[16:]); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(b, proxyproto.SIGV1):
+		one := make([]byte, 1)
+		for b[len(b)-1] != '\n' {
+			if len(b) == v1MaxLength {
+				return nil, proxyproto.ErrVersion1HeaderTooLong
+			}
+			if _, err := io.ReadFull(conn, one); err != nil {
+				return nil, err
+			}
+			b = append(b, one[0])
+		}
+	default:
+		return nil, errNoHeader
+	}
+	h, err := proxyproto.Read(bufio.NewReaderSize(bytes.NewReader(b), len(b)))
+	if err != nil {
+		return nil, err
+	}
+	if h.Command.IsProxy() && h.SourceAddr != nil {
+		return h.SourceAddr, nil
+	}
+	return conn.RemoteAddr(), nil
+}
+
+// proxiedConn is a connection whose header was read.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
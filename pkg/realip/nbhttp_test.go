@@ -0,0 +1,87 @@
+//go:build !race
+
+// The pollers of nbio hand the connections over through epoll, which the race detector does
+// not see.
+
+package realip
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesismal/nbio/nbhttp"
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/logger"
+)
+
+func TestResolver_NewRawListener(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	x, err := New(&Config{ProxyProtocol: true, Trusted: []string{"127.0.0.1"}})
+	assert.NoError(t, err)
+	var addr string
+	var mu sync.Mutex
+	opened := map[string]string{}
+	svr := nbhttp.NewServer(nbhttp.Config{
+		Network: "tcp",
+		Addrs:   []string{"127.0.0.1:0"},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, x.ClientAddr(r))
+		}),
+		Listen: func(network, address string) (net.Listener, error) {
+			l, err := net.Listen(network, address)
+			if err != nil {
+				return nil, err
+			}
+			addr = l.Addr().String()
+			return x.NewRawListener(l), nil
+		},
+	})
+	svr.OnOpen(func(c net.Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		opened[c.RemoteAddr().String()] = x.ConnAddr(c.RemoteAddr().String())
+	})
+	svr.OnClose(func(c net.Conn, err error) {
+		x.Forget(c.RemoteAddr().String())
+	})
+	assert.NoError(t, svr.Start())
+	defer svr.Stop()
+
+	client, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer client.Close()
+	h := &proxyproto.Header{
+		Version:           1,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: proxyproto.TCPv4,
+		SourceAddr:        &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 4000},
+		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80},
+	}
+	header, err := h.Format()
+	assert.NoError(t, err)
+	_, err = client.Write(append(header, "GET / HTTP/1.1\r\nHost: gofly\r\n\r\n"...))
+	assert.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if assert.NoError(t, err) {
+		b, err := io.ReadAll(io.LimitReader(res.Body, res.ContentLength))
+		assert.NoError(t, err)
+		assert.Equal(t, "203.0.113.9:4000", string(b))
+	}
+	mu.Lock()
+	assert.Equal(t, "203.0.113.9:4000", opened[client.LocalAddr().String()])
+	mu.Unlock()
+
+	// the client is forgotten once its connection is closed.
+	client.Close()
+	assert.Eventually(t, func() bool {
+		return x.ConnAddr(client.LocalAddr().String()) == client.LocalAddr().String()
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,148 @@
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var defaultHeaders = []string{"CF-Connecting-IP", "X-Forwarded-For"}
+
+// Resolver finds the address of the clients behind the trusted load balancers and proxies.
+type Resolver struct {
+	proxyProtocol bool
+	trusted       []netip.Prefix
+	headers       []string
+
+	proxied sync.Map // the remote address of the connections accepted by a raw listener to their client
+}
+
+func New(c *Config) (*Resolver, error) {
+	x := &Resolver{proxyProtocol: c.ProxyProtocol, headers: c.Headers}
+	if len(x.headers) == 0 {
+		x.headers = defaultHeaders
+	}
+	for _, s := range c.Trusted {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %w", err)
+		}
+		x.trusted = append(x.trusted, p)
+	}
+	return x, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func (x *Resolver) isTrusted(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range x.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Trusted reports whether the ip of addr, an ip:port, is a trusted proxy.
+func (x *Resolver) Trusted(addr string) bool {
+	ap, err := netip.ParseAddrPort(addr)
+	return err == nil && x.isTrusted(ap.Addr())
+}
+
+// ClientAddr returns the address of the client of r: the ip sent in the headers when r comes
+// from a trusted proxy, with the port 0, or the remote address of r.
+func (x *Resolver) ClientAddr(r *http.Request) string {
+	remote := x.ConnAddr(r.RemoteAddr)
+	if !x.Trusted(remote) {
+		return remote
+	}
+	for _, name := range x.headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		// the proxies append the address of their client, the rightmost untrusted one is the client.
+		ips := strings.Split(strings.Join(values, ","), ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip, err := netip.ParseAddr(strings.TrimSpace(ips[i]))
+			if err != nil {
+				break
+			}
+			if i == 0 || !x.isTrusted(ip) {
+				return netip.AddrPortFrom(ip.Unmap(), 0).String()
+			}
+		}
+	}
+	return remote
+}
+
+var _default atomic.Pointer[Resolver]
+
+// Default returns the resolver of the servers, nil when no proxy is trusted.
+func Default() *Resolver {
+	return _default.Load()
+}
+
+func SetDefault(x *Resolver) {
+	_default.Store(x)
+}
+
+// Trusted reports whether addr is a trusted proxy of the default resolver, if any.
+func Trusted(addr string) bool {
+	x := Default()
+	return x != nil && x.Trusted(addr)
+}
+
+// ClientAddr returns the address of the client of r with the default resolver, if any.
+func ClientAddr(r *http.Request) string {
+	if x := Default(); x != nil {
+		return x.ClientAddr(r)
+	}
+	return r.RemoteAddr
+}
+
+// NewListener returns l reading the PROXY protocol headers with the default resolver, if any.
+func NewListener(l net.Listener) net.Listener {
+	if x := Default(); x != nil {
+		return x.NewListener(l)
+	}
+	return l
+}
+
+// NewRawListener is NewListener for a poller, see Resolver.NewRawListener.
+func NewRawListener(l net.Listener) net.Listener {
+	if x := Default(); x != nil {
+		return x.NewRawListener(l)
+	}
+	return l
+}
+
+// ConnAddr returns the client of the connection from addr with the default resolver, if any.
+func ConnAddr(addr string) string {
+	if x := Default(); x != nil {
+		return x.ConnAddr(addr)
+	}
+	return addr
+}
+
+// Forget drops the client of the connection from addr in the default resolver, if any.
+func Forget(addr string) {
+	if x := Default(); x != nil {
+		x.Forget(addr)
+	}
+}
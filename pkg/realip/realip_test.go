@@ -0,0 +1,77 @@
+package realip
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/logger"
+)
+
+func TestResolver_ClientAddr(t *testing.T) {
+	x, err := New(&Config{Trusted: []string{"10.0.0.0/8"}})
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7, 10.0.0.2")
+	assert.Equal(t, "198.51.100.7:0", x.ClientAddr(r))
+
+	r.Header.Set("CF-Connecting-IP", "2001:db8::1")
+	assert.Equal(t, "[2001:db8::1]:0", x.ClientAddr(r))
+
+	// the headers of an untrusted peer are ignored.
+	r.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "192.0.2.1:1234", x.ClientAddr(r))
+}
+
+func TestResolver_NewListener(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	x, err := New(&Config{ProxyProtocol: true, Trusted: []string{"127.0.0.1"}})
+	assert.NoError(t, err)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	l := x.NewListener(inner)
+	defer l.Close()
+
+	for _, version := range []byte{1, 2} {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		assert.NoError(t, err)
+		h := &proxyproto.Header{
+			Version:           version,
+			Command:           proxyproto.PROXY,
+			TransportProtocol: proxyproto.TCPv4,
+			SourceAddr:        &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 4000},
+			DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443},
+		}
+		header, err := h.Format()
+		assert.NoError(t, err)
+		// the header and the first bytes of the client arrive together.
+		_, err = client.Write(append(header, "hello"...))
+		assert.NoError(t, err)
+
+		conn, err := l.Accept()
+		assert.NoError(t, err)
+		assert.Equal(t, "203.0.113.9:4000", conn.RemoteAddr().String())
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		conn.Close()
+		client.Close()
+	}
+
+	// a trusted source without a header is refused.
+	client, err := net.Dial("tcp", inner.Addr().String())
+	assert.NoError(t, err)
+	client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	b := make([]byte, 1)
+	_, err = client.Read(b)
+	assert.Error(t, err)
+	client.Close()
+}
@@ -0,0 +1,188 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session describes a client connected to one of the inbound servers.
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	Group      string    `json:"group"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr net.Addr  `json:"-"`
+	Start      time.Time `json:"start"`
+
+	mutex sync.Mutex
+	ips   []string
+	end   time.Time
+
+	up   atomic.Uint64
+	down atomic.Uint64
+
+	kick func(error)
+}
+
+func New(user, group, protocol string, remoteAddr net.Addr) *Session {
+	return &Session{
+		ID:         uuid.NewString(),
+		User:       user,
+		Group:      group,
+		Protocol:   protocol,
+		RemoteAddr: remoteAddr,
+		Start:      time.Now(),
+	}
+}
+
+// Client returns the remote address of the session as a string.
+func (s *Session) Client() string {
+	if s.RemoteAddr == nil {
+		return ""
+	}
+	return s.RemoteAddr.String()
+}
+
+// IPs returns the virtual addresses bound to the session.
+func (s *Session) IPs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.ips...)
+}
+
+// ErrKicked is the reason of a session closed by an administrator.
+var ErrKicked = errors.New("kicked by an administrator")
+
+// OnKick sets the function disconnecting the client of s.
+func (s *Session) OnKick(f func(error)) {
+	s.mutex.Lock()
+	s.kick = f
+	s.mutex.Unlock()
+}
+
+// Kick disconnects the client of s, it reports false when s can not be kicked.
+func (s *Session) Kick() bool {
+	return s.Disconnect(ErrKicked)
+}
+
+// Disconnect disconnects the client of s for the reason err, it reports false when s can not
+// be disconnected.
+func (s *Session) Disconnect(err error) bool {
+	s.mutex.Lock()
+	kick := s.kick
+	s.mutex.Unlock()
+	if kick == nil {
+		return false
+	}
+	kick(err)
+	return true
+}
+
+// AddUp accounts n bytes sent by the client.
+func (s *Session) AddUp(n int) {
+	s.up.Add(uint64(n))
+}
+
+// AddDown accounts n bytes sent to the client.
+func (s *Session) AddDown(n int) {
+	s.down.Add(uint64(n))
+}
+
+// Up returns the bytes sent by the client.
+func (s *Session) Up() uint64 {
+	return s.up.Load()
+}
+
+// Down returns the bytes sent to the client.
+func (s *Session) Down() uint64 {
+	return s.down.Load()
+}
+
+// End returns the time the session ended, zero while it is open.
+func (s *Session) End() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.end
+}
+
+// _sessions maps a virtual address to the session which owns it.
+var _sessions sync.Map
+
+// Bind records that the virtual address ip belongs to s.
+func Bind(ip string, s *Session) {
+	if v, ok := _sessions.Load(ip); ok && v.(*Session) == s {
+		return
+	}
+	_sessions.Store(ip, s)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// an address taken back from another session is already listed.
+	for _, v := range s.ips {
+		if v == ip {
+			return
+		}
+	}
+	s.ips = append(s.ips, ip)
+}
+
+// Unbind removes every virtual address bound to s.
+func Unbind(s *Session) {
+	for _, ip := range s.IPs() {
+		_sessions.CompareAndDelete(ip, s)
+	}
+}
+
+// Close ends s: its virtual addresses are unbound and s is passed to the recorder.
+func Close(s *Session) {
+	s.mutex.Lock()
+	closed := !s.end.IsZero()
+	if !closed {
+		s.end = time.Now()
+	}
+	s.mutex.Unlock()
+	if closed {
+		return
+	}
+	Unbind(s)
+	if r, ok := _recorder.Load().(func(*Session)); ok {
+		r(s)
+	}
+}
+
+// _recorder receives every closed session.
+var _recorder atomic.Value
+
+// SetRecorder sets the function receiving every closed session.
+func SetRecorder(r func(*Session)) {
+	_recorder.Store(r)
+}
+
+// All returns the open sessions bound to a virtual address.
+func All() []*Session {
+	seen := make(map[*Session]bool)
+	var all []*Session
+	_sessions.Range(func(_, v any) bool {
+		if s := v.(*Session); !seen[s] {
+			seen[s] = true
+			all = append(all, s)
+		}
+		return true
+	})
+	return all
+}
+
+// Lookup returns the session owning the virtual address ip, or nil.
+func Lookup(ip net.IP) *Session {
+	if ip == nil {
+		return nil
+	}
+	if v, ok := _sessions.Load(ip.String()); ok {
+		return v.(*Session)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package sniff
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "CONNECT ", "PATCH ", "TRACE "}
+
+// HTTP returns the Host header of a plain http request.
+func HTTP(b []byte) (string, error) {
+	if !isHTTPRequest(b) {
+		return "", ErrNotMatch
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(b)
+	}
+	lines := strings.Split(string(b[:end]), "\r\n")
+	// the last line may be truncated unless the header is complete
+	complete := end < len(b)
+	for i, line := range lines[1:] {
+		if !complete && i == len(lines)-2 {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			return "", ErrNotMatch
+		}
+		return strings.ToLower(host), nil
+	}
+	if complete {
+		return "", ErrNotMatch
+	}
+	return "", ErrIncomplete
+}
+
+func isHTTPRequest(b []byte) bool {
+	for _, m := range httpMethods {
+		n := len(m)
+		if len(b) < n {
+			n = len(b)
+		}
+		if n > 0 && string(b[:n]) == m[:n] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	quicVersion1       = 0x00000001
+	quicVersionDraft29 = 0xff00001d
+
+	quicFramePadding = 0x00
+	quicFramePing    = 0x01
+	quicFrameCrypto  = 0x06
+)
+
+var (
+	quicSaltV1      = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicSaltDraft29 = []byte{0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97, 0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99}
+)
+
+// QUIC returns the server name indication of the ClientHello carried by a QUIC Initial packet (RFC 9001).
+func QUIC(b []byte) (string, error) {
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 || b[0]&0x30 != 0 {
+		return "", ErrNotMatch
+	}
+	var salt []byte
+	switch binary.BigEndian.Uint32(b[1:5]) {
+	case quicVersion1:
+		salt = quicSaltV1
+	case quicVersionDraft29:
+		salt = quicSaltDraft29
+	default:
+		return "", ErrNotMatch
+	}
+	r := reader(b[5:])
+	dcid, ok := r.vector(1)
+	if !ok || !r.skipVector(1) {
+		return "", ErrNotMatch
+	}
+	tokenLength, ok := r.varint()
+	if !ok || !r.skip(int(tokenLength)) {
+		return "", ErrNotMatch
+	}
+	length, ok := r.varint()
+	if !ok || uint64(len(r)) < length || length < 20 {
+		return "", ErrNotMatch
+	}
+	pnOffset := len(b) - len(r)
+
+	key, iv, hp := quicClientInitialKeys(salt, dcid)
+
+	// remove the header protection on a copy of the packet
+	packet := append([]byte(nil), b[:pnOffset+int(length)]...)
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return "", err
+	}
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	pnLength := int(packet[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLength; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(packet[pnOffset+i])
+	}
+
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	header := packet[:pnOffset+pnLength]
+	payload, err := aead.Open(nil, nonce, packet[pnOffset+pnLength:], header)
+	if err != nil {
+		return "", ErrNotMatch
+	}
+
+	crypto, err := quicCryptoData(payload)
+	if err != nil {
+		return "", err
+	}
+	return clientHello(crypto)
+}
+
+// quicCryptoData reassembles the contiguous CRYPTO stream data starting at offset 0.
+func quicCryptoData(payload []byte) ([]byte, error) {
+	var data []byte
+	var filled []bool
+	r := reader(payload)
+	for len(r) > 0 {
+		typ, _ := r.varint()
+		switch typ {
+		case quicFramePadding, quicFramePing:
+			continue
+		case quicFrameCrypto:
+			offset, ok1 := r.varint()
+			length, ok2 := r.varint()
+			if !ok1 || !ok2 || uint64(len(r)) < length || offset+length > 1<<16 {
+				return nil, ErrNotMatch
+			}
+			end := int(offset + length)
+			if end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+				filled = append(filled, make([]bool, end-len(filled))...)
+			}
+			copy(data[offset:end], r[:length])
+			for i := int(offset); i < end; i++ {
+				filled[i] = true
+			}
+			r = r[length:]
+		default:
+			// other frames are not expected before the ClientHello, stop here
+			r = nil
+		}
+	}
+	n := 0
+	for n < len(filled) && filled[n] {
+		n++
+	}
+	if n == 0 {
+		return nil, ErrNotMatch
+	}
+	return data[:n], nil
+}
+
+func quicClientInitialKeys(salt, dcid []byte) (key, iv, hp []byte) {
+	initialSecret := hkdf.Extract(sha256.New, dcid, salt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", 32)
+	key = hkdfExpandLabel(clientSecret, "quic key", 16)
+	iv = hkdfExpandLabel(clientSecret, "quic iv", 12)
+	hp = hkdfExpandLabel(clientSecret, "quic hp", 16)
+	return
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label of TLS 1.3 with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(sha256.New, secret, info), out)
+	return out
+}
+
+// varint reads a QUIC variable-length integer (RFC 9000 16).
+func (r *reader) varint() (uint64, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	n := 1 << ((*r)[0] >> 6)
+	if len(*r) < n {
+		return 0, false
+	}
+	v := uint64((*r)[0] & 0x3f)
+	for _, c := range (*r)[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	*r = (*r)[n:]
+	return v, true
+}
@@ -0,0 +1,43 @@
+package sniff
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrIncomplete is returned when more data is needed to decide.
+	ErrIncomplete = errors.New("incomplete data")
+
+	// ErrNotMatch is returned when the data is not of the sniffed protocol.
+	ErrNotMatch = errors.New("protocol not match")
+)
+
+type Config struct {
+	Enable              bool          `yaml:"enable"`
+	Timeout             time.Duration `yaml:"timeout"`              //how long to wait for the first bytes of a flow
+	OverrideDestination bool          `yaml:"override_destination"` //dial the sniffed domain instead of the ip
+}
+
+// Stream returns the domain name found in the first bytes of a tcp flow.
+func Stream(b []byte) (string, error) {
+	var incomplete bool
+	for _, f := range []func([]byte) (string, error){TLS, HTTP} {
+		host, err := f(b)
+		if err == nil {
+			return host, nil
+		}
+		if err == ErrIncomplete {
+			incomplete = true
+		}
+	}
+	if incomplete {
+		return "", ErrIncomplete
+	}
+	return "", ErrNotMatch
+}
+
+// Packet returns the domain name found in the first datagram of a udp flow.
+func Packet(b []byte) (string, error) {
+	return QUIC(b)
+}
@@ -0,0 +1,99 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func clientHelloRecord(t *testing.T, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go tls.Client(c1, &tls.Config{ServerName: serverName}).Handshake()
+	buf := make([]byte, 4096)
+	n, err := c2.Read(buf)
+	assert.NoError(t, err)
+	c1.Close()
+	return buf[:n]
+}
+
+func TestTLS(t *testing.T) {
+	record := clientHelloRecord(t, "Example.COM")
+	host, err := TLS(record)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", host)
+
+	_, err = TLS(record[:40])
+	assert.Equal(t, ErrIncomplete, err)
+	_, err = TLS([]byte("SSH-2.0-OpenSSH_9.0\r\n"))
+	assert.Equal(t, ErrNotMatch, err)
+}
+
+func TestHTTP(t *testing.T) {
+	host, err := Stream([]byte("GET / HTTP/1.1\r\nUser-Agent: curl\r\nHost: www.example.com:8080\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "www.example.com", host)
+
+	_, err = Stream([]byte("GET / HTTP/1.1\r\nHo"))
+	assert.Equal(t, ErrIncomplete, err)
+	_, err = Stream([]byte("GET / HTTP/1.0\r\n\r\n"))
+	assert.Equal(t, ErrNotMatch, err)
+}
+
+func TestQUICClientInitialKeys(t *testing.T) {
+	// RFC 9001 A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	key, iv, hp := quicClientInitialKeys(quicSaltV1, dcid)
+	assert.Equal(t, "1f369613dd76d5467730efcbe3b1a22d", hex.EncodeToString(key))
+	assert.Equal(t, "fa044b2f42a3fd3b46fb255c", hex.EncodeToString(iv))
+	assert.Equal(t, "9f50449e04a0e810283a1e9933adedd2", hex.EncodeToString(hp))
+}
+
+// sealQUICInitial builds a protected client Initial packet carrying crypto in a single CRYPTO frame.
+func sealQUICInitial(dcid, crypto []byte) []byte {
+	frame := append([]byte{quicFrameCrypto, 0x00, 0x40 | byte(len(crypto)>>8), byte(len(crypto))}, crypto...)
+	for len(frame) < 1162 {
+		frame = append(frame, quicFramePadding)
+	}
+	pnLength := 4
+	length := pnLength + len(frame) + 16
+	header := []byte{0xc0 | byte(pnLength-1), 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, 0, 0, 0x40|byte(length>>8), byte(length), 0, 0, 0, 2)
+
+	key, iv, hp := quicClientInitialKeys(quicSaltV1, dcid)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := append([]byte(nil), iv...)
+	nonce[len(nonce)-1] ^= 2
+	packet := aead.Seal(append([]byte(nil), header...), nonce, frame, header)
+
+	pnOffset := len(header) - pnLength
+	block, _ = aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLength; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func TestQUIC(t *testing.T) {
+	record := clientHelloRecord(t, "quic.example.com")
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	packet := sealQUICInitial(dcid, record[recordHeaderLength:])
+
+	host, err := Packet(packet)
+	assert.NoError(t, err)
+	assert.Equal(t, "quic.example.com", host)
+
+	packet[len(packet)-1] ^= 0xff
+	_, err = Packet(packet)
+	assert.Equal(t, ErrNotMatch, err)
+}
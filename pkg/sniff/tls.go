@@ -0,0 +1,144 @@
+package sniff
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	recordTypeHandshake     = 0x16
+	handshakeClientHello    = 0x01
+	extensionServerName     = 0x0000
+	serverNameTypeHostName  = 0x00
+	recordHeaderLength      = 5
+	handshakeHeaderLength   = 4
+	clientHelloRandomLength = 32
+)
+
+// TLS returns the server name indication of a tls ClientHello record.
+func TLS(b []byte) (string, error) {
+	if len(b) < recordHeaderLength {
+		return "", ErrIncomplete
+	}
+	if b[0] != recordTypeHandshake || b[1] != 0x03 {
+		return "", ErrNotMatch
+	}
+	length := int(binary.BigEndian.Uint16(b[3:5]))
+	b = b[recordHeaderLength:]
+	if len(b) > length {
+		b = b[:length]
+	}
+	return clientHello(b)
+}
+
+// clientHello returns the server name indication of a ClientHello handshake message,
+// ErrIncomplete is returned when b is truncated.
+func clientHello(b []byte) (string, error) {
+	if len(b) < handshakeHeaderLength {
+		return "", ErrIncomplete
+	}
+	if b[0] != handshakeClientHello {
+		return "", ErrNotMatch
+	}
+	length := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[handshakeHeaderLength:]
+	if len(b) < length {
+		return "", ErrIncomplete
+	}
+	r := reader(b[:length])
+	// legacy version and random
+	if !r.skip(2 + clientHelloRandomLength) {
+		return "", ErrNotMatch
+	}
+	// session id, cipher suites and compression methods
+	if !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return "", ErrNotMatch
+	}
+	extensions, ok := r.vector(2)
+	if !ok {
+		return "", ErrNotMatch
+	}
+	for len(extensions) > 0 {
+		typ, ok := extensions.uint16()
+		if !ok {
+			return "", ErrNotMatch
+		}
+		data, ok := extensions.vector(2)
+		if !ok {
+			return "", ErrNotMatch
+		}
+		if typ != extensionServerName {
+			continue
+		}
+		list, ok := data.vector(2)
+		if !ok {
+			return "", ErrNotMatch
+		}
+		for len(list) > 0 {
+			nameType, ok := list.uint8()
+			if !ok {
+				return "", ErrNotMatch
+			}
+			name, ok := list.vector(2)
+			if !ok {
+				return "", ErrNotMatch
+			}
+			if nameType == serverNameTypeHostName && len(name) > 0 {
+				return strings.ToLower(strings.TrimSuffix(string(name), ".")), nil
+			}
+		}
+	}
+	return "", ErrNotMatch
+}
+
+// reader reads big endian fields off the front of a byte slice.
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector reads a vector prefixed by a length of size bytes.
+func (r *reader) vector(size int) (reader, bool) {
+	if len(*r) < size {
+		return nil, false
+	}
+	var n int
+	for _, c := range (*r)[:size] {
+		n = n<<8 | int(c)
+	}
+	*r = (*r)[size:]
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *reader) skipVector(size int) bool {
+	_, ok := r.vector(size)
+	return ok
+}
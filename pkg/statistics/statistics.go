@@ -1,10 +1,13 @@
 package statistics
 
 import (
-	"net"
+	"context"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"gofly/pkg/session"
 )
 
 type Time time.Time
@@ -14,11 +17,30 @@ func (t Time) String() string {
 }
 
 func (t Time) MarshalJSON() ([]byte, error) {
+	if time.Time(t).IsZero() {
+		return []byte(`""`), nil
+	}
 	return []byte("\"" + t.String() + "\""), nil
 }
 
+// The resolutions of the traffic series.
+const (
+	Second = time.Second
+	Minute = time.Minute
+	Hour   = time.Hour
+)
+
+// maxOffline is the number of closed sessions kept in the snapshots.
+const maxOffline = 100
+
+// ClientData is the traffic of a session, RX is sent by the client and TX is sent to it.
 type ClientData struct {
-	Addr        net.Addr `json:"addr"`
+	ID          string   `json:"id"`
+	User        string   `json:"user"`
+	Group       string   `json:"group"`
+	Protocol    string   `json:"protocol"`
+	Addr        string   `json:"addr"`
+	IPs         []string `json:"ips"`
 	OnlineTime  Time     `json:"online_time"`
 	OfflineTime Time     `json:"offline_time"`
 	Online      bool     `json:"online"`
@@ -26,110 +48,273 @@ type ClientData struct {
 	TX          uint64   `json:"tx"`
 }
 
-type ChartData struct {
-	mutex          sync.Mutex
-	previousRX     uint64
-	previousTX     uint64
-	transportBytes []int
-	receiveBytes   []int
-	labels         []string
-	count          int
+func newClientData(s *session.Session, online bool) *ClientData {
+	return &ClientData{
+		ID:          s.ID,
+		User:        s.User,
+		Group:       s.Group,
+		Protocol:    s.Protocol,
+		Addr:        s.Client(),
+		IPs:         s.IPs(),
+		OnlineTime:  Time(s.Start),
+		OfflineTime: Time(s.End()),
+		Online:      online,
+		RX:          s.Up(),
+		TX:          s.Down(),
+	}
+}
+
+// UserData is the traffic of the sessions of a user since the server started.
+type UserData struct {
+	User     string `json:"user"`
+	Group    string `json:"group"`
+	Online   int    `json:"online"` //the open sessions
+	Sessions int    `json:"sessions"`
+	RX       uint64 `json:"rx"`
+	TX       uint64 `json:"tx"`
 }
 
-type Statistics struct {
-	mutex             sync.Mutex
-	OnlineClientCount int
-	ClientList        []ClientData
-	RX                uint64
-	TX                uint64
-	ChartData         ChartData
+// Snapshot is the state of the statistics at a time.
+type Snapshot struct {
+	Time              Time              `json:"time"`
+	OnlineClientCount int               `json:"online_client_count"`
+	RX                uint64            `json:"rx"`
+	TX                uint64            `json:"tx"`
+	Clients           []*ClientData     `json:"clients"` //the open sessions, then the last closed ones
+	Users             []*UserData       `json:"users"`
+	Rejected          map[string]uint64 `json:"rejected"` //the connections and sessions refused by the limits, by reason
+}
+
+// Point is the traffic of an interval of a series.
+type Point struct {
+	Time Time   `json:"time"`
+	RX   uint64 `json:"rx"`
+	TX   uint64 `json:"tx"`
+}
+
+// series is a ring of the last points of a resolution.
+type series struct {
+	resolution time.Duration
+	points     []Point
+	next       int
+	full       bool
+
+	// the interval being accumulated
+	start  time.Time
+	rx, tx uint64
 }
 
-var keyMap = make(map[string]int)
+func newSeries(resolution time.Duration, size int) *series {
+	return &series{resolution: resolution, points: make([]Point, size)}
+}
 
-func (x *Statistics) IncrClientReceivedBytes(y net.Addr, n int) {
-	if i, ok := x.Contains(y); ok {
-		atomic.AddUint64(&x.ClientList[i].RX, uint64(n))
+// add accounts the traffic at t, closing the current interval when t is past it.
+func (s *series) add(t time.Time, rx, tx uint64) {
+	start := t.Truncate(s.resolution)
+	if !s.start.IsZero() && start.After(s.start) {
+		s.points[s.next] = Point{Time: Time(s.start), RX: s.rx, TX: s.tx}
+		s.next = (s.next + 1) % len(s.points)
+		s.full = s.full || s.next == 0
+		s.rx, s.tx = 0, 0
 	}
+	if s.start.IsZero() || start.After(s.start) {
+		s.start = start
+	}
+	s.rx += rx
+	s.tx += tx
 }
 
-func (x *Statistics) IncrClientTransportBytes(y net.Addr, n int) {
-	if i, ok := x.Contains(y); ok {
-		atomic.AddUint64(&x.ClientList[i].TX, uint64(n))
+// get returns the points from the oldest.
+func (s *series) get() []Point {
+	if !s.full {
+		return append([]Point(nil), s.points[:s.next]...)
 	}
+	return append(append([]Point(nil), s.points[s.next:]...), s.points[:s.next]...)
+}
+
+// Statistics is the traffic of the sessions of the inbound servers.
+type Statistics struct {
+	rx atomic.Uint64
+	tx atomic.Uint64
+
+	mu       sync.RWMutex
+	sessions map[*session.Session]struct{}
+	offline  []*ClientData        // the last closed sessions, the oldest first
+	closed   map[string]*UserData // the traffic of the closed sessions of every user
+	rejected map[string]uint64
+
+	seriesMu  sync.Mutex
+	series    []*series
+	sampledRX uint64
+	sampledTX uint64
 }
 
-func (x *Statistics) IncrReceivedBytes(n int) {
-	atomic.AddUint64(&x.RX, uint64(n))
+func New() *Statistics {
+	return &Statistics{
+		sessions: make(map[*session.Session]struct{}),
+		closed:   make(map[string]*UserData),
+		rejected: make(map[string]uint64),
+		series: []*series{
+			newSeries(Second, 1800), // 30 minutes
+			newSeries(Minute, 1440), // 1 day
+			newSeries(Hour, 720),    // 30 days
+		},
+	}
 }
 
-func (x *Statistics) IncrTransportBytes(n int) {
-	atomic.AddUint64(&x.TX, uint64(n))
+// Push records that s is online.
+func (x *Statistics) Push(s *session.Session) {
+	x.mu.Lock()
+	x.sessions[s] = struct{}{}
+	x.mu.Unlock()
 }
 
-func (x *Statistics) Contains(y net.Addr) (int, bool) {
-	if v, ok := keyMap[y.String()]; ok {
-		return v, true
+// Remove records that s is closed, its traffic is kept in the traffic of its user.
+func (x *Statistics) Remove(s *session.Session) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.sessions[s]; !ok {
+		return
+	}
+	delete(x.sessions, s)
+	u := x.closed[s.User]
+	if u == nil {
+		u = &UserData{User: s.User}
+		x.closed[s.User] = u
+	}
+	u.Group = s.Group
+	u.Sessions++
+	u.RX += s.Up()
+	u.TX += s.Down()
+	if len(x.offline) == maxOffline {
+		x.offline = append(x.offline[:0], x.offline[1:]...)
 	}
-	for i, client := range x.ClientList {
-		if client.Addr.String() == y.String() && client.Addr.Network() == y.Network() && client.Online {
-			return i, true
+	x.offline = append(x.offline, newClientData(s, false))
+}
+
+// Lookup returns the online session with the given id, or nil.
+func (x *Statistics) Lookup(id string) *session.Session {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for s := range x.sessions {
+		if s.ID == id {
+			return s
 		}
 	}
-	return -1, false
+	return nil
 }
 
-func (x *Statistics) Remove(y net.Addr) {
-	i, ok := x.Contains(y)
-	if ok {
-		x.mutex.Lock()
-		defer x.mutex.Unlock()
-		//x.OnlineClientList = append(x.OnlineClientList[:i], x.OnlineClientList[i+1:]...)
-		delete(keyMap, y.String())
-		x.OnlineClientCount--
-		x.ClientList[i].Online = false
-		x.ClientList[i].OfflineTime = Time(time.Now())
+// AddRX accounts n bytes sent by the client of s, s may be nil.
+func (x *Statistics) AddRX(s *session.Session, n int) {
+	if x != nil {
+		x.rx.Add(uint64(n))
+	}
+	if s != nil {
+		s.AddUp(n)
 	}
 }
 
-func (x *Statistics) Push(y net.Addr) {
-	if _, ok := x.Contains(y); !ok {
-		x.mutex.Lock()
-		defer x.mutex.Unlock()
-		x.ClientList = append(x.ClientList, ClientData{Addr: y, Online: true, OnlineTime: Time(time.Now())})
-		x.OnlineClientCount++
-		keyMap[y.String()] = len(x.ClientList) - 1
+// AddTX accounts n bytes sent to the client of s, s may be nil.
+func (x *Statistics) AddTX(s *session.Session, n int) {
+	if x != nil {
+		x.tx.Add(uint64(n))
+	}
+	if s != nil {
+		s.AddDown(n)
 	}
 }
 
-func (x *Statistics) AutoUpdateChartData() {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		var currentTX = x.TX //TX is the total received by all clients
-		var currentRX = x.RX //RX is the total number of transfers from all clients
-		if currentTX == 0 && currentRX == 0 {
-			continue
+// AddRejected counts a connection or a session refused for the reason err, x may be nil.
+func (x *Statistics) AddRejected(err error) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	x.rejected[err.Error()]++
+	x.mu.Unlock()
+}
+
+// Snapshot returns the traffic of every session and every user.
+func (x *Statistics) Snapshot() *Snapshot {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	snapshot := &Snapshot{
+		Time:              Time(time.Now()),
+		OnlineClientCount: len(x.sessions),
+		RX:                x.rx.Load(),
+		TX:                x.tx.Load(),
+		Clients:           make([]*ClientData, 0, len(x.sessions)+len(x.offline)),
+		Rejected:          make(map[string]uint64, len(x.rejected)),
+	}
+	for reason, n := range x.rejected {
+		snapshot.Rejected[reason] = n
+	}
+	users := make(map[string]*UserData, len(x.closed))
+	for name, u := range x.closed {
+		c := *u
+		users[name] = &c
+	}
+	online := make([]*ClientData, 0, len(x.sessions))
+	for s := range x.sessions {
+		c := newClientData(s, true)
+		online = append(online, c)
+		u := users[s.User]
+		if u == nil {
+			u = &UserData{User: s.User}
+			users[s.User] = u
 		}
-		x.mutex.Lock()
-		if x.ChartData.count < 1800 {
-			x.ChartData.labels = append(x.ChartData.labels, time.Now().Format("15:04:05"))
-			x.ChartData.transportBytes = append(x.ChartData.transportBytes, int(currentRX-x.ChartData.previousRX))
-			x.ChartData.receiveBytes = append(x.ChartData.receiveBytes, int(currentTX-x.ChartData.previousTX))
-			x.ChartData.count++
-		} else {
-			x.ChartData.labels = append(x.ChartData.labels[1:], time.Now().Format("15:04:05"))
-			x.ChartData.transportBytes = append(x.ChartData.transportBytes[1:], int(currentRX-x.ChartData.previousRX))
-			x.ChartData.receiveBytes = append(x.ChartData.receiveBytes[1:], int(currentTX-x.ChartData.previousTX))
+		u.Group = s.Group
+		u.Online++
+		u.Sessions++
+		u.RX += c.RX
+		u.TX += c.TX
+	}
+	sort.Slice(online, func(i, j int) bool {
+		return time.Time(online[i].OnlineTime).Before(time.Time(online[j].OnlineTime))
+	})
+	snapshot.Clients = append(append(snapshot.Clients, online...), x.offline...)
+	snapshot.Users = make([]*UserData, 0, len(users))
+	for _, u := range users {
+		snapshot.Users = append(snapshot.Users, u)
+	}
+	sort.Slice(snapshot.Users, func(i, j int) bool { return snapshot.Users[i].User < snapshot.Users[j].User })
+	return snapshot
+}
+
+// sample adds the traffic since the last sample to the series.
+func (x *Statistics) sample(t time.Time) {
+	x.seriesMu.Lock()
+	defer x.seriesMu.Unlock()
+	rx, tx := x.rx.Load(), x.tx.Load()
+	for _, s := range x.series {
+		s.add(t, rx-x.sampledRX, tx-x.sampledTX)
+	}
+	x.sampledRX, x.sampledTX = rx, tx
+}
+
+// Series returns the traffic of the last intervals of resolution, one of Second, Minute or Hour,
+// from the oldest. The interval being accumulated is not returned.
+func (x *Statistics) Series(resolution time.Duration) ([]Point, bool) {
+	x.seriesMu.Lock()
+	defer x.seriesMu.Unlock()
+	for _, s := range x.series {
+		if s.resolution == resolution {
+			return s.get(), true
 		}
-		x.mutex.Unlock()
-		x.ChartData.previousTX = currentTX
-		x.ChartData.previousRX = currentRX
 	}
+	return nil, false
 }
 
-func (x *ChartData) GetData() ([]int, []int, []string, int) {
-	x.mutex.Lock()
-	defer x.mutex.Unlock()
-	return x.transportBytes, x.receiveBytes, x.labels, x.count
+// Run samples the traffic every second until ctx is done.
+func (x *Statistics) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			x.sample(t)
+		case <-ctx.Done():
+			return
+		}
+	}
 }
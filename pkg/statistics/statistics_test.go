@@ -0,0 +1,90 @@
+package statistics
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/session"
+)
+
+func TestStatistics_Concurrent(t *testing.T) {
+	x := New()
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				x.Snapshot()
+				x.sample(time.Now())
+				x.Series(Second)
+			}
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// the reconnects from the same address are distinct sessions.
+				s := session.New("alice", "staff", "wss", addr)
+				x.Push(s)
+				x.AddRX(s, 10)
+				x.AddTX(s, 100)
+				x.Remove(s)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	online := session.New("bob", "", "wss", addr)
+	x.Push(online)
+	x.AddRX(online, 1)
+	x.AddRX(nil, 1)
+
+	s := x.Snapshot()
+	assert.Equal(t, 1, s.OnlineClientCount)
+	assert.Equal(t, uint64(8*100*10+2), s.RX)
+	assert.Equal(t, uint64(8*100*100), s.TX)
+	assert.Len(t, s.Clients, 1+maxOffline)
+	assert.True(t, s.Clients[0].Online)
+	assert.False(t, s.Clients[1].Online)
+	assert.Equal(t, []*UserData{
+		{User: "alice", Group: "staff", Sessions: 800, RX: 8000, TX: 80000},
+		{User: "bob", Online: 1, Sessions: 1, RX: 1},
+	}, s.Users)
+}
+
+func TestStatistics_Series(t *testing.T) {
+	x := New()
+	start := time.Date(2023, 6, 1, 10, 0, 0, 0, time.Local)
+	for i := 0; i < 125; i++ {
+		x.AddRX(nil, 1)
+		x.AddTX(nil, 2)
+		x.sample(start.Add(time.Duration(i) * time.Second))
+	}
+
+	seconds, ok := x.Series(Second)
+	assert.True(t, ok)
+	assert.Len(t, seconds, 124)
+	assert.Equal(t, Point{Time: Time(start), RX: 1, TX: 2}, seconds[0])
+
+	minutes, _ := x.Series(Minute)
+	assert.Equal(t, []Point{
+		{Time: Time(start), RX: 60, TX: 120},
+		{Time: Time(start.Add(time.Minute)), RX: 60, TX: 120},
+	}, minutes)
+
+	hours, _ := x.Series(Hour)
+	assert.Empty(t, hours)
+	_, ok = x.Series(time.Millisecond)
+	assert.False(t, ok)
+}
@@ -0,0 +1,334 @@
+package statistics
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"gofly/pkg/logger"
+	"gofly/pkg/session"
+)
+
+type StoreConfig struct {
+	Path          string        `yaml:"path"`           //disabled when empty
+	FlushInterval time.Duration `yaml:"flush_interval"` //1m when empty
+	RetentionDays int           `yaml:"retention_days"` //the days of session history and daily traffic kept, forever when 0
+}
+
+const (
+	defaultFlushInterval = time.Minute
+
+	// anonymousKey is the key the users authenticated by the shared key are stored under, their
+	// records have an empty user. The user names are printable, so none of them shares the key.
+	anonymousKey = "\x00"
+
+	dayLayout        = "2006-01-02"
+	sessionKeyLayout = "20060102T150405.000000000"
+)
+
+var (
+	usersBucket    = []byte("users")
+	dailyBucket    = []byte("daily")
+	sessionsBucket = []byte("sessions")
+)
+
+// UserTraffic is the traffic of a user since the store was created, the user of the clients
+// authenticated by the shared key is empty.
+type UserTraffic struct {
+	User     string    `json:"user"`
+	Group    string    `json:"group"`
+	Up       uint64    `json:"up"`
+	Down     uint64    `json:"down"`
+	Sessions uint64    `json:"sessions"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// DailyTraffic is the traffic of a user on a day.
+type DailyTraffic struct {
+	Date string `json:"date"`
+	User string `json:"user"`
+	Up   uint64 `json:"up"`
+	Down uint64 `json:"down"`
+}
+
+// SessionRecord is a closed session.
+type SessionRecord struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Group    string    `json:"group"`
+	Protocol string    `json:"protocol"`
+	Client   string    `json:"client"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Up       uint64    `json:"up"`
+	Down     uint64    `json:"down"`
+}
+
+type counters struct {
+	up   uint64
+	down uint64
+}
+
+// Store persists the traffic of the sessions to a bbolt file: the totals of every user, the
+// daily traffic of every user and the history of the sessions.
+type Store struct {
+	db            *bbolt.DB
+	flushInterval time.Duration
+	retention     time.Duration
+
+	mu      sync.Mutex
+	flushed map[*session.Session]counters // the traffic of the open sessions already written
+	closed  []*session.Session            // the sessions closed since the last flush
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func OpenStore(c *StoreConfig) (*Store, error) {
+	db, err := bbolt.Open(c.Path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{usersBucket, dailyBucket, sessionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	x := &Store{
+		db:            db,
+		flushInterval: c.FlushInterval,
+		retention:     time.Duration(c.RetentionDays) * 24 * time.Hour,
+		flushed:       make(map[*session.Session]counters),
+		done:          make(chan struct{}),
+	}
+	if x.flushInterval <= 0 {
+		x.flushInterval = defaultFlushInterval
+	}
+	x.wg.Add(1)
+	go x.run()
+	return x, nil
+}
+
+// Record keeps the closed session s until the next flush, it fits session.SetRecorder.
+func (x *Store) Record(s *session.Session) {
+	x.mu.Lock()
+	x.closed = append(x.closed, s)
+	x.mu.Unlock()
+}
+
+func (x *Store) run() {
+	defer x.wg.Done()
+	ticker := time.NewTicker(x.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := x.flush(time.Now()); err != nil {
+				logger.Logger.Sugar().Errorf("flush statistics: %v", err)
+			}
+		case <-x.done:
+			return
+		}
+	}
+}
+
+// flush writes the traffic of the sessions since the last flush, and drops the history
+// older than the retention.
+func (x *Store) flush(now time.Time) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	closed := x.closed
+	x.closed = nil
+
+	return x.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		daily := tx.Bucket(dailyBucket)
+		day := now.Format(dayLayout)
+		add := func(s *session.Session) error {
+			up, down := s.Up(), s.Down()
+			f, seen := x.flushed[s]
+			x.flushed[s] = counters{up, down}
+			if seen && up == f.up && down == f.down {
+				return nil
+			}
+			name := userKey(s)
+			var u UserTraffic
+			if err := get(users, []byte(name), &u); err != nil {
+				return err
+			}
+			u.User, u.Group, u.LastSeen = s.User, s.Group, now
+			u.Up += up - f.up
+			u.Down += down - f.down
+			if !seen {
+				u.Sessions++
+			}
+			if err := put(users, []byte(name), &u); err != nil {
+				return err
+			}
+			key := []byte(day + "/" + name)
+			d := DailyTraffic{Date: day, User: s.User}
+			if err := get(daily, key, &d); err != nil {
+				return err
+			}
+			d.Up += up - f.up
+			d.Down += down - f.down
+			return put(daily, key, &d)
+		}
+		for _, s := range session.All() {
+			if err := add(s); err != nil {
+				return err
+			}
+		}
+		sessions := tx.Bucket(sessionsBucket)
+		for _, s := range closed {
+			if err := add(s); err != nil {
+				return err
+			}
+			delete(x.flushed, s)
+			r := &SessionRecord{
+				ID:       s.ID,
+				User:     s.User,
+				Group:    s.Group,
+				Protocol: s.Protocol,
+				Client:   s.Client(),
+				Start:    s.Start,
+				End:      s.End(),
+				Up:       s.Up(),
+				Down:     s.Down(),
+			}
+			if err := put(sessions, []byte(s.Start.UTC().Format(sessionKeyLayout)+"/"+s.ID), r); err != nil {
+				return err
+			}
+		}
+		if x.retention > 0 {
+			cutoff := now.Add(-x.retention)
+			if err := purge(daily, []byte(cutoff.Format(dayLayout))); err != nil {
+				return err
+			}
+			return purge(sessions, []byte(cutoff.UTC().Format(sessionKeyLayout)))
+		}
+		return nil
+	})
+}
+
+// userKey returns the key of the user of s, bbolt refuses the empty keys.
+func userKey(s *session.Session) string {
+	if s.User == "" {
+		return anonymousKey
+	}
+	return s.User
+}
+
+// purge deletes the keys of b sorted before before.
+func purge(b *bbolt.Bucket, before []byte) error {
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, before) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func get(b *bbolt.Bucket, key []byte, v any) error {
+	if data := b.Get(key); data != nil {
+		return json.Unmarshal(data, v)
+	}
+	return nil
+}
+
+func put(b *bbolt.Bucket, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// Users returns the traffic of every user.
+func (x *Store) Users() ([]*UserTraffic, error) {
+	users := []*UserTraffic{}
+	err := x.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(_, v []byte) error {
+			u := &UserTraffic{}
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// Daily returns the daily traffic of the users from the day from to the day to included,
+// the days are formatted like 2006-01-02 and an empty bound is open.
+func (x *Store) Daily(from, to string) ([]*DailyTraffic, error) {
+	days := []*DailyTraffic{}
+	err := x.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(dailyBucket).Cursor()
+		for k, v := c.Seek([]byte(from)); k != nil; k, v = c.Next() {
+			if to != "" && string(k[:len(dayLayout)]) > to {
+				break
+			}
+			d := &DailyTraffic{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			days = append(days, d)
+		}
+		return nil
+	})
+	return days, err
+}
+
+// Sessions returns the most recent closed sessions of user, of every user when it is empty.
+func (x *Store) Sessions(user string, limit int) ([]*SessionRecord, error) {
+	sessions := []*SessionRecord{}
+	err := x.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(sessionsBucket).Cursor()
+		for k, v := c.Last(); k != nil && (limit <= 0 || len(sessions) < limit); k, v = c.Prev() {
+			r := &SessionRecord{}
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			if user == "" || r.User == user {
+				sessions = append(sessions, r)
+			}
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+// Close flushes the traffic and closes the file.
+func (x *Store) Close() error {
+	close(x.done)
+	x.wg.Wait()
+	err := x.flush(time.Now())
+	if cerr := x.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var _defaultStore atomic.Pointer[Store]
+
+// DefaultStore returns the store the sessions are persisted to, nil when there is none.
+func DefaultStore() *Store {
+	return _defaultStore.Load()
+}
+
+func SetDefaultStore(x *Store) {
+	_defaultStore.Store(x)
+}
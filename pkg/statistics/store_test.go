@@ -0,0 +1,76 @@
+package statistics
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gofly/pkg/session"
+)
+
+func TestStore(t *testing.T) {
+	c := &StoreConfig{Path: filepath.Join(t.TempDir(), "stats.db"), RetentionDays: 30}
+	x, err := OpenStore(c)
+	assert.NoError(t, err)
+	session.SetRecorder(x.Record)
+	defer session.SetRecorder(func(*session.Session) {})
+
+	alice := session.New("alice", "staff", "wss", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000})
+	session.Bind("172.16.222.10", alice)
+	anonymous := session.New("", "", "wss", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000})
+	session.Bind("172.16.222.11", anonymous)
+	defer session.Close(anonymous)
+	// a configured user may be named anonymous, it is not merged with the clients of the shared key.
+	named := session.New("anonymous", "", "wss", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 1000})
+	session.Bind("172.16.222.12", named)
+	defer session.Close(named)
+
+	now := time.Now()
+	alice.AddUp(100)
+	alice.AddDown(1000)
+	anonymous.AddDown(10)
+	named.AddDown(20)
+	assert.NoError(t, x.flush(now))
+	alice.AddUp(100)
+	session.Close(alice)
+	assert.NoError(t, x.flush(now))
+	assert.NoError(t, x.flush(now))
+
+	users, err := x.Users()
+	assert.NoError(t, err)
+	if assert.Len(t, users, 3) {
+		assert.Equal(t, &UserTraffic{Down: 10, Sessions: 1, LastSeen: users[0].LastSeen}, users[0])
+		assert.Equal(t, &UserTraffic{User: "alice", Group: "staff", Up: 200, Down: 1000, Sessions: 1, LastSeen: users[1].LastSeen}, users[1])
+		assert.Equal(t, &UserTraffic{User: "anonymous", Down: 20, Sessions: 1, LastSeen: users[2].LastSeen}, users[2])
+	}
+	days, err := x.Daily(now.Format(dayLayout), now.Format(dayLayout))
+	assert.NoError(t, err)
+	assert.Len(t, days, 3)
+
+	// the traffic survives a restart.
+	assert.NoError(t, x.Close())
+	x, err = OpenStore(c)
+	assert.NoError(t, err)
+	defer x.Close()
+	sessions, err := x.Sessions("alice", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, alice.ID, sessions[0].ID)
+		assert.Equal(t, uint64(200), sessions[0].Up)
+		assert.Equal(t, "192.0.2.1:1000", sessions[0].Client)
+	}
+
+	// the history older than the retention is dropped.
+	assert.NoError(t, x.flush(now.Add(31*24*time.Hour)))
+	sessions, err = x.Sessions("", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	days, err = x.Daily(now.Format(dayLayout), now.Format(dayLayout))
+	assert.NoError(t, err)
+	assert.Empty(t, days)
+	users, err = x.Users()
+	assert.NoError(t, err)
+	assert.Len(t, users, 3)
+}
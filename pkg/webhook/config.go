@@ -0,0 +1,17 @@
+package webhook
+
+import "time"
+
+type Hook struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"` //signs the timestamp and the body with HMAC-SHA256 in the X-Gofly-Signature header when set
+	Events []string `yaml:"events"` //the event types sent to the hook, all when empty
+}
+
+type Config struct {
+	Hooks         []Hook        `yaml:"hooks"`
+	BatchSize     int           `yaml:"batch_size"`     //the most events in a request, 20 when empty
+	BatchInterval time.Duration `yaml:"batch_interval"` //how long an event waits for others, 1s when empty
+	Retries       int           `yaml:"retries"`        //the retries of a failed request, 3 when empty and none when negative
+	Timeout       time.Duration `yaml:"timeout"`        //the timeout of a request, 10s when empty
+}
@@ -0,0 +1,259 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gofly/pkg/logger"
+)
+
+// The event types.
+const (
+	ClientConnected    = "client_connected"
+	ClientDisconnected = "client_disconnected"
+	AuthFailed         = "auth_failed"
+	QuotaExceeded      = "quota_exceeded"
+	UpstreamDown       = "upstream_down"
+	UpstreamUp         = "upstream_up"
+	ConfigReloaded     = "config_reloaded" // the tls certificate was reloaded
+)
+
+const (
+	// SignatureHeader carries sha256=<hex>, the hex HMAC-SHA256 of the timestamp, a dot and the
+	// body, keyed by the secret of the hook.
+	SignatureHeader = "X-Gofly-Signature"
+	// TimestampHeader carries the unix time the request was signed at, the receivers reject the
+	// old ones to detect the replays.
+	TimestampHeader = "X-Gofly-Timestamp"
+)
+
+const (
+	defaultBatchSize     = 20
+	defaultBatchInterval = time.Second
+	defaultRetries       = 3
+	defaultTimeout       = 10 * time.Second
+
+	// queueSize is the number of events a hook buffers, newer events are dropped when it is full.
+	queueSize = 1024
+)
+
+// Event is something that happened on the server.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	User    string    `json:"user,omitempty"`
+	Group   string    `json:"group,omitempty"`
+	Session string    `json:"session,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Batch is the body of a webhook request.
+type Batch struct {
+	Events []*Event `json:"events"`
+}
+
+type hook struct {
+	url    string
+	secret []byte
+	events map[string]bool
+	queue  chan *Event
+}
+
+// Dispatcher sends the events to the hooks, every hook has its own queue so a slow hook
+// does not delay the others.
+type Dispatcher struct {
+	hooks         []*hook
+	batchSize     int
+	batchInterval time.Duration
+	retries       int
+	client        *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(c *Config) (*Dispatcher, error) {
+	d := &Dispatcher{
+		batchSize:     c.BatchSize,
+		batchInterval: c.BatchInterval,
+		retries:       c.Retries,
+		client:        &http.Client{Timeout: c.Timeout},
+	}
+	if d.batchSize <= 0 {
+		d.batchSize = defaultBatchSize
+	}
+	if d.batchInterval <= 0 {
+		d.batchInterval = defaultBatchInterval
+	}
+	if d.retries == 0 {
+		d.retries = defaultRetries
+	}
+	if d.client.Timeout <= 0 {
+		d.client.Timeout = defaultTimeout
+	}
+	for i, h := range c.Hooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("webhook %d: empty url", i)
+		}
+		parsed := &hook{url: h.URL, secret: []byte(h.Secret), queue: make(chan *Event, queueSize)}
+		if len(h.Events) > 0 {
+			parsed.events = make(map[string]bool, len(h.Events))
+			for _, e := range h.Events {
+				parsed.events[e] = true
+			}
+		}
+		d.hooks = append(d.hooks, parsed)
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, h := range d.hooks {
+		d.wg.Add(1)
+		go d.run(h)
+	}
+	return d, nil
+}
+
+// Emit queues e for the hooks subscribed to its type, it never blocks.
+func (d *Dispatcher) Emit(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, h := range d.hooks {
+		if h.events != nil && !h.events[e.Type] {
+			continue
+		}
+		select {
+		case h.queue <- e:
+		default:
+			logger.Logger.Sugar().Warnf("webhook %s queue is full, %s event dropped", h.url, e.Type)
+		}
+	}
+}
+
+// run sends the events of h in batches, a batch is sent when it is full or batchInterval
+// after its first event.
+func (d *Dispatcher) run(h *hook) {
+	defer d.wg.Done()
+	var batch []*Event
+	var timer <-chan time.Time
+	flush := func() {
+		if len(batch) > 0 {
+			d.send(h, batch)
+			batch, timer = nil, nil
+		}
+	}
+	for {
+		select {
+		case e := <-h.queue:
+			batch = append(batch, e)
+			if len(batch) >= d.batchSize {
+				flush()
+			} else if timer == nil {
+				timer = time.After(d.batchInterval)
+			}
+		case <-timer:
+			flush()
+		case <-d.ctx.Done():
+			// send what is queued before stopping.
+			for {
+				select {
+				case e := <-h.queue:
+					batch = append(batch, e)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts batch to h, retrying with a growing delay.
+func (d *Dispatcher) send(h *hook, batch []*Event) {
+	body, err := json.Marshal(&Batch{Events: batch})
+	if err != nil {
+		logger.Logger.Sugar().Errorf("webhook %s: %v", h.url, err)
+		return
+	}
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if err = d.post(h, body); err == nil {
+			return
+		}
+		if attempt >= d.retries || d.ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-d.ctx.Done():
+			// one last attempt is made while stopping.
+		}
+	}
+	logger.Logger.Sugar().Errorf("webhook %s: %d events dropped: %v", h.url, len(batch), err)
+}
+
+func (d *Dispatcher) post(h *hook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(h.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(h.secret, timestamp, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the value of SignatureHeader for body sent at timestamp.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close sends the queued events and stops the dispatcher.
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+var _default atomic.Pointer[Dispatcher]
+
+// Default returns the dispatcher of the server, nil when there are no webhooks.
+func Default() *Dispatcher {
+	return _default.Load()
+}
+
+func SetDefault(d *Dispatcher) {
+	_default.Store(d)
+}
+
+// Emit queues e to the default dispatcher, if any.
+func Emit(e *Event) {
+	if d := Default(); d != nil {
+		d.Emit(e)
+	}
+}
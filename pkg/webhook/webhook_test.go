@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gofly/pkg/logger"
+)
+
+func TestDispatcher(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	var mu sync.Mutex
+	var received []*Event
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(TimestampHeader)
+		sent, err := strconv.ParseInt(timestamp, 10, 64)
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), time.Unix(sent, 0), time.Minute)
+		assert.Equal(t, Sign([]byte("demo_secret"), timestamp, body), r.Header.Get(SignatureHeader))
+		mu.Lock()
+		defer mu.Unlock()
+		// the first request fails and is retried.
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var b Batch
+		assert.NoError(t, json.Unmarshal(body, &b))
+		received = append(received, b.Events...)
+	}))
+	defer receiver.Close()
+
+	d, err := New(&Config{
+		Hooks: []Hook{{
+			URL:    receiver.URL,
+			Secret: "demo_secret",
+			Events: []string{ClientConnected, QuotaExceeded},
+		}},
+		BatchSize:     2,
+		BatchInterval: 50 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	d.Emit(&Event{Type: ClientConnected, User: "alice"})
+	d.Emit(&Event{Type: AuthFailed, Client: "192.0.2.1:1000"})
+	d.Emit(&Event{Type: QuotaExceeded, User: "alice"})
+	d.Emit(&Event{Type: ClientConnected, User: "bob"})
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	d.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "alice", received[0].User)
+	assert.Equal(t, QuotaExceeded, received[1].Type)
+	assert.Equal(t, "bob", received[2].User)
+	assert.False(t, received[2].Time.IsZero())
+}
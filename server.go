@@ -4,14 +4,27 @@ import (
 	"context"
 	"errors"
 	"go.uber.org/zap"
+	"gofly/pkg/accesslog"
+	"gofly/pkg/acl"
+	"gofly/pkg/api"
+	"gofly/pkg/audit"
+	"gofly/pkg/ban"
 	"gofly/pkg/config"
+	"gofly/pkg/connlimit"
 	"gofly/pkg/device/tun"
 	"gofly/pkg/engine"
+	"gofly/pkg/engine/tunnel/statistic"
 	"gofly/pkg/logger"
 	"gofly/pkg/protocol/basic"
+	"gofly/pkg/protocol/grpc"
 	"gofly/pkg/protocol/reality"
 	"gofly/pkg/protocol/ws"
+	"gofly/pkg/quota"
+	"gofly/pkg/ratelimit"
+	"gofly/pkg/realip"
+	"gofly/pkg/session"
 	"gofly/pkg/statistics"
+	"gofly/pkg/webhook"
 	"log"
 )
 
@@ -21,8 +34,8 @@ var stats *statistics.Statistics
 
 func StartServer(config *config.Config) {
 	_ctx, cancel = context.WithCancel(context.Background())
-	stats = &statistics.Statistics{}
-	go stats.AutoUpdateChartData()
+	stats = statistics.New()
+	go stats.Run(_ctx)
 	bs := basic.Server{
 		Config:     config,
 		ReadFunc:   ReadFromTun,
@@ -30,6 +43,102 @@ func StartServer(config *config.Config) {
 		CTX:        _ctx,
 		Statistics: stats,
 	}
+	if err := config.DNSSettings.Check(); err != nil {
+		logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+		return
+	}
+	if len(config.ACLSettings.Rules) > 0 || config.ACLSettings.Default != "" {
+		a, err := acl.New(&config.ACLSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		acl.SetDefault(a)
+	}
+	if len(config.WebhookSettings.Hooks) > 0 {
+		d, err := webhook.New(&config.WebhookSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		defer d.Close()
+		webhook.SetDefault(d)
+	}
+	if config.RateLimitSettings.Enabled() {
+		l, err := ratelimit.New(&config.RateLimitSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		ratelimit.SetDefault(l)
+	}
+	if config.QuotaSettings.Enabled() {
+		q, err := quota.New(&config.QuotaSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		defer q.Close()
+		quota.SetDefault(q)
+	}
+	if config.StatsSettings.Path != "" {
+		store, err := statistics.OpenStore(&config.StatsSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		defer store.Close()
+		statistics.SetDefaultStore(store)
+		session.SetRecorder(store.Record)
+	}
+	if config.AuditSettings.Path != "" {
+		l, err := audit.Open(&config.AuditSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		defer l.Close()
+		audit.SetDefault(l)
+	}
+	if config.BanSettings.Enabled() {
+		m, err := ban.New(&config.BanSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		defer m.Close()
+		ban.SetDefault(m)
+	}
+	if config.LimitSettings.Enabled() {
+		m, err := connlimit.New(&config.LimitSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		connlimit.SetDefault(m)
+	}
+	if config.RealIPSettings.Enabled() {
+		r, err := realip.New(&config.RealIPSettings)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		realip.SetDefault(r)
+	}
+	if config.AccessLogSettings.Path != "" {
+		al, err := accesslog.Open(config.AccessLogSettings.Path)
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		defer al.Close()
+		statistic.DefaultManager.SetRecorder(al.Record)
+	}
+	if config.APISettings.ListenAddr != "" {
+		as := &api.Server{Config: &config.APISettings, Statistics: stats}
+		as.Init()
+		go as.Start()
+	}
 	go RunTun2Socks(config, _ctx)
 	var server basic.ServerForApi
 	var err error
@@ -54,6 +163,16 @@ func StartServer(config *config.Config) {
 			Server: bs,
 		}
 		break
+	case "grpc", "grpcs":
+		err = config.GRPCSettings.Check()
+		if err != nil {
+			logger.Logger.Sugar().Errorf("error: %v\n", zap.Error(err))
+			return
+		}
+		server = &grpc.Server{
+			Server: bs,
+		}
+		break
 	default:
 		log.Panic(errors.New("unsupported protocol"))
 	}
@@ -65,6 +184,8 @@ func StartServer(config *config.Config) {
 
 func RunTun2Socks(config *config.Config, _ctx context.Context) {
 	engine.Insert(&config.Tun2SocksSettings)
+	engine.InsertDNS(&config.DNSSettings)
+	engine.InsertSniff(&config.SniffSettings)
 	engine.Start()
 	defer engine.Stop()
 	<-_ctx.Done()